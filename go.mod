@@ -0,0 +1,10 @@
+module github.com/adamcrossland/grog
+
+go 1.18
+
+require (
+	golang.org/x/crypto v0.9.0
+	golang.org/x/term v0.10.0
+)
+
+require golang.org/x/sys v0.10.0 // indirect
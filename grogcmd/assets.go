@@ -161,3 +161,50 @@ func updateAsset(assetName string, source io.Reader) {
 		os.Exit(-1)
 	}
 }
+
+func listAssetHistory(assetName string) {
+	grog = getModel()
+
+	versions, versionsErr := grog.AssetVersions(assetName)
+	if versionsErr != nil {
+		fmt.Printf("Error loading versions of asset %s: %v\n", assetName, versionsErr)
+		os.Exit(-1)
+	}
+
+	columnData := make([][]string, len(versions))
+
+	for row, version := range versions {
+		columnData[row] = make([]string, 6)
+		columnData[row][0] = fmt.Sprintf("%d", version.Version)
+		columnData[row][1] = version.MimeType
+
+		if version.ServeExternal {
+			columnData[row][2] = "+ext"
+		} else {
+			columnData[row][2] = "-ext"
+		}
+
+		if version.Rendered {
+			columnData[row][3] = "+rnd"
+		} else {
+			columnData[row][3] = "-rnd"
+		}
+
+		columnData[row][4] = fmt.Sprintf("%d bytes", version.Size)
+		columnData[row][5] = version.Added.Val().Format("Jan 2 2006 15:04")
+	}
+
+	tabularOutput(columnData)
+}
+
+func restoreAsset(assetName string, version int64) {
+	grog = getModel()
+
+	restoreErr := grog.RestoreAssetVersion(assetName, version)
+	if restoreErr != nil {
+		fmt.Printf("Error restoring version %d of asset %s: %v\n", version, assetName, restoreErr)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("asset %s restored to version %d\n", assetName, version)
+}
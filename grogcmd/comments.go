@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func listComments(status string) {
+	comments, err := grog.AllComments(status)
+	if err != nil {
+		fmt.Printf("error loading comments: %v\n", err)
+		os.Exit(-1)
+	}
+
+	columnData := make([][]string, len(comments)+1)
+	columnData[0] = []string{"ID", "Content ID", "Reply To", "Status", "Added", "Author", "Body"}
+
+	for row, comment := range comments {
+		columnData[row+1] = []string{
+			fmt.Sprintf("%d", comment.ID),
+			fmt.Sprintf("%d", comment.Content),
+			fmt.Sprintf("%d", comment.Parent),
+			comment.Status,
+			comment.Added.Val().Format("Jan 2 2006 15:04"),
+			comment.AuthorName,
+			strings.Replace(comment.Body, "\n", "\\n", -1),
+		}
+	}
+
+	tabularOutput(columnData)
+}
+
+func setCommentStatus(commentID int64, status string) {
+	comment, commentErr := grog.GetComment(commentID)
+	if commentErr != nil {
+		fmt.Printf("error loading comment %d: %v\n", commentID, commentErr)
+		os.Exit(-1)
+	}
+
+	comment.Status = status
+	saveErr := comment.Save()
+	if saveErr != nil {
+		fmt.Printf("error saving comment %d: %v\n", commentID, saveErr)
+		os.Exit(-1)
+	}
+}
+
+func deleteComment(commentID int64) {
+	comment, commentErr := grog.GetComment(commentID)
+	if commentErr != nil {
+		fmt.Printf("error loading comment %d: %v\n", commentID, commentErr)
+		os.Exit(-1)
+	}
+
+	delErr := comment.Delete()
+	if delErr != nil {
+		fmt.Printf("error deleting comment %d: %v\n", commentID, delErr)
+		os.Exit(-1)
+	}
+}
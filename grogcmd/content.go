@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"html"
 	"io"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	model "github.com/adamcrossland/grog/models"
 )
@@ -32,6 +35,9 @@ var contentColumns = []string{
 	"Author ID",
 	"Added",
 	"Modified",
+	"Status",
+	"Publish At",
+	"Body Format",
 }
 
 func listContent(longListing bool) {
@@ -61,7 +67,7 @@ func listContent(longListing bool) {
 	for row := 0; row < len(allContent); row++ {
 		contentRow := allContent[row]
 		if !longListing {
-			columnData[row+1] = make([]string, 10)
+			columnData[row+1] = make([]string, len(contentColumns))
 		}
 
 		// Make sure that the part of the Body that we show does not have CRLFs in it
@@ -82,6 +88,9 @@ func listContent(longListing bool) {
 				contentRow.Added.Val().Day(), contentRow.Added.Val().Year())
 			columnData[9][1] = fmt.Sprintf("%d %d %d", contentRow.Modified.Val().Month(),
 				contentRow.Modified.Val().Day(), contentRow.Modified.Val().Year())
+			columnData[10][1] = contentRow.Status
+			columnData[11][1] = publishAtText(contentRow)
+			columnData[12][1] = contentRow.BodyFormat
 		} else {
 			columnData[row+1][0] = fmt.Sprintf("%d", contentRow.ID)
 			columnData[row+1][1] = fmt.Sprintf("%.10s", contentRow.Title)
@@ -96,6 +105,9 @@ func listContent(longListing bool) {
 				contentRow.Added.Val().Day(), contentRow.Added.Val().Year())
 			columnData[row+1][9] = fmt.Sprintf("%d %d %d", contentRow.Modified.Val().Month(),
 				contentRow.Modified.Val().Day(), contentRow.Modified.Val().Year())
+			columnData[row+1][10] = contentRow.Status
+			columnData[row+1][11] = publishAtText(contentRow)
+			columnData[row+1][12] = contentRow.BodyFormat
 		}
 
 		if longListing {
@@ -109,6 +121,14 @@ func listContent(longListing bool) {
 	}
 }
 
+func publishAtText(content *model.Content) string {
+	if content.PublishAt.IsNull() {
+		return ""
+	}
+
+	return content.PublishAt.Val().Format("2006-01-02T15:04")
+}
+
 func addContent(source io.Reader) {
 	fmt.Print("Title: ")
 	title := strings.TrimSuffix(readStringToEOL(source), "\n")
@@ -170,3 +190,149 @@ func deleteContent(contentID int64) {
 		return
 	}
 }
+
+func listContentHistory(contentID int64) {
+	revisions, revisionsErr := grog.ContentRevisions(contentID)
+	if revisionsErr != nil {
+		fmt.Printf("error loading history of content item %d: %v\n", contentID, revisionsErr)
+		os.Exit(-1)
+	}
+
+	columnData := make([][]string, len(revisions)+1)
+	columnData[0] = []string{"Revision", "Author ID", "Added", "Title"}
+
+	for row, revision := range revisions {
+		columnData[row+1] = make([]string, 4)
+		columnData[row+1][0] = fmt.Sprintf("%d", revision.Revision)
+		columnData[row+1][1] = fmt.Sprintf("%d", revision.Author)
+		columnData[row+1][2] = revision.Added.Val().Format("Jan 2 2006 15:04")
+		columnData[row+1][3] = revision.Title
+	}
+
+	tabularOutput(columnData)
+}
+
+func diffContentRevisions(contentID int64, fromRevision int64, toRevision int64) {
+	from, fromErr := grog.GetContentRevision(contentID, fromRevision)
+	if fromErr != nil {
+		fmt.Printf("error loading revision %d: %v\n", fromRevision, fromErr)
+		os.Exit(-1)
+	}
+
+	to, toErr := grog.GetContentRevision(contentID, toRevision)
+	if toErr != nil {
+		fmt.Printf("error loading revision %d: %v\n", toRevision, toErr)
+		os.Exit(-1)
+	}
+
+	fmt.Print(from.Diff(to))
+}
+
+func searchContent(query string) {
+	results, searchErr := grog.SearchContent(query, 0, true)
+	if searchErr != nil {
+		fmt.Printf("error searching content: %v\n", searchErr)
+		os.Exit(-1)
+	}
+
+	// Snippets are meant for web pages, so put them back into plain text with the
+	// matching words set off by asterisks.
+	plainSnippet := strings.NewReplacer("<mark>", "*", "</mark>", "*")
+
+	columnData := make([][]string, len(results)+1)
+	columnData[0] = []string{"ID", "Status", "Title", "Snippet"}
+
+	for row, result := range results {
+		columnData[row+1] = make([]string, 4)
+		columnData[row+1][0] = fmt.Sprintf("%d", result.Content.ID)
+		columnData[row+1][1] = result.Content.Status
+		columnData[row+1][2] = result.Content.Title
+		columnData[row+1][3] = html.UnescapeString(plainSnippet.Replace(result.Snippet))
+	}
+
+	tabularOutput(columnData)
+}
+
+func revertContent(contentID int64, revision int64) {
+	content, contentErr := grog.GetContent(contentID)
+	if contentErr != nil {
+		fmt.Printf("error loading content item %d: %v\n", contentID, contentErr)
+		os.Exit(-1)
+	}
+
+	restoreErr := content.Restore(revision)
+	if restoreErr != nil {
+		fmt.Printf("error reverting content item %d to revision %d: %v\n", contentID, revision, restoreErr)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("content item %d reverted to revision %d\n", contentID, revision)
+}
+
+// setContentProps applies name=value settings, as given on the command line, to a
+// content item.
+func setContentProps(contentID int64, settings []string) {
+	content, contentErr := grog.GetContent(contentID)
+	if contentErr != nil {
+		fmt.Printf("error loading content item %d: %v\n", contentID, contentErr)
+		os.Exit(-1)
+	}
+
+	for _, setting := range settings {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			fmt.Printf("setting %s must have the form name=value\n", setting)
+			os.Exit(-1)
+		}
+
+		switch strings.ToLower(parts[0]) {
+		case "template":
+			content.Template = parts[1]
+		case "parent", "author":
+			intVal, convErr := strconv.ParseInt(parts[1], 10, 64)
+			if convErr != nil {
+				fmt.Printf("%s must be convertible to an integer\n", parts[0])
+				os.Exit(-1)
+			}
+			if strings.ToLower(parts[0]) == "parent" {
+				content.Parent = intVal
+			} else {
+				content.Author = intVal
+			}
+		case "status":
+			if !model.ValidContentStatus(parts[1]) {
+				fmt.Printf("status must be one of draft, scheduled, published or archived\n")
+				os.Exit(-1)
+			}
+			content.Status = parts[1]
+		case "publish":
+			if len(parts[1]) == 0 {
+				content.PublishAt.Null = true
+				content.PublishAt.Time = time.Time{}
+				break
+			}
+			publishAt, parseErr := time.ParseInLocation("2006-01-02T15:04", parts[1], time.Local)
+			if parseErr != nil {
+				fmt.Printf("publish must have the form 2006-01-02T15:04\n")
+				os.Exit(-1)
+			}
+			content.PublishAt.Set(publishAt)
+		case "format":
+			if !model.ValidBodyFormat(parts[1]) {
+				fmt.Printf("format must be one of html, markdown or plain\n")
+				os.Exit(-1)
+			}
+			content.BodyFormat = parts[1]
+		default:
+			fmt.Printf("setting %s not understood\n", parts[0])
+			helpContentCmd(false)
+			os.Exit(-1)
+		}
+	}
+
+	saveErr := content.Save()
+	if saveErr != nil {
+		fmt.Printf("error saving content item %d: %v\n", contentID, saveErr)
+		os.Exit(-1)
+	}
+}
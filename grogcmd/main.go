@@ -130,6 +130,29 @@ func main() {
 				}
 
 				updateAsset(assetName, source)
+			case "history":
+				if len(args) < 4 {
+					fmt.Printf("asset history: too few parameters\n")
+					helpAssetCmd(false)
+					os.Exit(-1)
+				}
+
+				listAssetHistory(args[3])
+			case "restore":
+				if len(args) < 5 {
+					fmt.Printf("asset restore: too few parameters\n")
+					helpAssetCmd(false)
+					os.Exit(-1)
+				}
+
+				version, convErr := strconv.ParseInt(args[4], 10, 64)
+				if convErr != nil {
+					fmt.Printf("version must be convertible to an integer\n")
+					helpAssetCmd(false)
+					os.Exit(-1)
+				}
+
+				restoreAsset(args[3], version)
 			default:
 				fmt.Printf("asset sub-command %s not understood\n", args[2])
 				helpAssetCmd(false)
@@ -184,6 +207,67 @@ func main() {
 				}
 			case "ls":
 				listUsers()
+			case "role":
+				if len(args) == 5 {
+					userIDInt, convErr := strconv.ParseInt(args[3], 10, 64)
+					if convErr != nil {
+						fmt.Printf("userid parameter must be convertible to an integer\n")
+						helpUserCmd(false)
+						os.Exit(-1)
+					}
+
+					setUserRole(userIDInt, strings.ToLower(args[4]))
+				} else {
+					helpUserCmd(false)
+					os.Exit(-1)
+				}
+			case "passwd":
+				if len(args) >= 4 {
+					userIDInt, convErr := strconv.ParseInt(args[3], 10, 64)
+					if convErr != nil {
+						fmt.Printf("userid parameter must be convertible to an integer\n")
+						helpUserCmd(false)
+						os.Exit(-1)
+					}
+
+					if len(args) >= 5 && strings.ToLower(args[4]) == "-reset" {
+						resetUserPassword(userIDInt)
+					} else {
+						setUserPassword(userIDInt, os.Stdin)
+					}
+				} else {
+					helpUserCmd(false)
+					os.Exit(-1)
+				}
+			case "token":
+				if len(args) >= 5 {
+					idArg, convErr := strconv.ParseInt(args[4], 10, 64)
+					if convErr != nil {
+						fmt.Printf("id parameter must be convertible to an integer\n")
+						helpUserCmd(false)
+						os.Exit(-1)
+					}
+
+					switch strings.ToLower(args[3]) {
+					case "add":
+						tokenName := ""
+						if len(args) >= 6 {
+							tokenName = args[5]
+						}
+						addUserToken(idArg, tokenName)
+					case "ls":
+						listUserTokens(idArg)
+					case "rm":
+						deleteUserToken(idArg)
+					default:
+						fmt.Printf("user token sub-command %s not understood\n", args[3])
+						helpUserCmd(false)
+						os.Exit(-1)
+					}
+				} else {
+					helpUserCmd(false)
+					os.Exit(-1)
+				}
 			default:
 				fmt.Printf("user sub-command %s not understood\n", args[2])
 				helpUserCmd(false)
@@ -240,7 +324,7 @@ func main() {
 				fmt.Printf("content rm: too few parameters\n")
 				helpContentCmd(false)
 				os.Exit(-1)
-			} 
+			}
 
 			contentID := args[3]
 			contentIDInt, convErr := strconv.ParseInt(contentID, 10, 64)
@@ -251,9 +335,208 @@ func main() {
 			}
 
 			deleteContent(contentIDInt)
+		case "set":
+			if len(args) < 5 {
+				fmt.Printf("content set: too few parameters\n")
+				helpContentCmd(false)
+				os.Exit(-1)
+			}
+
+			contentIDInt, convErr := strconv.ParseInt(args[3], 10, 64)
+			if convErr != nil {
+				fmt.Printf("contentid must be convertible to an integer\n")
+				helpContentCmd(false)
+				os.Exit(-1)
+			}
+
+			setContentProps(contentIDInt, args[4:])
+		case "history":
+			if len(args) < 4 {
+				fmt.Printf("content history: too few parameters\n")
+				helpContentCmd(false)
+				os.Exit(-1)
+			}
+
+			contentIDInt, convErr := strconv.ParseInt(args[3], 10, 64)
+			if convErr != nil {
+				fmt.Printf("contentid must be convertible to an integer\n")
+				helpContentCmd(false)
+				os.Exit(-1)
+			}
+
+			listContentHistory(contentIDInt)
+		case "diff", "revert":
+			minArgs := 5
+			if strings.ToLower(args[2]) == "diff" {
+				minArgs = 6
+			}
+			if len(args) < minArgs {
+				fmt.Printf("content %s: too few parameters\n", args[2])
+				helpContentCmd(false)
+				os.Exit(-1)
+			}
+
+			intArgs := make([]int64, minArgs-3)
+			for i := range intArgs {
+				var convErr error
+				intArgs[i], convErr = strconv.ParseInt(args[3+i], 10, 64)
+				if convErr != nil {
+					fmt.Printf("contentid and revisions must be convertible to integers\n")
+					helpContentCmd(false)
+					os.Exit(-1)
+				}
+			}
+
+			if strings.ToLower(args[2]) == "diff" {
+				diffContentRevisions(intArgs[0], intArgs[1], intArgs[2])
+			} else {
+				revertContent(intArgs[0], intArgs[1])
+			}
+		case "search":
+			if len(args) < 4 {
+				fmt.Printf("content search: too few parameters\n")
+				helpContentCmd(false)
+				os.Exit(-1)
+			}
+
+			searchContent(strings.Join(args[3:], " "))
+		case "tag", "untag":
+			if len(args) < 5 {
+				fmt.Printf("content %s: too few parameters\n", args[2])
+				helpContentCmd(false)
+				os.Exit(-1)
+			}
+
+			contentIDInt, convErr := strconv.ParseInt(args[3], 10, 64)
+			if convErr != nil {
+				fmt.Printf("contentid must be convertible to an integer\n")
+				helpContentCmd(false)
+				os.Exit(-1)
+			}
+
+			if strings.ToLower(args[2]) == "tag" {
+				tagContent(contentIDInt, args[4:])
+			} else {
+				untagContent(contentIDInt, args[4:])
+			}
 		default:
 			helpContentCmd(false)
 		}
+	case "comment":
+		if len(args) < 3 {
+			helpCommentCmd(false)
+			os.Exit(-1)
+		}
+
+		switch strings.ToLower(args[2]) {
+		case "ls":
+			status := ""
+			if len(args) > 3 {
+				status = strings.ToLower(args[3])
+				if !model.ValidCommentStatus(status) {
+					fmt.Printf("unknown comment status %s\n", args[3])
+					helpCommentCmd(false)
+					os.Exit(-1)
+				}
+			}
+
+			listComments(status)
+		case "approve", "spam", "rm":
+			if len(args) < 4 {
+				fmt.Printf("comment %s: too few parameters\n", args[2])
+				helpCommentCmd(false)
+				os.Exit(-1)
+			}
+
+			commentIDInt, convErr := strconv.ParseInt(args[3], 10, 64)
+			if convErr != nil {
+				fmt.Printf("commentid must be convertible to an integer\n")
+				helpCommentCmd(false)
+				os.Exit(-1)
+			}
+
+			switch strings.ToLower(args[2]) {
+			case "approve":
+				setCommentStatus(commentIDInt, model.CommentApproved)
+			case "spam":
+				setCommentStatus(commentIDInt, model.CommentSpam)
+			default:
+				deleteComment(commentIDInt)
+			}
+		default:
+			helpCommentCmd(false)
+		}
+	case "tag":
+		if len(args) < 3 {
+			helpTagCmd(false)
+			os.Exit(-1)
+		}
+
+		switch strings.ToLower(args[2]) {
+		case "ls":
+			listTags()
+		case "show":
+			if len(args) < 4 {
+				fmt.Printf("tag show: too few parameters\n")
+				helpTagCmd(false)
+				os.Exit(-1)
+			}
+
+			showTag(strings.Join(args[3:], " "))
+		default:
+			helpTagCmd(false)
+		}
+	case "query":
+		if len(args) < 3 {
+			helpQueryCmd(false)
+			os.Exit(-1)
+		}
+
+		queryCmd := strings.ToLower(args[2])
+		if queryCmd != "ls" && len(args) < 4 {
+			fmt.Printf("query %s: too few parameters\n", queryCmd)
+			helpQueryCmd(false)
+			os.Exit(-1)
+		}
+
+		switch queryCmd {
+		case "add", "update":
+			source := os.Stdin
+
+			if len(args) >= 5 {
+				// Get filename for the query from command line
+				var fileErr error
+				source, fileErr = os.Open(args[4])
+				if fileErr != nil {
+					fmt.Printf("error opening file %s: %v\n", args[4], fileErr)
+					os.Exit(-1)
+				}
+			}
+
+			if queryCmd == "add" {
+				addQuery(args[3], source)
+			} else {
+				updateQuery(args[3], source)
+			}
+		case "ls":
+			listQueries()
+		case "show":
+			showQuery(args[3])
+		case "rm":
+			deleteQuery(args[3])
+		case "set":
+			if len(args) < 5 {
+				fmt.Printf("query set: too few parameters\n")
+				helpQueryCmd(false)
+				os.Exit(-1)
+			}
+
+			setQueryProps(args[3], args[4:])
+		case "test":
+			testQuery(args[3], args[4:])
+		default:
+			helpQueryCmd(false)
+		}
 	default:
 		help()
 	}
@@ -278,6 +561,9 @@ func help() {
 	fmt.Println("Usage:")
 	helpAssetCmd(true)
 	helpContentCmd(true)
+	helpCommentCmd(true)
+	helpTagCmd(true)
+	helpQueryCmd(true)
 	helpUserCmd(true)
 }
 
@@ -290,6 +576,8 @@ func helpAssetCmd(usageShown bool) {
 	fmt.Printf("\t              set [+-ext] [+-render] <file|directory>\n")
 	fmt.Printf("\t              ls\n")
 	fmt.Printf("\t				update <assetname> [filename]\n")
+	fmt.Printf("\t              history <assetname>\n")
+	fmt.Printf("\t              restore <assetname> <version>\n")
 	fmt.Println()
 }
 
@@ -300,6 +588,11 @@ func helpUserCmd(usageShown bool) {
 	fmt.Printf("\tgrogcmd user add \"name\" \"emailAddress\"\n")
 	fmt.Printf("\t             rm id\n")
 	fmt.Printf("\t             ls\n")
+	fmt.Printf("\t             role userid admin|editor|author|viewer\n")
+	fmt.Printf("\t             passwd userid [-reset]\n")
+	fmt.Printf("\t             token add userid [\"name\"]\n")
+	fmt.Printf("\t                   ls userid\n")
+	fmt.Printf("\t                   rm tokenid\n")
 	fmt.Println()
 }
 
@@ -310,7 +603,49 @@ func helpContentCmd(usageShown bool) {
 	fmt.Printf("\tgrogcmd content ls -l\n")
 	fmt.Printf("\t                add\n")
 	fmt.Printf("\t                set contentid [template=templatename] [parent=parentid] [author=authorid]\n")
+	fmt.Printf("\t                              [status=draft|scheduled|published|archived] [publish=2006-01-02T15:04]\n")
+	fmt.Printf("\t                              [format=html|markdown|plain]\n")
 	fmt.Printf("\t                update contentid [filename]\n")
 	fmt.Printf("\t                rm contentid\n")
+	fmt.Printf("\t                history contentid\n")
+	fmt.Printf("\t                diff contentid fromrevision torevision\n")
+	fmt.Printf("\t                revert contentid revision\n")
+	fmt.Printf("\t                search terms...\n")
+	fmt.Printf("\t                tag contentid tagname...\n")
+	fmt.Printf("\t                untag contentid tagname...\n")
+	fmt.Println()
+}
+
+func helpCommentCmd(usageShown bool) {
+	if !usageShown {
+		fmt.Println("Usage:")
+	}
+	fmt.Printf("\tgrogcmd comment ls [pending|approved|spam]\n")
+	fmt.Printf("\t                approve commentid\n")
+	fmt.Printf("\t                spam commentid\n")
+	fmt.Printf("\t                rm commentid\n")
+	fmt.Println()
+}
+
+func helpTagCmd(usageShown bool) {
+	if !usageShown {
+		fmt.Println("Usage:")
+	}
+	fmt.Printf("\tgrogcmd tag ls\n")
+	fmt.Printf("\t            show tagname\n")
+	fmt.Println()
+}
+
+func helpQueryCmd(usageShown bool) {
+	if !usageShown {
+		fmt.Println("Usage:")
+	}
+	fmt.Printf("\tgrogcmd query add name [filename]\n")
+	fmt.Printf("\t              ls\n")
+	fmt.Printf("\t              show name\n")
+	fmt.Printf("\t              update name [filename]\n")
+	fmt.Printf("\t              set name [timeout=5s] [maxrows=1000] [public=true] [\"params=id:int limit:int=10\"]\n")
+	fmt.Printf("\t              rm name\n")
+	fmt.Printf("\t              test name [param...]\n")
 	fmt.Println()
 }
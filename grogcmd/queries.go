@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamcrossland/grog/mtemplate"
+)
+
+func readQuery(source *os.File) string {
+	if source == os.Stdin {
+		fmt.Println("Query: (__EOF__ to finish)")
+	}
+
+	return strings.TrimSpace(readDocument(source, "__EOF__"))
+}
+
+func addQuery(name string, source *os.File) {
+	newQuery := grog.NewNamedQuery(name, readQuery(source))
+
+	saveErr := newQuery.Save()
+	if saveErr != nil {
+		fmt.Printf("error saving new query %s: %v\n", name, saveErr)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("Added new query %s with id %d\n", name, newQuery.ID)
+}
+
+func listQueries() {
+	allQueries, err := grog.AllNamedQueries()
+	if err != nil {
+		fmt.Printf("error loading queries: %v\n", err)
+		os.Exit(-1)
+	}
+
+	columnData := make([][]string, len(allQueries)+1)
+	columnData[0] = []string{"ID", "Name", "Added", "Modified", "Query"}
+
+	for row, query := range allQueries {
+		columnData[row+1] = []string{
+			fmt.Sprintf("%d", query.ID),
+			query.Name,
+			query.Added.Val().Format("Jan 2 2006 15:04"),
+			query.Modified.Val().Format("Jan 2 2006 15:04"),
+			strings.Join(strings.Fields(query.Query), " "),
+		}
+	}
+
+	tabularOutput(columnData)
+}
+
+func setQueryProps(name string, settings []string) {
+	query, queryErr := grog.GetNamedQuery(name)
+	if queryErr != nil {
+		fmt.Printf("error loading query %s: %v\n", name, queryErr)
+		os.Exit(-1)
+	}
+
+	for _, setting := range settings {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			fmt.Printf("setting %s must have the form name=value\n", setting)
+			os.Exit(-1)
+		}
+
+		switch strings.ToLower(parts[0]) {
+		case "timeout":
+			timeout, parseErr := time.ParseDuration(parts[1])
+			if parseErr != nil || timeout < 0 {
+				fmt.Printf("timeout must be a duration such as 500ms or 5s, or 0 for the default\n")
+				os.Exit(-1)
+			}
+			query.Timeout = timeout
+		case "maxrows":
+			maxRows, convErr := strconv.Atoi(parts[1])
+			if convErr != nil || maxRows < 0 {
+				fmt.Printf("maxrows must be a positive integer, or 0 for the default\n")
+				os.Exit(-1)
+			}
+			query.MaxRows = maxRows
+		case "public":
+			public, parseErr := strconv.ParseBool(parts[1])
+			if parseErr != nil {
+				fmt.Printf("public must be true or false\n")
+				os.Exit(-1)
+			}
+			query.Public = public
+		case "params":
+			if _, paramsErr := mtemplate.ParseModelParameters(parts[1]); paramsErr != nil {
+				fmt.Printf("params are not valid: %v\n", paramsErr)
+				os.Exit(-1)
+			}
+			query.Params = strings.Join(strings.Fields(parts[1]), " ")
+		default:
+			fmt.Printf("setting %s not understood\n", parts[0])
+			helpQueryCmd(false)
+			os.Exit(-1)
+		}
+	}
+
+	saveErr := query.Save()
+	if saveErr != nil {
+		fmt.Printf("error saving query %s: %v\n", name, saveErr)
+		os.Exit(-1)
+	}
+}
+
+func showQuery(name string) {
+	query, queryErr := grog.GetNamedQuery(name)
+	if queryErr != nil {
+		fmt.Printf("error loading query %s: %v\n", name, queryErr)
+		os.Exit(-1)
+	}
+
+	// Limits of 0 mean that the server's defaults apply
+	timeout, maxRows := "default", "default"
+	if query.Timeout > 0 {
+		timeout = query.Timeout.String()
+	}
+	if query.MaxRows > 0 {
+		maxRows = fmt.Sprintf("%d", query.MaxRows)
+	}
+
+	tabularOutput([][]string{
+		{"ID", fmt.Sprintf("%d", query.ID)},
+		{"Name", query.Name},
+		{"Added", query.Added.Val().Format("Jan 2 2006 15:04")},
+		{"Modified", query.Modified.Val().Format("Jan 2 2006 15:04")},
+		{"Timeout", timeout},
+		{"Max Rows", maxRows},
+		{"Public", fmt.Sprintf("%v", query.Public)},
+		{"Params", query.Params},
+	})
+	fmt.Println()
+	fmt.Println(query.Query)
+}
+
+func updateQuery(name string, source *os.File) {
+	query, queryErr := grog.GetNamedQuery(name)
+	if queryErr != nil {
+		fmt.Printf("error loading query %s: %v\n", name, queryErr)
+		os.Exit(-1)
+	}
+
+	query.Query = readQuery(source)
+
+	saveErr := query.Save()
+	if saveErr != nil {
+		fmt.Printf("error saving query %s: %v\n", name, saveErr)
+		os.Exit(-1)
+	}
+}
+
+func deleteQuery(name string) {
+	query, queryErr := grog.GetNamedQuery(name)
+	if queryErr != nil {
+		fmt.Printf("error loading query %s: %v\n", name, queryErr)
+		os.Exit(-1)
+	}
+
+	delErr := query.Delete()
+	if delErr != nil {
+		fmt.Printf("error deleting query %s: %v\n", name, delErr)
+		os.Exit(-1)
+	}
+}
+
+// testQuery runs a query just as a template would, with parameters given on the
+// command line, and shows its results. Parameters that can be read as numbers are
+// passed as numbers; any others are passed as text.
+func testQuery(name string, params []string) {
+	query, queryErr := grog.GetNamedQuery(name)
+	if queryErr != nil {
+		fmt.Printf("error loading query %s: %v\n", name, queryErr)
+		os.Exit(-1)
+	}
+
+	queryParams := make([]interface{}, len(params))
+	for i, param := range params {
+		if asInt, intErr := strconv.ParseInt(param, 10, 64); intErr == nil {
+			queryParams[i] = asInt
+		} else if asFloat, floatErr := strconv.ParseFloat(param, 64); floatErr == nil {
+			queryParams[i] = asFloat
+		} else {
+			queryParams[i] = param
+		}
+	}
+
+	results, runErr := grog.MakeNamedQuerier(query)(queryParams)
+	if runErr != nil {
+		fmt.Printf("error running query %s: %v\n", name, runErr)
+		os.Exit(-1)
+	}
+
+	rows, rowsErr := results.All()
+	if rowsErr != nil {
+		fmt.Printf("error reading results of query %s: %v\n", name, rowsErr)
+		os.Exit(-1)
+	}
+
+	columns := results.Columns()
+	columnData := make([][]string, len(rows)+1)
+	columnData[0] = columns
+
+	for row, values := range rows {
+		columnData[row+1] = make([]string, len(columns))
+		for col, colName := range columns {
+			columnData[row+1][col] = queryValueText(values[colName])
+		}
+	}
+
+	tabularOutput(columnData)
+	fmt.Printf("%d rows\n", len(rows))
+}
+
+func queryValueText(value interface{}) string {
+	var text string
+
+	switch v := value.(type) {
+	case nil:
+		text = "NULL"
+	case []byte:
+		text = string(v)
+	case time.Time:
+		text = v.Format("Jan 2 2006 15:04")
+	default:
+		text = fmt.Sprint(v)
+	}
+
+	return strings.Replace(text, "\n", "\\n", -1)
+}
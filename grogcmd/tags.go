@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func tagContent(contentID int64, tagNames []string) {
+	content, contentErr := grog.GetContent(contentID)
+	if contentErr != nil {
+		fmt.Printf("error loading content item %d: %v\n", contentID, contentErr)
+		os.Exit(-1)
+	}
+
+	tagErr := content.Tag(tagNames...)
+	if tagErr != nil {
+		fmt.Printf("error tagging content item %d: %v\n", contentID, tagErr)
+		os.Exit(-1)
+	}
+}
+
+func untagContent(contentID int64, tagNames []string) {
+	content, contentErr := grog.GetContent(contentID)
+	if contentErr != nil {
+		fmt.Printf("error loading content item %d: %v\n", contentID, contentErr)
+		os.Exit(-1)
+	}
+
+	untagErr := content.Untag(tagNames...)
+	if untagErr != nil {
+		fmt.Printf("error removing tags from content item %d: %v\n", contentID, untagErr)
+		os.Exit(-1)
+	}
+}
+
+func listTags() {
+	allTags, err := grog.AllTags()
+	if err != nil {
+		fmt.Printf("error loading tags: %v\n", err)
+		os.Exit(-1)
+	}
+
+	columnData := make([][]string, len(allTags)+1)
+	columnData[0] = []string{"Name", "Content Count"}
+
+	for row, tag := range allTags {
+		tag.SetPreview(true)
+		columnData[row+1] = []string{tag.Name, fmt.Sprintf("%d", len(tag.Contents()))}
+	}
+
+	tabularOutput(columnData)
+}
+
+func showTag(tagName string) {
+	tagged, err := grog.ContentsWithTag(tagName, true)
+	if err != nil {
+		fmt.Printf("error loading content tagged %s: %v\n", tagName, err)
+		os.Exit(-1)
+	}
+
+	columnData := make([][]string, len(tagged)+1)
+	columnData[0] = []string{"ID", "Status", "Title"}
+
+	for row, content := range tagged {
+		columnData[row+1] = []string{fmt.Sprintf("%d", content.ID), content.Status, content.Title}
+	}
+
+	tabularOutput(columnData)
+}
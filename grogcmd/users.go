@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+
+	model "github.com/adamcrossland/grog/models"
+	"golang.org/x/term"
 )
 
 func listUsers() {
@@ -17,13 +23,158 @@ func listUsers() {
 	columnData := make([][]string, len(users))
 
 	for i := 0; i < len(users); i++ {
-		columnData[i] = make([]string, 4)
+		columnData[i] = make([]string, 5)
 		columnData[i][0] = fmt.Sprintf("%d", users[i].ID)
 		columnData[i][1] = users[i].Name
 		columnData[i][2] = users[i].Email
-		columnData[i][3] = fmt.Sprintf("%s %d %d", users[i].Added.Val().Month(),
+		columnData[i][3] = users[i].Role
+		columnData[i][4] = fmt.Sprintf("%s %d %d", users[i].Added.Val().Month(),
 			users[i].Added.Val().Day(), users[i].Added.Val().Year())
 	}
 
 	tabularOutput(columnData)
 }
+
+func setUserRole(userID int64, role string) {
+	grog := getModel()
+
+	if !model.ValidRole(role) {
+		fmt.Printf("role %s not understood\n", role)
+		helpUserCmd(false)
+		os.Exit(-1)
+	}
+
+	user, userErr := grog.GetUser(userID)
+	if userErr != nil {
+		fmt.Printf("error loading user %d: %v\n", userID, userErr)
+		os.Exit(-1)
+	}
+
+	user.Role = role
+	saveErr := user.Save()
+	if saveErr != nil {
+		fmt.Printf("error saving user %d: %v\n", userID, saveErr)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("user %d is now %s\n", userID, role)
+}
+
+func addUserToken(userID int64, name string) {
+	grog := getModel()
+
+	if _, userErr := grog.GetUser(userID); userErr != nil {
+		fmt.Printf("error loading user %d: %v\n", userID, userErr)
+		os.Exit(-1)
+	}
+
+	newToken, secret, tokenErr := grog.NewAPIToken(userID, name)
+	if tokenErr != nil {
+		fmt.Printf("error adding api token: %v\n", tokenErr)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("api token %d added for user %d. It will not be shown again:\n", newToken.ID, userID)
+	fmt.Printf("%s\n", secret)
+}
+
+func listUserTokens(userID int64) {
+	grog := getModel()
+
+	tokens, tokensErr := grog.UserAPITokens(userID)
+	if tokensErr != nil {
+		fmt.Printf("error loading api tokens from database: %v\n", tokensErr)
+		os.Exit(-1)
+	}
+
+	columnData := make([][]string, len(tokens))
+
+	for i := 0; i < len(tokens); i++ {
+		columnData[i] = make([]string, 4)
+		columnData[i][0] = fmt.Sprintf("%d", tokens[i].ID)
+		columnData[i][1] = tokens[i].Name
+		columnData[i][2] = fmt.Sprintf("%s %d %d", tokens[i].Added.Val().Month(),
+			tokens[i].Added.Val().Day(), tokens[i].Added.Val().Year())
+		if tokens[i].LastUsed.IsNull() {
+			columnData[i][3] = "never used"
+		} else {
+			columnData[i][3] = fmt.Sprintf("%s %d %d", tokens[i].LastUsed.Val().Month(),
+				tokens[i].LastUsed.Val().Day(), tokens[i].LastUsed.Val().Year())
+		}
+	}
+
+	tabularOutput(columnData)
+}
+
+func deleteUserToken(tokenID int64) {
+	grog := getModel()
+
+	delErr := grog.DeleteAPIToken(tokenID)
+	if delErr != nil {
+		fmt.Printf("error deleting api token %d: %v\n", tokenID, delErr)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("api token %d deleted\n", tokenID)
+}
+
+func setUserPassword(userID int64, source io.Reader) {
+	grog := getModel()
+
+	if _, userErr := grog.GetUser(userID); userErr != nil {
+		fmt.Printf("error loading user %d: %v\n", userID, userErr)
+		os.Exit(-1)
+	}
+
+	// Both lines must come from the same reader, or the second read could miss
+	// data that the first one buffered.
+	reader := bufio.NewReader(source)
+
+	password := readPassword("New password: ", source, reader)
+	repeated := readPassword("Repeat password: ", source, reader)
+
+	if password != repeated {
+		fmt.Printf("passwords do not match; password not changed\n")
+		os.Exit(-1)
+	}
+
+	setErr := grog.SetUserPassword(userID, password)
+	if setErr != nil {
+		fmt.Printf("error setting password for user %d: %v\n", userID, setErr)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("password changed for user %d\n", userID)
+}
+
+// readPassword prompts for a password and reads it. From a terminal, the password is
+// read without being shown; otherwise, such as when it is piped in, it is read as a
+// line from reader, which buffers source.
+func readPassword(prompt string, source io.Reader, reader *bufio.Reader) string {
+	fmt.Print(prompt)
+
+	if file, isFile := source.(*os.File); isFile && term.IsTerminal(int(file.Fd())) {
+		password, readErr := term.ReadPassword(int(file.Fd()))
+		fmt.Println()
+		if readErr != nil {
+			fmt.Printf("error reading password: %v\n", readErr)
+			os.Exit(-1)
+		}
+		return string(password)
+	}
+
+	password, _ := reader.ReadString('\n')
+	return strings.TrimSuffix(password, "\n")
+}
+
+func resetUserPassword(userID int64) {
+	grog := getModel()
+
+	password, resetErr := grog.ResetUserPassword(userID)
+	if resetErr != nil {
+		fmt.Printf("error resetting password for user %d: %v\n", userID, resetErr)
+		os.Exit(-1)
+	}
+
+	fmt.Printf("password for user %d reset to: %s\n", userID, password)
+}
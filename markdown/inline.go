@@ -0,0 +1,463 @@
+package markdown
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// inline is one piece of a paragraph's rendered text. Runs of * and _ are kept as
+// delimiters until emphasis has been worked out; everything else is finished HTML.
+type inline struct {
+	html      string
+	delimiter byte
+	count     int // Delimiter characters not yet used for emphasis
+	original  int // Length of the delimiter run as written
+	canOpen   bool
+	canClose  bool
+	before    string // Closing tags that go before the delimiter's remaining characters
+	after     string // Opening tags that go after them
+}
+
+var (
+	autolinkPattern   = regexp.MustCompile(`^<([a-zA-Z][a-zA-Z0-9+.-]{1,31}:[^\s<>]*)>`)
+	emailPattern      = regexp.MustCompile(`^<([a-zA-Z0-9.!#$%&'*+/=?^_` + "`" + `{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*)>`)
+	inlineHTMLPattern = regexp.MustCompile(`^(?:<[a-zA-Z][a-zA-Z0-9-]*(?:\s+[a-zA-Z_:][a-zA-Z0-9_.:-]*(?:\s*=\s*(?:[^\s"'=<>` + "`" + `]+|'[^']*'|"[^"]*"))?)*\s*/?>|</[a-zA-Z][a-zA-Z0-9-]*\s*>|<!--[\s\S]*?-->|<\?[\s\S]*?\?>|<![A-Z]+\s[^>]*>|<!\[CDATA\[[\s\S]*?\]\]>)`)
+	entityPattern     = regexp.MustCompile(`^&(?:#[xX][0-9a-fA-F]{1,6}|#[0-9]{1,7}|[a-zA-Z][a-zA-Z0-9]{1,31});`)
+)
+
+const asciiPunctuation = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// renderInline converts the text of a paragraph or heading into HTML.
+func (p *parser) renderInline(text string) string {
+	var pieces []*inline
+	var literal strings.Builder
+
+	flush := func() {
+		if literal.Len() > 0 {
+			pieces = append(pieces, &inline{html: literal.String()})
+			literal.Reset()
+		}
+	}
+	add := func(markup string) {
+		flush()
+		pieces = append(pieces, &inline{html: markup})
+	}
+
+	for i := 0; i < len(text); {
+		c := text[i]
+
+		switch {
+		case c == '\\' && i+1 < len(text) && strings.IndexByte(asciiPunctuation, text[i+1]) >= 0:
+			literal.WriteString(escapeHTML(text[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '\\' && i+1 < len(text) && text[i+1] == '\n':
+			add("<br />\n")
+			i += 2
+			continue
+		case c == '\n':
+			// Two or more spaces at the end of a line make a hard break.
+			trimmed := strings.TrimRight(literal.String(), " ")
+			hardBreak := literal.Len()-len(trimmed) >= 2
+			literal.Reset()
+			literal.WriteString(trimmed)
+			if hardBreak {
+				add("<br />\n")
+			} else {
+				literal.WriteString("\n")
+			}
+			i++
+			continue
+		case c == '`':
+			if code, end, isCode := parseCodeSpan(text, i); isCode {
+				add("<code>" + escapeHTML(code) + "</code>")
+				i = end
+				continue
+			}
+
+			run := len(text[i:]) - len(strings.TrimLeft(text[i:], "`"))
+			literal.WriteString(text[i : i+run])
+			i += run
+			continue
+		case c == '<':
+			if match := autolinkPattern.FindStringSubmatch(text[i:]); match != nil {
+				add(`<a href="` + escapeURL(match[1]) + `">` + escapeHTML(match[1]) + `</a>`)
+				i += len(match[0])
+				continue
+			}
+			if match := emailPattern.FindStringSubmatch(text[i:]); match != nil {
+				add(`<a href="mailto:` + escapeURL(match[1]) + `">` + escapeHTML(match[1]) + `</a>`)
+				i += len(match[0])
+				continue
+			}
+			if match := inlineHTMLPattern.FindString(text[i:]); match != "" {
+				add(match)
+				i += len(match)
+				continue
+			}
+		case c == '&':
+			if match := entityPattern.FindString(text[i:]); match != "" && html.UnescapeString(match) != match {
+				literal.WriteString(match)
+				i += len(match)
+				continue
+			}
+		case c == '[' || (c == '!' && i+1 < len(text) && text[i+1] == '['):
+			if markup, end, isLink := p.parseLink(text, i); isLink {
+				add(markup)
+				i = end
+				continue
+			}
+		case c == '*' || c == '_':
+			run := len(text[i:]) - len(strings.TrimLeft(text[i:], string(c)))
+			flush()
+			pieces = append(pieces, newDelimiter(text, i, run))
+			i += run
+			continue
+		}
+
+		literal.WriteString(escapeHTML(text[i : i+1]))
+		i++
+	}
+	flush()
+
+	processEmphasis(pieces)
+
+	var out strings.Builder
+	for _, piece := range pieces {
+		out.WriteString(piece.before)
+		if piece.delimiter != 0 {
+			out.WriteString(strings.Repeat(string(piece.delimiter), piece.count))
+		} else {
+			out.WriteString(piece.html)
+		}
+		out.WriteString(piece.after)
+	}
+
+	return out.String()
+}
+
+// parseCodeSpan looks for a code span that starts with the backticks at text[start].
+// It returns the span's contents and the index just past its closing backticks.
+func parseCodeSpan(text string, start int) (string, int, bool) {
+	run := len(text[start:]) - len(strings.TrimLeft(text[start:], "`"))
+	fence := text[start : start+run]
+
+	for i := start + run; i < len(text); {
+		next := strings.Index(text[i:], fence)
+		if next < 0 {
+			return "", 0, false
+		}
+
+		closeAt := i + next
+		closeRun := len(text[closeAt:]) - len(strings.TrimLeft(text[closeAt:], "`"))
+		if closeRun != run {
+			i = closeAt + closeRun
+			continue
+		}
+
+		code := strings.Replace(text[start+run:closeAt], "\n", " ", -1)
+		if len(code) >= 2 && code[0] == ' ' && code[len(code)-1] == ' ' && len(strings.Trim(code, " ")) > 0 {
+			code = code[1 : len(code)-1]
+		}
+
+		return code, closeAt + run, true
+	}
+
+	return "", 0, false
+}
+
+// newDelimiter works out whether a run of * or _ can open or close emphasis, from the
+// characters on either side of it.
+func newDelimiter(text string, start int, run int) *inline {
+	before, after := ' ', ' '
+	if start > 0 {
+		before, _ = utf8.DecodeLastRuneInString(text[:start])
+	}
+	if start+run < len(text) {
+		after, _ = utf8.DecodeRuneInString(text[start+run:])
+	}
+
+	leftFlanking := !unicode.IsSpace(after) &&
+		(!isPunctuation(after) || unicode.IsSpace(before) || isPunctuation(before))
+	rightFlanking := !unicode.IsSpace(before) &&
+		(!isPunctuation(before) || unicode.IsSpace(after) || isPunctuation(after))
+
+	d := &inline{delimiter: text[start], count: run, original: run}
+	if d.delimiter == '*' {
+		d.canOpen = leftFlanking
+		d.canClose = rightFlanking
+	} else {
+		d.canOpen = leftFlanking && (!rightFlanking || isPunctuation(before))
+		d.canClose = rightFlanking && (!leftFlanking || isPunctuation(after))
+	}
+
+	return d
+}
+
+func isPunctuation(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// processEmphasis pairs up delimiter runs into em and strong elements, following the
+// CommonMark rules for which runs may match.
+func processEmphasis(pieces []*inline) {
+	for closer := 0; closer < len(pieces); closer++ {
+		c := pieces[closer]
+		if c.delimiter == 0 || !c.canClose {
+			continue
+		}
+
+		for c.count > 0 {
+			opener := -1
+			for o := closer - 1; o >= 0; o-- {
+				candidate := pieces[o]
+				if candidate.delimiter != c.delimiter || !candidate.canOpen || candidate.count == 0 {
+					continue
+				}
+
+				// A run that can both open and close cannot match one whose length,
+				// added to its own, is a multiple of three, unless both are.
+				if (candidate.canClose || c.canOpen) && (candidate.original+c.original)%3 == 0 &&
+					!(candidate.original%3 == 0 && c.original%3 == 0) {
+					continue
+				}
+
+				opener = o
+				break
+			}
+
+			if opener < 0 {
+				break
+			}
+
+			o := pieces[opener]
+			use, tag := 1, "em"
+			if o.count >= 2 && c.count >= 2 {
+				use, tag = 2, "strong"
+			}
+
+			o.count -= use
+			c.count -= use
+			o.after = "<" + tag + ">" + o.after
+			c.before = c.before + "</" + tag + ">"
+
+			// Delimiters between the pair can no longer match anything outside it.
+			for between := opener + 1; between < closer; between++ {
+				pieces[between].canOpen = false
+				pieces[between].canClose = false
+			}
+		}
+	}
+}
+
+// parseLink looks for a link or image that starts at text[start]. It returns the
+// rendered element and the index just past it.
+func (p *parser) parseLink(text string, start int) (string, int, bool) {
+	image := text[start] == '!'
+	open := start
+	if image {
+		open++
+	}
+
+	closeAt := matchingBracket(text, open)
+	if closeAt < 0 {
+		return "", 0, false
+	}
+
+	label := text[open+1 : closeAt]
+	end := closeAt + 1
+
+	var url, title string
+	found := false
+
+	if end < len(text) && text[end] == '(' {
+		url, title, end, found = parseDestination(text, end)
+	}
+
+	if !found {
+		// A reference link: [text][label], [label][] or [label]
+		refLabel := label
+		end = closeAt + 1
+		if end < len(text) && text[end] == '[' {
+			if refClose := matchingBracket(text, end); refClose >= 0 {
+				if refClose > end+1 {
+					refLabel = text[end+1 : refClose]
+				}
+				end = refClose + 1
+			}
+		}
+
+		var ref linkReference
+		ref, found = p.references[normalizeLabel(refLabel)]
+		url, title = ref.url, ref.title
+	}
+
+	if !found {
+		return "", 0, false
+	}
+
+	content := p.renderInline(label)
+
+	var markup string
+	if image {
+		markup = `<img src="` + escapeURL(url) + `" alt="` + escapeHTML(stripTags(content)) + `"`
+		if len(title) > 0 {
+			markup += ` title="` + escapeHTML(title) + `"`
+		}
+		markup += " />"
+	} else {
+		markup = `<a href="` + escapeURL(url) + `"`
+		if len(title) > 0 {
+			markup += ` title="` + escapeHTML(title) + `"`
+		}
+		markup += ">" + content + "</a>"
+	}
+
+	return markup, end, true
+}
+
+// matchingBracket finds the ] that closes the [ at text[open], skipping brackets that
+// are escaped or inside code spans. It returns -1 if there is none.
+func matchingBracket(text string, open int) int {
+	depth := 0
+	for i := open; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '`':
+			if _, end, isCode := parseCodeSpan(text, i); isCode {
+				i = end - 1
+			} else {
+				for i+1 < len(text) && text[i+1] == '`' {
+					i++
+				}
+			}
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// parseDestination reads an inline link's (destination "title") starting at the
+// parenthesis at text[open].
+func parseDestination(text string, open int) (string, string, int, bool) {
+	i := skipSpace(text, open+1)
+
+	var url string
+	if i < len(text) && text[i] == '<' {
+		end := strings.IndexAny(text[i+1:], ">\n")
+		if end < 0 || text[i+1+end] != '>' {
+			return "", "", 0, false
+		}
+		url = text[i+1 : i+1+end]
+		i += end + 2
+	} else {
+		depth := 0
+		begin := i
+		for ; i < len(text); i++ {
+			c := text[i]
+			if c == '\\' && i+1 < len(text) {
+				i++
+				continue
+			}
+			if c <= ' ' {
+				break
+			}
+			if c == '(' {
+				depth++
+			} else if c == ')' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			}
+		}
+		url = text[begin:i]
+	}
+
+	var title string
+	afterURL := i
+	i = skipSpace(text, i)
+	if i < len(text) && i > afterURL && (text[i] == '"' || text[i] == '\'' || text[i] == '(') {
+		closer := text[i]
+		if closer == '(' {
+			closer = ')'
+		}
+
+		end := i + 1
+		for ; end < len(text) && text[end] != closer; end++ {
+			if text[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(text) {
+			return "", "", 0, false
+		}
+
+		title = text[i+1 : end]
+		i = skipSpace(text, end+1)
+	}
+
+	if i >= len(text) || text[i] != ')' {
+		return "", "", 0, false
+	}
+
+	return unescapeText(url), unescapeText(title), i + 1, true
+}
+
+func skipSpace(text string, i int) int {
+	for i < len(text) && (text[i] == ' ' || text[i] == '\n') {
+		i++
+	}
+
+	return i
+}
+
+var (
+	backslashEscapePattern = regexp.MustCompile(`\\([!"#$%&'()*+,\-./:;<=>?@\[\\\]^_` + "`" + `{|}~])`)
+	tagPattern             = regexp.MustCompile(`<[^>]*>`)
+)
+
+// unescapeText resolves backslash escapes and entities in link destinations, titles
+// and info strings.
+func unescapeText(text string) string {
+	return html.UnescapeString(backslashEscapePattern.ReplaceAllString(text, "$1"))
+}
+
+func stripTags(markup string) string {
+	return html.UnescapeString(tagPattern.ReplaceAllString(markup, ""))
+}
+
+func escapeHTML(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;").Replace(text)
+}
+
+// escapeURL percent-encodes the characters in a URL that are not allowed to appear
+// in one as written, and escapes it for use in an attribute.
+func escapeURL(url string) string {
+	const allowed = "-._~:/?#[]@!$&'()*+,;=%"
+
+	var encoded strings.Builder
+	for i := 0; i < len(url); i++ {
+		c := url[i]
+		if c < 0x80 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.IndexByte(allowed, c) >= 0) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+
+	return escapeHTML(encoded.String())
+}
@@ -0,0 +1,575 @@
+// Package markdown renders CommonMark-formatted text as HTML.
+//
+// It supports the block structure of CommonMark (paragraphs, ATX and setext headings,
+// thematic breaks, block quotes, bullet and ordered lists, indented and fenced code
+// blocks and HTML blocks) and its inline structure (emphasis, code spans, links and
+// images, including reference links, autolinks, raw HTML, entities, backslash escapes
+// and hard line breaks). Raw HTML is passed through untouched, so output rendered
+// from untrusted input should be sanitized.
+package markdown
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type blockKind int
+
+const (
+	paragraphBlock blockKind = iota
+	headingBlock
+	thematicBreakBlock
+	codeBlock
+	htmlBlock
+	blockquoteBlock
+	listBlock
+	listItemBlock
+)
+
+// block is one node of the document's block structure.
+type block struct {
+	kind        blockKind
+	text        string // Inline text of paragraphs and headings; contents of code and HTML blocks
+	level       int    // Heading level
+	info        string // Info string of a fenced code block
+	ordered     bool
+	start       int // Number of the first item in an ordered list
+	tight       bool
+	blankBefore bool // Preceded by a blank line within its container
+	children    []*block
+}
+
+// linkReference is the destination given by a link reference definition.
+type linkReference struct {
+	url   string
+	title string
+}
+
+// parser holds what is learned about the whole document while its blocks are parsed.
+type parser struct {
+	references map[string]linkReference
+}
+
+var (
+	atxHeadingPattern    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	setextPattern        = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	thematicBreakPattern = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fencePattern         = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*(.*?)[ \t]*$")
+	listMarkerPattern    = regexp.MustCompile(`^( {0,3})([*+-]|[0-9]{1,9}[.)])( *)`)
+	htmlBlockPattern     = regexp.MustCompile(`(?i)^ {0,3}(?:<!--|<(?:script|pre|style)(?:\s|>|$)|</?(?:address|article|aside|base|blockquote|body|caption|center|col|colgroup|dd|details|dialog|dir|div|dl|dt|fieldset|figcaption|figure|footer|form|frame|frameset|h[1-6]|head|header|hr|html|iframe|legend|li|link|main|menu|nav|noframes|ol|optgroup|option|p|param|section|summary|table|tbody|td|tfoot|th|thead|title|tr|track|ul)(?:\s|/?>|$))`)
+	htmlTagLinePattern   = regexp.MustCompile(`^ {0,3}(?:<[a-zA-Z][a-zA-Z0-9-]*(?:\s+[a-zA-Z_:][a-zA-Z0-9_.:-]*(?:\s*=\s*(?:[^\s"'=<>` + "`" + `]+|'[^']*'|"[^"]*"))?)*\s*/?>|</[a-zA-Z][a-zA-Z0-9-]*\s*>)[ \t]*$`)
+	referencePattern     = regexp.MustCompile(`^ {0,3}\[((?:[^\]\\]|\\.)+)\]:[ \t]*\n?[ \t]*(<[^>\n]*>|\S+)(?:(?:[ \t]+|[ \t]*\n[ \t]*)("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|\((?:[^)\\]|\\.)*\)))?[ \t]*(?:\n|$)`)
+)
+
+// Render converts CommonMark source text into HTML.
+func Render(source string) string {
+	p := &parser{references: make(map[string]linkReference)}
+
+	source = strings.NewReplacer("\r\n", "\n", "\r", "\n", "\x00", "\uFFFD").Replace(source)
+	lines := strings.Split(source, "\n")
+	for i, line := range lines {
+		lines[i] = expandTabs(line)
+	}
+
+	blocks := p.parseBlocks(lines)
+
+	var out strings.Builder
+	p.renderBlocks(&out, blocks, false)
+
+	return out.String()
+}
+
+// expandTabs replaces tabs with spaces, using tab stops every four columns.
+func expandTabs(line string) string {
+	if !strings.Contains(line, "\t") {
+		return line
+	}
+
+	var expanded strings.Builder
+	column := 0
+	for _, r := range line {
+		if r == '\t' {
+			spaces := 4 - column%4
+			expanded.WriteString(strings.Repeat(" ", spaces))
+			column += spaces
+		} else {
+			expanded.WriteRune(r)
+			column++
+		}
+	}
+
+	return expanded.String()
+}
+
+func isBlank(line string) bool {
+	return len(strings.TrimSpace(line)) == 0
+}
+
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// removeIndent strips up to n leading spaces from the line.
+func removeIndent(line string, n int) string {
+	i := 0
+	for i < n && i < len(line) && line[i] == ' ' {
+		i++
+	}
+
+	return line[i:]
+}
+
+// listMarker describes the marker that starts a list item.
+type listMarker struct {
+	bullet   byte // '*', '+' or '-' for bullet lists; '.' or ')' for ordered lists
+	ordered  bool
+	number   int
+	width    int // Columns from the start of the line to the item's content
+	empty    bool
+	contents string
+}
+
+func parseListMarker(line string) (listMarker, bool) {
+	var marker listMarker
+
+	match := listMarkerPattern.FindStringSubmatch(line)
+	if match == nil {
+		return marker, false
+	}
+
+	indent, symbol, spaces := match[1], match[2], match[3]
+	rest := line[len(match[0]):]
+	if len(spaces) == 0 && len(rest) > 0 {
+		return marker, false
+	}
+
+	if symbol[len(symbol)-1] == '.' || symbol[len(symbol)-1] == ')' {
+		marker.ordered = true
+		marker.bullet = symbol[len(symbol)-1]
+		marker.number, _ = strconv.Atoi(symbol[:len(symbol)-1])
+	} else {
+		marker.bullet = symbol[0]
+	}
+
+	markerEnd := len(indent) + len(symbol)
+	marker.empty = isBlank(rest)
+	switch {
+	case marker.empty:
+		marker.width = markerEnd + 1
+	case len(spaces) > 4:
+		// The content is an indented code block, which starts one space after the marker.
+		marker.width = markerEnd + 1
+		rest = strings.Repeat(" ", len(spaces)-1) + rest
+	default:
+		marker.width = markerEnd + len(spaces)
+	}
+	if !marker.empty {
+		marker.contents = rest
+	}
+
+	return marker, true
+}
+
+// interruptsParagraph reports whether the line starts a block that can end a paragraph
+// without a blank line in between.
+func interruptsParagraph(line string) bool {
+	if atxHeadingPattern.MatchString(line) || thematicBreakPattern.MatchString(line) ||
+		fencePattern.MatchString(line) || htmlBlockPattern.MatchString(line) {
+		return true
+	}
+
+	if trimmed := strings.TrimLeft(line, " "); indentOf(line) < 4 && strings.HasPrefix(trimmed, ">") {
+		return true
+	}
+
+	if marker, isMarker := parseListMarker(line); isMarker && !marker.empty {
+		return !marker.ordered || marker.number == 1
+	}
+
+	return false
+}
+
+// parseBlocks finds the blocks in a sequence of lines that make up one container.
+func (p *parser) parseBlocks(lines []string) []*block {
+	var blocks []*block
+	sawBlank := false
+
+	for i := 0; i < len(lines); {
+		line := lines[i]
+
+		if isBlank(line) {
+			sawBlank = true
+			i++
+			continue
+		}
+
+		var newBlock *block
+		newBlock, i = p.parseBlock(lines, i)
+		if newBlock != nil {
+			newBlock.blankBefore = sawBlank
+			blocks = append(blocks, newBlock)
+		}
+		sawBlank = false
+	}
+
+	return blocks
+}
+
+// parseBlock parses the block that starts at lines[start], which is not blank, and
+// returns it along with the index of the first line after it. The block is nil if the
+// lines held only link reference definitions.
+func (p *parser) parseBlock(lines []string, start int) (*block, int) {
+	line := lines[start]
+
+	if indentOf(line) >= 4 {
+		return parseIndentedCode(lines, start)
+	}
+
+	if match := fencePattern.FindStringSubmatch(line); match != nil &&
+		!(match[2][0] == '`' && strings.Contains(match[3], "`")) {
+		return parseFencedCode(lines, start, len(match[1]), match[2], match[3])
+	}
+
+	if match := atxHeadingPattern.FindStringSubmatch(line); match != nil {
+		return &block{kind: headingBlock, level: len(match[1]), text: strings.TrimSpace(match[2])}, start + 1
+	}
+
+	if thematicBreakPattern.MatchString(line) {
+		return &block{kind: thematicBreakBlock}, start + 1
+	}
+
+	if strings.HasPrefix(strings.TrimLeft(line, " "), ">") {
+		return p.parseBlockquote(lines, start)
+	}
+
+	if htmlBlockPattern.MatchString(line) || htmlTagLinePattern.MatchString(line) {
+		return parseHTMLBlock(lines, start)
+	}
+
+	if _, isMarker := parseListMarker(line); isMarker {
+		return p.parseList(lines, start)
+	}
+
+	return p.parseParagraph(lines, start)
+}
+
+func parseIndentedCode(lines []string, start int) (*block, int) {
+	var code []string
+
+	end := start
+	for end < len(lines) && (isBlank(lines[end]) || indentOf(lines[end]) >= 4) {
+		code = append(code, removeIndent(lines[end], 4))
+		end++
+	}
+
+	// Trailing blank lines are not part of the code.
+	for len(code) > 0 && isBlank(code[len(code)-1]) {
+		code = code[:len(code)-1]
+		end--
+	}
+
+	return &block{kind: codeBlock, text: strings.Join(code, "\n") + "\n"}, end
+}
+
+func parseFencedCode(lines []string, start int, indent int, fence string, info string) (*block, int) {
+	var code []string
+
+	end := start + 1
+	for ; end < len(lines); end++ {
+		trimmed := strings.TrimLeft(lines[end], " ")
+		if indentOf(lines[end]) < 4 && strings.HasPrefix(trimmed, fence) &&
+			len(strings.Trim(strings.TrimSpace(trimmed), fence[:1])) == 0 {
+			end++
+			break
+		}
+
+		code = append(code, removeIndent(lines[end], indent))
+	}
+
+	codeText := strings.Join(code, "\n")
+	if len(code) > 0 {
+		codeText += "\n"
+	}
+
+	return &block{kind: codeBlock, text: codeText, info: unescapeText(info)}, end
+}
+
+func (p *parser) parseBlockquote(lines []string, start int) (*block, int) {
+	var quoted []string
+
+	end := start
+	for ; end < len(lines); end++ {
+		line := lines[end]
+		trimmed := strings.TrimLeft(line, " ")
+
+		if indentOf(line) < 4 && strings.HasPrefix(trimmed, ">") {
+			trimmed = trimmed[1:]
+			if strings.HasPrefix(trimmed, " ") {
+				trimmed = trimmed[1:]
+			}
+			quoted = append(quoted, trimmed)
+		} else if !isBlank(line) && len(quoted) > 0 && !isBlank(quoted[len(quoted)-1]) &&
+			!interruptsParagraph(line) {
+			// A lazy continuation of a paragraph in the quote
+			quoted = append(quoted, line)
+		} else {
+			break
+		}
+	}
+
+	return &block{kind: blockquoteBlock, children: p.parseBlocks(quoted)}, end
+}
+
+func parseHTMLBlock(lines []string, start int) (*block, int) {
+	// Comments and script, pre and style elements may contain blank lines, so they
+	// run until they are closed. Everything else runs until a blank line.
+	var closer string
+	lower := strings.ToLower(lines[start])
+	switch {
+	case strings.Contains(lower, "<!--"):
+		closer = "-->"
+	case strings.Contains(lower, "<script"):
+		closer = "</script>"
+	case strings.Contains(lower, "<pre"):
+		closer = "</pre>"
+	case strings.Contains(lower, "<style"):
+		closer = "</style>"
+	}
+
+	end := start
+	for end < len(lines) {
+		if closer != "" {
+			if strings.Contains(strings.ToLower(lines[end]), closer) {
+				end++
+				break
+			}
+		} else if isBlank(lines[end]) {
+			break
+		}
+		end++
+	}
+
+	return &block{kind: htmlBlock, text: strings.Join(lines[start:end], "\n") + "\n"}, end
+}
+
+func (p *parser) parseList(lines []string, start int) (*block, int) {
+	first, _ := parseListMarker(lines[start])
+	list := &block{kind: listBlock, ordered: first.ordered, start: first.number, tight: true}
+
+	end := start
+	blankBetween := false
+	for end < len(lines) {
+		marker, isMarker := parseListMarker(lines[end])
+		if !isMarker || marker.ordered != first.ordered || marker.bullet != first.bullet ||
+			thematicBreakPattern.MatchString(lines[end]) {
+			break
+		}
+
+		itemLines := []string{marker.contents}
+		end++
+		for ; end < len(lines); end++ {
+			line := lines[end]
+			previous := itemLines[len(itemLines)-1]
+
+			if isBlank(line) {
+				// An item that starts with a blank line can only have one.
+				if len(itemLines) == 1 && marker.empty {
+					break
+				}
+				itemLines = append(itemLines, "")
+			} else if indentOf(line) >= marker.width {
+				itemLines = append(itemLines, line[marker.width:])
+			} else if _, nextItem := parseListMarker(line); nextItem {
+				break
+			} else if !isBlank(previous) && !interruptsParagraph(line) {
+				// A lazy continuation of a paragraph in the item
+				itemLines = append(itemLines, line)
+			} else {
+				break
+			}
+		}
+
+		// Blank lines at the end of an item separate it from the next one.
+		trailingBlank := false
+		for len(itemLines) > 1 && isBlank(itemLines[len(itemLines)-1]) {
+			itemLines = itemLines[:len(itemLines)-1]
+			trailingBlank = true
+		}
+
+		item := &block{kind: listItemBlock, blankBefore: blankBetween, children: p.parseBlocks(itemLines)}
+		list.children = append(list.children, item)
+
+		if item.blankBefore && len(list.children) > 1 {
+			list.tight = false
+		}
+		for i, child := range item.children {
+			if i > 0 && child.blankBefore {
+				list.tight = false
+			}
+		}
+
+		blankBetween = trailingBlank
+	}
+
+	// A blank line after the last item belongs after the list, not inside it.
+	if blankBetween {
+		for end > start && isBlank(lines[end-1]) {
+			end--
+		}
+	}
+
+	return list, end
+}
+
+func (p *parser) parseParagraph(lines []string, start int) (*block, int) {
+	paragraph := []string{strings.TrimLeft(lines[start], " ")}
+
+	end := start + 1
+	for ; end < len(lines); end++ {
+		line := lines[end]
+		if isBlank(line) {
+			break
+		}
+
+		if match := setextPattern.FindStringSubmatch(line); match != nil {
+			text := p.extractReferences(strings.Join(paragraph, "\n"))
+			if len(text) > 0 {
+				level := 1
+				if match[1][0] == '-' {
+					level = 2
+				}
+
+				return &block{kind: headingBlock, level: level, text: strings.TrimSpace(text)}, end + 1
+			}
+		}
+
+		if interruptsParagraph(line) {
+			break
+		}
+
+		paragraph = append(paragraph, strings.TrimLeft(line, " "))
+	}
+
+	text := p.extractReferences(strings.Join(paragraph, "\n"))
+	if len(text) == 0 {
+		return nil, end
+	}
+
+	return &block{kind: paragraphBlock, text: strings.TrimRight(text, " ")}, end
+}
+
+// extractReferences removes link reference definitions from the start of a paragraph's
+// text and records them.
+func (p *parser) extractReferences(text string) string {
+	for {
+		match := referencePattern.FindStringSubmatch(text)
+		if match == nil {
+			return text
+		}
+
+		label := normalizeLabel(match[1])
+		if len(label) == 0 {
+			return text
+		}
+
+		// A destination that opens with < must be closed with >; "<" and "<x" are not
+		// destinations at all, so the line is text rather than a definition.
+		destination := match[2]
+		if strings.HasPrefix(destination, "<") {
+			if len(destination) < 2 || !strings.HasSuffix(destination, ">") {
+				return text
+			}
+			destination = destination[1 : len(destination)-1]
+		}
+
+		title := match[3]
+		if len(title) >= 2 {
+			title = title[1 : len(title)-1]
+		}
+
+		// The first definition of a label wins.
+		if _, defined := p.references[label]; !defined {
+			p.references[label] = linkReference{url: unescapeText(destination), title: unescapeText(title)}
+		}
+
+		text = text[len(match[0]):]
+	}
+}
+
+// normalizeLabel puts a link label into the form used to match references to
+// definitions: case-folded, with whitespace collapsed.
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+func (p *parser) renderBlocks(out *strings.Builder, blocks []*block, tight bool) {
+	for _, b := range blocks {
+		p.renderBlock(out, b, tight)
+	}
+}
+
+func (p *parser) renderBlock(out *strings.Builder, b *block, tight bool) {
+	switch b.kind {
+	case paragraphBlock:
+		if tight {
+			out.WriteString(p.renderInline(b.text))
+		} else {
+			out.WriteString("<p>" + p.renderInline(b.text) + "</p>\n")
+		}
+	case headingBlock:
+		tag := "h" + strconv.Itoa(b.level)
+		out.WriteString("<" + tag + ">" + p.renderInline(b.text) + "</" + tag + ">\n")
+	case thematicBreakBlock:
+		out.WriteString("<hr />\n")
+	case codeBlock:
+		out.WriteString("<pre><code")
+		if language := strings.Fields(b.info); len(language) > 0 {
+			out.WriteString(` class="language-` + escapeHTML(language[0]) + `"`)
+		}
+		out.WriteString(">" + escapeHTML(b.text) + "</code></pre>\n")
+	case htmlBlock:
+		out.WriteString(b.text)
+	case blockquoteBlock:
+		out.WriteString("<blockquote>\n")
+		p.renderBlocks(out, b.children, false)
+		out.WriteString("</blockquote>\n")
+	case listBlock:
+		tag := "ul"
+		if b.ordered {
+			tag = "ol"
+		}
+
+		out.WriteString("<" + tag)
+		if b.ordered && b.start != 1 {
+			out.WriteString(` start="` + strconv.Itoa(b.start) + `"`)
+		}
+		out.WriteString(">\n")
+
+		for _, item := range b.children {
+			p.renderListItem(out, item, b.tight)
+		}
+
+		out.WriteString("</" + tag + ">\n")
+	}
+}
+
+func (p *parser) renderListItem(out *strings.Builder, item *block, tight bool) {
+	out.WriteString("<li>")
+
+	for i, child := range item.children {
+		if tight && child.kind == paragraphBlock {
+			p.renderBlock(out, child, true)
+			if i < len(item.children)-1 {
+				out.WriteString("\n")
+			}
+		} else {
+			if i == 0 {
+				out.WriteString("\n")
+			}
+			p.renderBlock(out, child, false)
+		}
+	}
+
+	out.WriteString("</li>\n")
+}
@@ -0,0 +1,64 @@
+package markdown
+
+import (
+	"testing"
+)
+
+func TestRenderBlocks(t *testing.T) {
+	cases := []struct {
+		source string
+		want   string
+	}{
+		{"# Title", "<h1>Title</h1>\n"},
+		{"Title\n===", "<h1>Title</h1>\n"},
+		{"one\ntwo\n\nthree", "<p>one\ntwo</p>\n<p>three</p>\n"},
+		{"- a\n- b", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"1. x", "<ol>\n<li>x</li>\n</ol>\n"},
+		{"> quoted", "<blockquote>\n<p>quoted</p>\n</blockquote>\n"},
+		{"```go\nx<y\n```", "<pre><code class=\"language-go\">x&lt;y\n</code></pre>\n"},
+		{"<div>raw</div>", "<div>raw</div>\n"},
+	}
+
+	for _, c := range cases {
+		if got := Render(c.source); got != c.want {
+			t.Errorf("Render(%q) = %q, want %q", c.source, got, c.want)
+		}
+	}
+}
+
+func TestRenderInline(t *testing.T) {
+	cases := []struct {
+		source string
+		want   string
+	}{
+		{"*em* **strong** `code`", "<p><em>em</em> <strong>strong</strong> <code>code</code></p>\n"},
+		{"[link](http://x?a&b)", "<p><a href=\"http://x?a&amp;b\">link</a></p>\n"},
+		{"a < b & c", "<p>a &lt; b &amp; c</p>\n"},
+	}
+
+	for _, c := range cases {
+		if got := Render(c.source); got != c.want {
+			t.Errorf("Render(%q) = %q, want %q", c.source, got, c.want)
+		}
+	}
+}
+
+func TestRenderReferences(t *testing.T) {
+	cases := []struct {
+		source string
+		want   string
+	}{
+		{"[a]: /u \"t\"\n\n[a]", "<p><a href=\"/u\" title=\"t\">a</a></p>\n"},
+		{"[a]: <x>\n\n[a]", "<p><a href=\"x\">a</a></p>\n"},
+		{"[A]: /first\n[a]: /second\n\n[a]", "<p><a href=\"/first\">a</a></p>\n"},
+		// Destinations that open with < but are not closed are not definitions.
+		{"[a]: <", "<p>[a]: &lt;</p>\n"},
+		{"[a]: <x", "<p>[a]: &lt;x</p>\n"},
+	}
+
+	for _, c := range cases {
+		if got := Render(c.source); got != c.want {
+			t.Errorf("Render(%q) = %q, want %q", c.source, got, c.want)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package migrations
 
 import (
 	"database/sql"
+	"log"
+	"strings"
 
 	"github.com/adamcrossland/grog/manageddb"
 )
@@ -11,9 +13,21 @@ var DatabaseMigrations map[int]manageddb.DBMigration
 
 func init() {
 	DatabaseMigrations = map[int]manageddb.DBMigration{
-		1: {Up: migration1up, Down: migration1down},
-		2: {Up: migration2up, Down: migration2down},
-		3: {Up: migration3up, Down: migration3down},
+		1:  {Up: migration1up, Down: migration1down},
+		2:  {Up: migration2up, Down: migration2down},
+		3:  {Up: migration3up, Down: migration3down},
+		4:  {Up: migration4up, Down: migration4down},
+		5:  {Up: migration5up, Down: migration5down},
+		6:  {Up: migration6up, Down: migration6down},
+		7:  {Up: migration7up, Down: migration7down},
+		8:  {Up: migration8up, Down: migration8down},
+		9:  {Up: migration9up, Down: migration9down},
+		10: {Up: migration10up, Down: migration10down},
+		11: {Up: migration11up, Down: migration11down},
+		12: {Up: migration12up, Down: migration12down},
+		13: {Up: migration13up, Down: migration13down},
+		14: {Up: migration14up, Down: migration14down},
+		15: {Up: migration15up, Down: migration15down},
 	}
 }
 
@@ -117,3 +131,408 @@ func migration3down(db *sql.DB) error {
 
 	return err
 }
+
+func migration4up(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`create table sessions (id text primary key,
+		user integer not null,
+		added numeric,
+		expires numeric)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`create table api_tokens (id integer primary key,
+		user integer not null,
+		name text,
+		token text not null,
+		added numeric,
+		last_used numeric)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`create unique index tokenindex on api_tokens (token)`)
+
+	return err
+}
+
+func migration4down(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`drop index tokenindex`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("drop table api_tokens")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("drop table sessions")
+
+	return err
+}
+
+func migration5up(db *sql.DB) error {
+	_, err := db.Exec(`alter table users add column password text not null default ''`)
+
+	return err
+}
+
+func migration5down(db *sql.DB) error {
+	_, err := db.Exec(`alter table users drop column password`)
+
+	return err
+}
+
+func migration6up(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`alter table users add column role text not null default 'viewer'`)
+	if err != nil {
+		return err
+	}
+
+	// Before roles existed, every user could change anything, so existing users
+	// keep that ability.
+	_, err = db.Exec(`update users set role = 'admin'`)
+
+	return err
+}
+
+func migration6down(db *sql.DB) error {
+	_, err := db.Exec(`alter table users drop column role`)
+
+	return err
+}
+
+func migration7up(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`create table content_revisions (id integer primary key,
+		content integer not null,
+		revision integer not null,
+		title text,
+		summary text,
+		body text,
+		author integer,
+		added numeric)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`create unique index revisionindex on content_revisions (content, revision)`)
+	if err != nil {
+		return err
+	}
+
+	// Whatever is there now becomes the first revision of each piece of Content.
+	_, err = db.Exec(`insert into content_revisions (content, revision, title, summary, body, author, added)
+		select id, 1, title, summary, body, author, modified from content`)
+
+	return err
+}
+
+func migration7down(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`drop index revisionindex`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("drop table content_revisions")
+
+	return err
+}
+
+func migration8up(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`create table asset_versions (id integer primary key,
+		name text not null,
+		version integer not null,
+		mimeType text,
+		content blob,
+		serve_external integer,
+		rendered integer,
+		added numeric)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`create unique index assetversionindex on asset_versions (name, version)`)
+
+	return err
+}
+
+func migration8down(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`drop index assetversionindex`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("drop table asset_versions")
+
+	return err
+}
+
+func migration9up(db *sql.DB) error {
+	var err error
+
+	// Everything that already exists is live, so it starts out published.
+	_, err = db.Exec(`alter table content add column status text not null default 'published'`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`alter table content add column publish_at numeric not null default 0`)
+	if err != nil {
+		return err
+	}
+
+	// Named queries can select from this view rather than content to see only what
+	// the public is allowed to see.
+	_, err = db.Exec(`create view published_content as select * from content
+		where status = 'published' or (status = 'scheduled' and publish_at <= strftime('%s','now'))`)
+
+	return err
+}
+
+func migration9down(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`drop view published_content`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`alter table content drop column publish_at`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`alter table content drop column status`)
+
+	return err
+}
+
+// migration10up uses SQLite's FTS5 extension when it is available, which with
+// github.com/mattn/go-sqlite3 means building with -tags sqlite_fts5. Without it,
+// content_search is made a plain table, and SearchContent falls back to matching with
+// LIKE. A database made that way keeps the plain table even after FTS5 is built in.
+func migration10up(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`create virtual table content_search using fts5(title, summary, body)`)
+	if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+		log.Printf("SQLite was built without FTS5; content search will be slower and simpler")
+		_, err = db.Exec(`create table content_search (title text, summary text, body text)`)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Content.Save strips markup from the body before indexing it; existing bodies
+	// are indexed as they are until they are next saved.
+	_, err = db.Exec(`insert into content_search (rowid, title, summary, body)
+		select id, title, summary, body from content`)
+
+	return err
+}
+
+func migration10down(db *sql.DB) error {
+	_, err := db.Exec("drop table content_search")
+
+	return err
+}
+
+func migration11up(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`create table tags (id integer primary key,
+		name text not null)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`create unique index tagnameindex on tags (name)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`create table content_tags (content integer not null,
+		tag integer not null)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`create unique index contenttagindex on content_tags (content, tag)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`create index tagcontentindex on content_tags (tag)`)
+
+	return err
+}
+
+func migration11down(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`drop index tagcontentindex`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`drop index contenttagindex`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("drop table content_tags")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`drop index tagnameindex`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("drop table tags")
+
+	return err
+}
+
+func migration12up(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`create table comments (id integer primary key,
+		content integer not null,
+		parent integer not null default 0,
+		user integer not null default 0,
+		author_name text,
+		author_email text,
+		body text,
+		status text not null default 'pending',
+		added numeric)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`create index commentcontentindex on comments (content, status)`)
+
+	return err
+}
+
+func migration12down(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`drop index commentcontentindex`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("drop table comments")
+
+	return err
+}
+
+func migration13up(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`alter table content add column body_format text not null default 'html'`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`alter table content_revisions add column body_format text not null default 'html'`)
+	if err != nil {
+		return err
+	}
+
+	// Holds the body of the revision rendered as HTML, once something has asked for it
+	_, err = db.Exec(`alter table content_revisions add column rendered text`)
+
+	return err
+}
+
+func migration13down(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`alter table content_revisions drop column rendered`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`alter table content_revisions drop column body_format`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`alter table content drop column body_format`)
+
+	return err
+}
+
+func migration14up(db *sql.DB) error {
+	var err error
+
+	// Limits on how long a named query may run, in milliseconds, and how many rows it
+	// may return. Zero means that the server's default applies.
+	_, err = db.Exec(`alter table queries add column timeout integer not null default 0`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`alter table queries add column max_rows integer not null default 0`)
+
+	return err
+}
+
+func migration14down(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`alter table queries drop column max_rows`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`alter table queries drop column timeout`)
+
+	return err
+}
+
+func migration15up(db *sql.DB) error {
+	var err error
+
+	// Whether a named query may be run by anyone through /q/{name}, and the parameters
+	// that it takes from the request when it is.
+	_, err = db.Exec(`alter table queries add column public integer not null default 0`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`alter table queries add column params text not null default ''`)
+
+	return err
+}
+
+func migration15down(db *sql.DB) error {
+	var err error
+
+	_, err = db.Exec(`alter table queries drop column params`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`alter table queries drop column public`)
+
+	return err
+}
@@ -0,0 +1,119 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// APIToken is a long-lived credential that lets scripts act as a User without
+// logging in. As with Sessions, only a hash of the token is stored.
+type APIToken struct {
+	model    *GrogModel
+	ID       int64
+	User     int64
+	Name     string
+	Added    NullTime
+	LastUsed NullTime
+}
+
+// NewAPIToken creates and saves a new APIToken for the given user. The returned token
+// is the only copy of the secret; it cannot be recovered later.
+func (model *GrogModel) NewAPIToken(userID int64, name string) (*APIToken, string, error) {
+	token, tokenErr := newSecret()
+	if tokenErr != nil {
+		return nil, "", tokenErr
+	}
+
+	newToken := new(APIToken)
+	newToken.model = model
+	newToken.User = userID
+	newToken.Name = name
+	newToken.Added.Set(time.Now())
+	newToken.LastUsed.Null = true
+
+	insertResult, err := model.db.DB.Exec(`insert into api_tokens (user, name, token, added, last_used)
+		values (?, ?, ?, ?, 0)`, newToken.User, newToken.Name, hashSecret(token), newToken.Added.Unix())
+	if err == nil {
+		newToken.ID, err = insertResult.LastInsertId()
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("error saving api token: %v", err)
+	}
+
+	return newToken, token, nil
+}
+
+// GetUserByAPIToken returns the User to whom the given token was issued and records
+// that the token has been used.
+func (model *GrogModel) GetUserByAPIToken(token string) (*User, error) {
+	var tokenID int64
+	var userID int64
+
+	hashed := hashSecret(token)
+	row := model.db.DB.QueryRow("select id, user from api_tokens where token = ?", hashed)
+	if row.Scan(&tokenID, &userID) == sql.ErrNoRows {
+		return nil, fmt.Errorf("unknown api token")
+	}
+
+	_, err := model.db.DB.Exec("update api_tokens set last_used = strftime('%s','now') where id = ?", tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("error updating api token %d: %v", tokenID, err)
+	}
+
+	return model.GetUser(userID)
+}
+
+// UserAPITokens loads all of the APITokens that have been issued to the given user.
+func (model *GrogModel) UserAPITokens(userID int64) ([]*APIToken, error) {
+	var foundTokens []*APIToken
+
+	rows, rowsErr := model.db.DB.Query(`select id, name, added, last_used from api_tokens where user = ?`, userID)
+	if rowsErr != nil {
+		return nil, fmt.Errorf("error loading api tokens: %v", rowsErr)
+	}
+
+	defer rows.Close()
+
+	var (
+		id       int64
+		name     string
+		added    int64
+		lastUsed int64
+	)
+
+	for rows.Next() {
+		if rows.Scan(&id, &name, &added, &lastUsed) != sql.ErrNoRows {
+			foundToken := new(APIToken)
+			foundToken.model = model
+			foundToken.ID = id
+			foundToken.User = userID
+			foundToken.Name = name
+			foundToken.Added.Set(time.Unix(added, 0))
+			if lastUsed > 0 {
+				foundToken.LastUsed.Set(time.Unix(lastUsed, 0))
+			} else {
+				foundToken.LastUsed.Null = true
+			}
+
+			foundTokens = append(foundTokens, foundToken)
+		}
+	}
+
+	return foundTokens, nil
+}
+
+// DeleteAPIToken revokes the APIToken with the given id.
+func (model *GrogModel) DeleteAPIToken(id int64) error {
+	res, err := model.db.DB.Exec("delete from api_tokens where id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	rowsDeleted, rowsDeletedErr := res.RowsAffected()
+	if rowsDeletedErr == nil && rowsDeleted != 1 {
+		return fmt.Errorf("no api token with id %d", id)
+	}
+
+	return nil
+}
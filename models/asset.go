@@ -136,7 +136,8 @@ func (model *GrogModel) AssetExists(assetName string) bool {
 	return doesExist
 }
 
-// Save stores the Asset in the database
+// Save stores the Asset in the database. If the Asset already exists, the version that
+// it replaces is kept and can be found through AssetVersions.
 func (asset *Asset) Save() error {
 	var saveError error
 
@@ -167,6 +168,9 @@ func (asset *Asset) Save() error {
 		saveError = err
 	} else {
 		// Exists, do update
+		if archiveErr := asset.archive(); archiveErr != nil {
+			return archiveErr
+		}
 
 		asset.Modified.Set(time.Now())
 
@@ -209,13 +213,18 @@ func (asset Asset) Delete() error {
 		return fmt.Errorf("Asset.Delete should delete exactly 1 row. Instead, returned %d", rowsDeleted)
 	}
 
-	return nil
+	_, err = asset.model.db.DB.Exec("delete from asset_versions where name = ?", asset.Name)
+
+	return err
 }
 
 // Rename changes the name associated with the Asset.
 func (asset *Asset) Rename(toName string) error {
 	if !asset.model.AssetExists(toName) {
 		_, err := asset.model.db.DB.Exec("update Assets set name = ? where name = ?", toName, asset.Name)
+		if err == nil {
+			_, err = asset.model.db.DB.Exec("update asset_versions set name = ? where name = ?", toName, asset.Name)
+		}
 		if err == nil {
 			asset.Name = toName
 		} else {
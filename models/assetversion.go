@@ -0,0 +1,116 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// AssetVersion describes one of the prior versions of an Asset that were kept when the
+// Asset was changed. Versions are numbered from 1; the current Asset is always one
+// higher than the newest version.
+type AssetVersion struct {
+	Name          string
+	Version       int64
+	MimeType      string
+	ServeExternal bool
+	Rendered      bool
+	Size          int
+	Added         NullTime
+}
+
+// archive copies the Asset as it is currently stored in the database into the
+// asset_versions table.
+func (asset *Asset) archive() error {
+	_, err := asset.model.db.DB.Exec(`insert into asset_versions (name, version, mimeType, content,
+		serve_external, rendered, added) select name,
+		(select coalesce(max(version), 0) + 1 from asset_versions where name = ?),
+		mimeType, content, serve_external, rendered, modified from assets where name = ?`,
+		asset.Name, asset.Name)
+	if err != nil {
+		return fmt.Errorf("error keeping prior version of asset %s: %v", asset.Name, err)
+	}
+
+	return nil
+}
+
+// AssetVersions lists the prior versions of the Asset with the given name, oldest first.
+func (model *GrogModel) AssetVersions(name string) ([]*AssetVersion, error) {
+	var foundVersions []*AssetVersion
+
+	rows, rowsErr := model.db.DB.Query(`select version, mimeType, serve_external, rendered,
+		length(content), added from asset_versions where name = ? order by version`, name)
+	if rowsErr != nil {
+		return nil, fmt.Errorf("error loading versions of asset %s: %v", name, rowsErr)
+	}
+
+	defer rows.Close()
+
+	var (
+		version       int64
+		mimeType      string
+		serveExternal int64
+		rendered      int64
+		size          int
+		added         int64
+	)
+
+	for rows.Next() {
+		if rows.Scan(&version, &mimeType, &serveExternal, &rendered, &size, &added) != sql.ErrNoRows {
+			foundVersion := new(AssetVersion)
+			foundVersion.Name = name
+			foundVersion.Version = version
+			foundVersion.MimeType = mimeType
+			foundVersion.ServeExternal = serveExternal == 1
+			foundVersion.Rendered = rendered == 1
+			foundVersion.Size = size
+			foundVersion.Added.Set(time.Unix(added, 0))
+
+			foundVersions = append(foundVersions, foundVersion)
+		}
+	}
+
+	return foundVersions, nil
+}
+
+// GetAssetVersion loads a prior version of the Asset with the given name. Saving the
+// returned Asset makes that version current again.
+func (model *GrogModel) GetAssetVersion(name string, version int64) (*Asset, error) {
+	var foundAsset *Asset
+	var mimeType string
+	var content = make([]byte, 0)
+	var serveExternal int64
+	var rendered int64
+	var added int64
+	var err error
+
+	row := model.db.DB.QueryRow(`select mimeType, content, serve_external, rendered, added
+		from asset_versions where name = ? and version = ?`, name, version)
+	if row.Scan(&mimeType, &content, &serveExternal, &rendered, &added) != sql.ErrNoRows {
+		foundAsset = model.NewAsset(name, mimeType)
+		foundAsset.Content = content
+		foundAsset.ServeExternal = serveExternal == 1
+		foundAsset.Rendered = rendered == 1
+		foundAsset.Added.Set(time.Unix(added, 0))
+		foundAsset.Modified.Set(time.Unix(added, 0))
+	} else {
+		err = fmt.Errorf("No version %d of asset %s", version, name)
+	}
+
+	return foundAsset, err
+}
+
+// RestoreAssetVersion makes a prior version of the Asset with the given name current.
+// The version being replaced is itself kept, so a restore can be undone.
+func (model *GrogModel) RestoreAssetVersion(name string, version int64) error {
+	if !model.AssetExists(name) {
+		return fmt.Errorf("No asset with name %s", name)
+	}
+
+	restored, restoredErr := model.GetAssetVersion(name, version)
+	if restoredErr != nil {
+		return restoredErr
+	}
+
+	return restored.Save()
+}
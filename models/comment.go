@@ -0,0 +1,220 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The moderation states that a Comment can be in. New comments wait in the pending
+// state until they are approved; only approved comments are shown.
+const (
+	CommentPending  = "pending"
+	CommentApproved = "approved"
+	CommentSpam     = "spam"
+)
+
+// commentColumns lists the columns that readCommentFromRow expects, in order.
+const commentColumns = `id, content, parent, user, author_name, author_email, body, status, added`
+
+// ValidCommentStatus reports whether status is one of the known moderation states.
+func ValidCommentStatus(status string) bool {
+	switch status {
+	case CommentPending, CommentApproved, CommentSpam:
+		return true
+	}
+
+	return false
+}
+
+// Comment is a reader's response to a Content, or a reply to another Comment on the
+// same Content.
+type Comment struct {
+	model       *GrogModel
+	ID          int64
+	Content     int64
+	Parent      int64 // Comment that this one replies to, or 0
+	User        int64 // Set if the comment was made by a logged-in User
+	AuthorName  string
+	AuthorEmail string
+	Body        string
+	Status      string
+	Added       NullTime
+	Replies     []*Comment
+}
+
+// NewComment creates a new, pending Comment on the Content with the given id.
+func (model *GrogModel) NewComment(contentID int64, parent int64, authorName string,
+	authorEmail string, body string) *Comment {
+
+	newComment := new(Comment)
+	newComment.ID = -1 // Not set value
+	newComment.Content = contentID
+	newComment.Parent = parent
+	newComment.AuthorName = authorName
+	newComment.AuthorEmail = authorEmail
+	newComment.Body = body
+	newComment.Status = CommentPending
+	newComment.model = model
+
+	return newComment
+}
+
+// GetComment retrieves the Comment with the given id.
+func (model *GrogModel) GetComment(id int64) (*Comment, error) {
+	var foundComment *Comment
+	var err error
+
+	rows, queryErr := model.db.DB.Query(`select `+commentColumns+` from comments where id = ?`, id)
+
+	if queryErr == nil {
+		defer rows.Close()
+
+		foundComment = model.readCommentFromRow(rows)
+
+		if foundComment == nil {
+			err = fmt.Errorf("no Comment with id %d", id)
+		}
+	} else {
+		err = fmt.Errorf("database error while reading Comment: %v", queryErr)
+	}
+
+	return foundComment, err
+}
+
+// AllComments loads every Comment in the given moderation state, oldest first. If
+// status is empty, comments in every state are loaded.
+func (model *GrogModel) AllComments(status string) ([]*Comment, error) {
+	var foundComments []*Comment
+
+	commentQuery := `select ` + commentColumns + ` from comments`
+	var args []interface{}
+	if len(status) > 0 {
+		commentQuery += ` where status = ?`
+		args = append(args, status)
+	}
+	commentQuery += ` order by added, id`
+
+	rows, rowsErr := model.db.DB.Query(commentQuery, args...)
+	if rowsErr != nil {
+		return nil, fmt.Errorf("error loading comments: %v", rowsErr)
+	}
+
+	defer rows.Close()
+
+	for foundComment := model.readCommentFromRow(rows); foundComment != nil; foundComment = model.readCommentFromRow(rows) {
+		foundComments = append(foundComments, foundComment)
+	}
+
+	return foundComments, nil
+}
+
+func (model *GrogModel) readCommentFromRow(rows *sql.Rows) *Comment {
+	var foundComment *Comment
+
+	if rows.Next() {
+		var (
+			id          int64
+			content     int64
+			parent      int64
+			user        int64
+			authorName  string
+			authorEmail string
+			body        string
+			status      string
+			added       int64
+		)
+
+		if rows.Scan(&id, &content, &parent, &user, &authorName, &authorEmail, &body, &status,
+			&added) != sql.ErrNoRows {
+			foundComment = model.NewComment(content, parent, authorName, authorEmail, body)
+			foundComment.ID = id
+			foundComment.User = user
+			foundComment.Status = status
+			foundComment.Added.Set(time.Unix(added, 0))
+		}
+	}
+
+	return foundComment
+}
+
+// Save writes the Comment to the database.
+func (comment *Comment) Save() error {
+	if !ValidCommentStatus(comment.Status) {
+		return fmt.Errorf("unknown Comment status %q", comment.Status)
+	}
+
+	if comment.ID == -1 {
+		insertResult, err := comment.model.db.DB.Exec(`insert into comments (content, parent, user,
+			author_name, author_email, body, status, added) values (?, ?, ?, ?, ?, ?, ?, strftime('%s','now'))`,
+			comment.Content, comment.Parent, comment.User, comment.AuthorName, comment.AuthorEmail,
+			comment.Body, comment.Status)
+		if err != nil {
+			return fmt.Errorf("error saving new Comment: %v", err)
+		}
+
+		comment.ID, err = insertResult.LastInsertId()
+
+		return err
+	}
+
+	_, err := comment.model.db.DB.Exec(`update comments set content = ?, parent = ?, user = ?,
+		author_name = ?, author_email = ?, body = ?, status = ? where id = ?`,
+		comment.Content, comment.Parent, comment.User, comment.AuthorName, comment.AuthorEmail,
+		comment.Body, comment.Status, comment.ID)
+	if err != nil {
+		return fmt.Errorf("error updating Comment %d: %v", comment.ID, err)
+	}
+
+	return nil
+}
+
+// Delete removes the Comment, and every reply to it, from the database.
+func (comment *Comment) Delete() error {
+	_, err := comment.model.db.DB.Exec(`with recursive thread(id) as (select ?
+			union all select comments.id from comments join thread on comments.parent = thread.id)
+		delete from comments where id in (select id from thread)`, comment.ID)
+	if err != nil {
+		return fmt.Errorf("error deleting Comment %d: %v", comment.ID, err)
+	}
+
+	return nil
+}
+
+// Comments loads the Content's approved comments, oldest first, with replies gathered
+// into the Replies of the comments they answer. Replies to comments that have not been
+// approved are left out.
+func (content *Content) Comments() []*Comment {
+	var topLevel []*Comment
+
+	rows, queryErr := content.model.db.DB.Query(`select `+commentColumns+` from comments
+		where content = ? and status = ? order by added, id`, content.ID, CommentApproved)
+
+	if queryErr == nil {
+		defer rows.Close()
+
+		byID := make(map[int64]*Comment)
+		for foundComment := content.model.readCommentFromRow(rows); foundComment != nil; foundComment = content.model.readCommentFromRow(rows) {
+			// A reply is always added after the comment it answers, so its parent has
+			// already been seen if it is going to be shown at all.
+			if foundComment.Parent == 0 {
+				topLevel = append(topLevel, foundComment)
+			} else if parent, parentFound := byID[foundComment.Parent]; parentFound {
+				parent.Replies = append(parent.Replies, foundComment)
+			} else {
+				continue
+			}
+
+			byID[foundComment.ID] = foundComment
+		}
+	}
+
+	return topLevel
+}
+
+// deleteComments removes every comment on the Content.
+func (content *Content) deleteComments() error {
+	_, err := content.model.db.DB.Exec("delete from comments where content = ?", content.ID)
+
+	return err
+}
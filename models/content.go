@@ -8,20 +8,69 @@ import (
 	"unicode"
 )
 
+// The publication states that Content can be in. Only published Content, and scheduled
+// Content whose PublishAt time has passed, is shown to the public.
+const (
+	ContentDraft     = "draft"
+	ContentScheduled = "scheduled"
+	ContentPublished = "published"
+	ContentArchived  = "archived"
+)
+
+// The formats that a Content's Body can be written in.
+const (
+	BodyHTML     = "html"
+	BodyMarkdown = "markdown"
+	BodyPlain    = "plain"
+)
+
+// contentColumns lists the columns that readContentFromRow expects, in order.
+const contentColumns = `id, title, summary, body, slug, template, parent, author, added, modified,
+	status, publish_at, body_format`
+
+// publishedCondition is a SQL condition that holds for Content that the public may see.
+const publishedCondition = `(status = 'published' or (status = 'scheduled' and
+	publish_at <= strftime('%s','now')))`
+
+// ValidContentStatus reports whether status is one of the known publication states.
+func ValidContentStatus(status string) bool {
+	switch status {
+	case ContentDraft, ContentScheduled, ContentPublished, ContentArchived:
+		return true
+	}
+
+	return false
+}
+
+// ValidBodyFormat reports whether format is one of the known body formats.
+func ValidBodyFormat(format string) bool {
+	switch format {
+	case BodyHTML, BodyMarkdown, BodyPlain:
+		return true
+	}
+
+	return false
+}
+
 // Content models an individual unit of blog content
 type Content struct {
-	model    *GrogModel
-	ID       int64
-	Title    string
-	Summary  string
-	Body     string
-	Slug     string
-	Template string
-	Parent   int64
-	Author   int64
-	Added    NullTime
-	Modified NullTime
-	Children []*Content
+	model      *GrogModel
+	ID         int64
+	Title      string
+	Summary    string
+	Body       string
+	Slug       string
+	Template   string
+	Parent     int64
+	Author     int64
+	Added      NullTime
+	Modified   NullTime
+	Children   []*Content
+	Editor     int64 // User making the current change, recorded with its revision
+	Status     string
+	PublishAt  NullTime
+	BodyFormat string
+	preview    bool // Include unpublished children
 }
 
 // NewContent creates a new Content object
@@ -40,6 +89,9 @@ func (model *GrogModel) NewContent(title string, summary string, body string, sl
 	newContent.Summary = summary
 	newContent.Body = body
 	newContent.Template = template
+	newContent.Status = ContentPublished
+	newContent.PublishAt.Null = true
+	newContent.BodyFormat = BodyHTML
 	newContent.model = model
 
 	return newContent
@@ -50,8 +102,7 @@ func (model *GrogModel) GetContent(id int64) (*Content, error) {
 	var foundContent *Content
 	var err error
 
-	contentRow, queryErr := model.db.DB.Query(`select id, title, summary, body, slug, template,
-												parent, author, added, modified from Content where id = ?`, id)
+	contentRow, queryErr := model.db.DB.Query(`select `+contentColumns+` from Content where id = ?`, id)
 
 	if queryErr == nil {
 		defer contentRow.Close()
@@ -73,8 +124,7 @@ func (model *GrogModel) GetContentBySlug(slugged string) (*Content, error) {
 	var foundContent *Content
 	var err error
 
-	contentRow, queryErr := model.db.DB.Query(`select id, title, summary, body, slug, template,
-		parent, author, added, modified from Content where slug = ?`, slugged)
+	contentRow, queryErr := model.db.DB.Query(`select `+contentColumns+` from Content where slug = ?`, slugged)
 
 	if queryErr == nil {
 		defer contentRow.Close()
@@ -106,33 +156,62 @@ func (model *GrogModel) readContentFromRow(rows *sql.Rows) *Content {
 			author   int64
 			added    int64
 			edited   int64
+			status   string
+			publish  int64
+			format   string
 		)
 
-		if rows.Scan(&id, &title, &summary, &body, &slug, &template, &parent, &author, &added, &edited) != sql.ErrNoRows {
+		if rows.Scan(&id, &title, &summary, &body, &slug, &template, &parent, &author, &added, &edited,
+			&status, &publish, &format) != sql.ErrNoRows {
 			foundContent = model.NewContent(title, summary, body, slug, template)
 			foundContent.ID = id
 			foundContent.Parent = parent
 			foundContent.Author = author
 			foundContent.Added.Set(time.Unix(added, 0))
 			foundContent.Modified.Set(time.Unix(edited, 0))
+			foundContent.Status = status
+			if publish > 0 {
+				foundContent.PublishAt.Set(time.Unix(publish, 0))
+			}
+			foundContent.BodyFormat = format
 		}
 	}
 
 	return foundContent
 }
 
-// Save writes the Content object to the database
+// Save writes the Content object to the database, records the result as a new
+// revision and updates the search index.
 func (content *Content) Save() error {
 	var saveError error
 
-	if content.ID == -1 {
+	if !ValidContentStatus(content.Status) {
+		return fmt.Errorf("unknown Content status %q", content.Status)
+	}
+	if content.Status == ContentScheduled && content.PublishAt.IsNull() {
+		return fmt.Errorf("scheduled Content must have a PublishAt time")
+	}
+	if !ValidBodyFormat(content.BodyFormat) {
+		return fmt.Errorf("unknown Content body format %q", content.BodyFormat)
+	}
+
+	// The Content, its revision and its search entry are written together, so that
+	// no change is left without a revision.
+	tx, txErr := content.model.db.DB.Begin()
+	if txErr != nil {
+		return fmt.Errorf("error saving Content: %v", txErr)
+	}
+	defer tx.Rollback()
+
+	isNew := content.ID == -1
+	if isNew {
 		// New, do insert
 
-		insertResult, err := content.model.db.DB.Exec(`insert into content (title, summary, body, slug, 
-			template, parent, author, added, modified) values (?, ?, ?, ?, ?, ?, ?,
-				strftime('%s','now'), strftime('%s','now'))`,
+		insertResult, err := tx.Exec(`insert into content (title, summary, body, slug,
+			template, parent, author, added, modified, status, publish_at, body_format) values (?, ?, ?, ?,
+				?, ?, ?, strftime('%s','now'), strftime('%s','now'), ?, ?, ?)`,
 			content.Title, content.Summary, content.Body, content.Slug, content.Template,
-			content.Parent, content.Author)
+			content.Parent, content.Author, content.Status, content.PublishAt.Unix(), content.BodyFormat)
 		if err == nil {
 			content.ID, err = insertResult.LastInsertId()
 			if err != nil {
@@ -143,13 +222,27 @@ func (content *Content) Save() error {
 		saveError = err
 	} else {
 		// Exists, do update
-		_, err := content.model.db.DB.Exec(`update content set title = ?, summary = ?, body = ?, slug = ?,
-				template = ?, parent = ?, author = ?, modified = strftime('%s','now') where Id = ?`, content.Title,
+		_, err := tx.Exec(`update content set title = ?, summary = ?, body = ?, slug = ?,
+				template = ?, parent = ?, author = ?, modified = strftime('%s','now'), status = ?,
+				publish_at = ?, body_format = ? where Id = ?`, content.Title,
 			content.Summary, content.Body, content.Slug, content.Template, content.Parent,
-			content.Author, content.ID)
+			content.Author, content.Status, content.PublishAt.Unix(), content.BodyFormat, content.ID)
 		saveError = err
 	}
 
+	if saveError == nil {
+		saveError = content.saveRevision(tx)
+	}
+	if saveError == nil {
+		saveError = content.index(tx)
+	}
+	if saveError == nil {
+		saveError = tx.Commit()
+	}
+	if saveError != nil && isNew {
+		content.ID = -1
+	}
+
 	return saveError
 }
 
@@ -158,21 +251,44 @@ func (content Content) IndexSet() bool {
 	return content.ID != -1
 }
 
+// IsPublished reports whether the Content may be shown to the public.
+func (content Content) IsPublished() bool {
+	switch content.Status {
+	case ContentPublished:
+		return true
+	case ContentScheduled:
+		return !content.PublishAt.IsNull() && !content.PublishAt.Val().After(time.Now())
+	}
+
+	return false
+}
+
+// SetPreview controls whether IncludeChildren also finds unpublished children. It is
+// meant for authenticated users who need to see Content before it goes live.
+func (content *Content) SetPreview(preview bool) {
+	content.preview = preview
+}
+
 // IncludeChildren populates the Content's Children property with all of the Content
-// objects in the database whose Parent field is equal to the Content's ID.
+// objects in the database whose Parent field is equal to the Content's ID. Unless
+// the Content is being previewed, only published children are included.
 func (content *Content) IncludeChildren() *Content {
 
 	var foundContent *Content
 
-	contentRows, queryErr := content.model.db.DB.Query(`select id, title, summary, body, slug, template,
-	parent, author, added, modified from Content where parent = ?`, content.ID)
+	childQuery := `select ` + contentColumns + ` from Content where parent = ?`
+	if !content.preview {
+		childQuery += ` and ` + publishedCondition
+	}
+
+	contentRows, queryErr := content.model.db.DB.Query(childQuery, content.ID)
 
 	if queryErr == nil {
 		defer contentRows.Close()
 
 		foundContent = content.model.readContentFromRow(contentRows)
 		for foundContent != nil {
-			fmt.Printf("found child content: %+v\n", foundContent)
+			foundContent.preview = content.preview
 			if content.Children == nil {
 				content.Children = make([]*Content, 1, 10)
 				content.Children[0] = foundContent
@@ -218,41 +334,18 @@ func MakeSlug(toSlug string) string {
 func (model *GrogModel) AllContents() ([]*Content, error) {
 	var foundContents []*Content
 
-	rows, rowsErr := model.db.DB.Query(`select id, title, summary, body, slug, template,
-		parent, author, added, modified from Content`)
+	rows, rowsErr := model.db.DB.Query(`select ` + contentColumns + ` from Content`)
 	if rowsErr != nil {
 		return nil, fmt.Errorf("error loading all assets: %v", rowsErr)
 	}
 
 	defer rows.Close()
 
-	var (
-		ID       int64
-		title    string
-		summary  string
-		body     string
-		slug     string
-		template string
-		parent   int64
-		author   int64
-		added    int64
-		modified int64
-	)
-
-	for rows.Next() {
-		if rows.Scan(&ID, &title, &summary, &body, &slug, &template, &parent, &author, &added, &modified) != sql.ErrNoRows {
-			foundContent := model.NewContent(title, summary, body, slug, template)
-			foundContent.ID = ID
-			foundContent.Parent = parent
-			foundContent.Author = author
-			foundContent.Added.Set(time.Unix(added, 0))
-			foundContent.Modified.Set(time.Unix(modified, 0))
-
-			if foundContents == nil {
-				foundContents = make([]*Content, 0)
-			}
-			foundContents = append(foundContents, foundContent)
+	for foundContent := model.readContentFromRow(rows); foundContent != nil; foundContent = model.readContentFromRow(rows) {
+		if foundContents == nil {
+			foundContents = make([]*Content, 0)
 		}
+		foundContents = append(foundContents, foundContent)
 	}
 
 	return foundContents, nil
@@ -270,5 +363,25 @@ func (content Content) Delete() error {
 		return fmt.Errorf("Content.Delete should delete exactly 1 row. Instead, returned %d", rowsDeleted)
 	}
 
-	return nil
+	_, err = content.model.db.DB.Exec("delete from content_revisions where content = ?", content.ID)
+	if err != nil {
+		return err
+	}
+
+	err = content.deleteComments()
+	if err != nil {
+		return err
+	}
+
+	_, err = content.model.db.DB.Exec("delete from content_tags where content = ?", content.ID)
+	if err != nil {
+		return err
+	}
+
+	err = content.model.deleteUnusedTags()
+	if err != nil {
+		return err
+	}
+
+	return content.unindex(content.model.db.DB)
 }
@@ -1,11 +1,24 @@
 package model
 
-import "github.com/adamcrossland/grog/manageddb"
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/adamcrossland/grog/manageddb"
+)
 
 // GrogModel has all of the data and methods for interacting with the database that
 // backs Grog.
 type GrogModel struct {
-	db *manageddb.ManagedDB
+	db           *manageddb.ManagedDB
+	fullTextOnce sync.Once
+	fullText     bool // Whether content_search is an FTS5 table; see fullTextSearch
+}
+
+// execer runs statements on the database or in a transaction, so that the steps of
+// a change can be made either way.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
 }
 
 // NewModel create a new GrogModel instance.
@@ -2,7 +2,9 @@ package model
 
 import (
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/adamcrossland/grog/manageddb"
 	"github.com/adamcrossland/grog/migrations"
@@ -230,3 +232,868 @@ func TestContentChildren(t *testing.T) {
 
 	//dbTeardown()
 }
+
+func TestSessionsAndTokens(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	testUser := model.NewUser("tokenuser@test.com", "Token User")
+	if saveErr := testUser.Save(); saveErr != nil {
+		t.Fatalf("saving of testUser failed with error: %v", saveErr)
+	}
+
+	_, sessionKey, sessionErr := model.NewSession(testUser.ID, time.Hour)
+	if sessionErr != nil {
+		t.Fatalf("NewSession failed with error: %v", sessionErr)
+	}
+
+	foundSession, foundErr := model.GetSession(sessionKey)
+	if foundErr != nil {
+		t.Fatalf("GetSession failed with error: %v", foundErr)
+	}
+	if foundSession.User != testUser.ID {
+		t.Fatalf("session has user %d instead of %d", foundSession.User, testUser.ID)
+	}
+
+	_, expiredKey, _ := model.NewSession(testUser.ID, -time.Hour)
+	if _, expiredErr := model.GetSession(expiredKey); expiredErr == nil {
+		t.Fatal("GetSession returned an expired session")
+	}
+
+	_, token, tokenErr := model.NewAPIToken(testUser.ID, "test")
+	if tokenErr != nil {
+		t.Fatalf("NewAPIToken failed with error: %v", tokenErr)
+	}
+
+	tokenUser, tokenUserErr := model.GetUserByAPIToken(token)
+	if tokenUserErr != nil {
+		t.Fatalf("GetUserByAPIToken failed with error: %v", tokenUserErr)
+	}
+	if tokenUser.ID != testUser.ID {
+		t.Fatalf("api token belongs to user %d instead of %d", tokenUser.ID, testUser.ID)
+	}
+
+	if _, badErr := model.GetUserByAPIToken("not a token"); badErr == nil {
+		t.Fatal("GetUserByAPIToken accepted an unknown token")
+	}
+
+	if _, authErr := model.AuthenticateUser(testUser.Email, token); authErr != nil {
+		t.Fatalf("AuthenticateUser rejected a valid token: %v", authErr)
+	}
+
+	dbTeardown()
+}
+
+func TestUserPasswords(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	testUser := model.NewUser("passworduser@test.com", "Password User")
+	if saveErr := testUser.Save(); saveErr != nil {
+		t.Fatalf("saving of testUser failed with error: %v", saveErr)
+	}
+
+	if _, noPasswordErr := model.VerifyUserPassword(testUser.Email, ""); noPasswordErr == nil {
+		t.Fatal("VerifyUserPassword accepted a user without a password")
+	}
+
+	if shortErr := model.SetUserPassword(testUser.ID, "short"); shortErr == nil {
+		t.Fatal("SetUserPassword accepted a password that is too short")
+	}
+
+	if setErr := model.SetUserPassword(testUser.ID, "correct horse"); setErr != nil {
+		t.Fatalf("SetUserPassword failed with error: %v", setErr)
+	}
+
+	if _, verifyErr := model.VerifyUserPassword(testUser.Email, "correct horse"); verifyErr != nil {
+		t.Fatalf("VerifyUserPassword rejected the correct password: %v", verifyErr)
+	}
+
+	if _, wrongErr := model.VerifyUserPassword(testUser.Email, "battery staple"); wrongErr == nil {
+		t.Fatal("VerifyUserPassword accepted the wrong password")
+	}
+
+	resetPassword, resetErr := model.ResetUserPassword(testUser.ID)
+	if resetErr != nil {
+		t.Fatalf("ResetUserPassword failed with error: %v", resetErr)
+	}
+
+	if _, authErr := model.AuthenticateUser(testUser.Email, resetPassword); authErr != nil {
+		t.Fatalf("AuthenticateUser rejected the reset password: %v", authErr)
+	}
+
+	if _, oldErr := model.AuthenticateUser(testUser.Email, "correct horse"); oldErr == nil {
+		t.Fatal("AuthenticateUser accepted the password from before the reset")
+	}
+
+	_, sessionKey, sessionErr := model.NewSession(testUser.ID, time.Hour)
+	if sessionErr != nil {
+		t.Fatalf("NewSession failed with error: %v", sessionErr)
+	}
+	_, token, tokenErr := model.NewAPIToken(testUser.ID, "test")
+	if tokenErr != nil {
+		t.Fatalf("NewAPIToken failed with error: %v", tokenErr)
+	}
+
+	if setErr := model.SetUserPassword(testUser.ID, "battery staple"); setErr != nil {
+		t.Fatalf("SetUserPassword failed with error: %v", setErr)
+	}
+
+	if _, getErr := model.GetSession(sessionKey); getErr == nil {
+		t.Fatal("a session from before the password was changed is still valid")
+	}
+	if _, getErr := model.GetUserByAPIToken(token); getErr == nil {
+		t.Fatal("an API token from before the password was changed is still valid")
+	}
+
+	dbTeardown()
+}
+
+func TestUserRoles(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	author := model.NewUser("author@test.com", "Author")
+	if author.Role != RoleViewer {
+		t.Fatalf("new users should be viewers, got %s", author.Role)
+	}
+	author.Role = RoleAuthor
+	if saveErr := author.Save(); saveErr != nil {
+		t.Fatalf("saving of author failed with error: %v", saveErr)
+	}
+
+	author.Name = "Renamed Author"
+	if updateErr := author.Save(); updateErr != nil {
+		t.Fatalf("updating author failed with error: %v", updateErr)
+	}
+
+	foundAuthor, foundErr := model.GetUser(author.ID)
+	if foundErr != nil {
+		t.Fatalf("GetUser failed with error: %v", foundErr)
+	}
+	if foundAuthor.Role != RoleAuthor || foundAuthor.Name != "Renamed Author" {
+		t.Fatalf("author was not saved correctly: %+v", foundAuthor)
+	}
+
+	author.Role = "overlord"
+	if badRoleErr := author.Save(); badRoleErr == nil {
+		t.Fatal("saving a user with an unknown role should fail")
+	}
+	author.Role = RoleAuthor
+
+	ownPost := model.NewContent("Own post", "", "", "", "")
+	ownPost.Author = author.ID
+	otherPost := model.NewContent("Other post", "", "", "", "")
+	otherPost.Author = author.ID + 1
+
+	if !author.CanEditContent(ownPost) {
+		t.Fatal("authors should be able to edit their own content")
+	}
+	if author.CanEditContent(otherPost) {
+		t.Fatal("authors should not be able to edit content by others")
+	}
+	if author.CanEditAssets() || author.CanEditQueries() {
+		t.Fatal("authors should not be able to edit assets or queries")
+	}
+
+	editor := model.NewUser("editor@test.com", "Editor")
+	editor.Role = RoleEditor
+	if !editor.CanEditContent(otherPost) {
+		t.Fatal("editors should be able to edit content by others")
+	}
+
+	viewer := model.NewUser("viewer@test.com", "Viewer")
+	if viewer.CanAddContent() || viewer.CanEditContent(ownPost) {
+		t.Fatal("viewers should not be able to change content")
+	}
+
+	admin := model.NewUser("admin@test.com", "Admin")
+	admin.Role = RoleAdmin
+	if !admin.CanEditAssets() || !admin.CanEditQueries() {
+		t.Fatal("admins should be able to edit assets and queries")
+	}
+
+	dbTeardown()
+}
+
+func TestContentRevisions(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	post := model.NewContent("Revised post", "First summary", "one\ntwo\nthree", "", "")
+	post.Author = 7
+	if saveErr := post.Save(); saveErr != nil {
+		t.Fatalf("Saving new Content resulted in database error: %v", saveErr)
+	}
+
+	post.Body = "one\n2\nthree"
+	post.Editor = 9
+	if saveErr := post.Save(); saveErr != nil {
+		t.Fatalf("Updating Content resulted in database error: %v", saveErr)
+	}
+
+	revisions, revisionsErr := model.ContentRevisions(post.ID)
+	if revisionsErr != nil {
+		t.Fatalf("ContentRevisions failed with error: %v", revisionsErr)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("expected 2 revisions, got %d", len(revisions))
+	}
+	if revisions[0].Author != 7 || revisions[1].Author != 9 {
+		t.Fatalf("revisions have authors %d and %d instead of 7 and 9", revisions[0].Author, revisions[1].Author)
+	}
+
+	diff := revisions[0].Diff(revisions[1])
+	expectedDiff := "--- revision 1\n+++ revision 2\n@@ body @@\n one\n-two\n+2\n three\n"
+	if diff != expectedDiff {
+		t.Fatalf("unexpected diff:\n%s", diff)
+	}
+
+	if restoreErr := post.Restore(1); restoreErr != nil {
+		t.Fatalf("Restore failed with error: %v", restoreErr)
+	}
+
+	restored, restoredErr := model.GetContent(post.ID)
+	if restoredErr != nil {
+		t.Fatalf("GetContent failed with error: %v", restoredErr)
+	}
+	if restored.Body != "one\ntwo\nthree" {
+		t.Fatalf("restored Body was %q", restored.Body)
+	}
+
+	latest, latestErr := model.GetContentRevision(post.ID, 3)
+	if latestErr != nil {
+		t.Fatalf("restoring should have saved revision 3: %v", latestErr)
+	}
+	if latest.Body != restored.Body {
+		t.Fatal("revision 3 does not match the restored Content")
+	}
+
+	// A change that cannot be recorded as a revision is not saved either.
+	if _, triggerErr := model.db.DB.Exec(`create trigger norevisions before insert on content_revisions
+		begin select raise(fail, 'no revisions'); end`); triggerErr != nil {
+		t.Fatalf("creating trigger failed with error: %v", triggerErr)
+	}
+
+	restored.Body = "unrecorded"
+	if saveErr := restored.Save(); saveErr == nil {
+		t.Fatal("Save succeeded although its revision could not be saved")
+	}
+	unchanged, _ := model.GetContent(post.ID)
+	if unchanged.Body != "one\ntwo\nthree" {
+		t.Fatalf("Content was changed to %q without a revision", unchanged.Body)
+	}
+
+	orphan := model.NewContent("Orphan", "", "", "", "")
+	if saveErr := orphan.Save(); saveErr == nil || orphan.IndexSet() {
+		t.Fatal("new Content was saved, or kept its id, although its revision could not be saved")
+	}
+
+	dbTeardown()
+}
+
+func TestAssetVersions(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	asset := model.NewAsset("versioned.html", "text/html")
+	asset.Write([]byte("first"))
+	if saveErr := asset.Save(); saveErr != nil {
+		t.Fatalf("Saving new Asset resulted in database error: %v", saveErr)
+	}
+
+	asset.Write([]byte("second"))
+	asset.Rendered = true
+	if saveErr := asset.Save(); saveErr != nil {
+		t.Fatalf("Updating Asset resulted in database error: %v", saveErr)
+	}
+
+	versions, versionsErr := model.AssetVersions("versioned.html")
+	if versionsErr != nil {
+		t.Fatalf("AssetVersions failed with error: %v", versionsErr)
+	}
+	if len(versions) != 1 || versions[0].Version != 1 || versions[0].Rendered {
+		t.Fatalf("expected one unrendered prior version, got %+v", versions)
+	}
+
+	first, firstErr := model.GetAssetVersion("versioned.html", 1)
+	if firstErr != nil {
+		t.Fatalf("GetAssetVersion failed with error: %v", firstErr)
+	}
+	if string(first.Content) != "first" {
+		t.Fatalf("version 1 has content %q", string(first.Content))
+	}
+
+	if restoreErr := model.RestoreAssetVersion("versioned.html", 1); restoreErr != nil {
+		t.Fatalf("RestoreAssetVersion failed with error: %v", restoreErr)
+	}
+
+	current, currentErr := model.GetAsset("versioned.html")
+	if currentErr != nil {
+		t.Fatalf("GetAsset failed with error: %v", currentErr)
+	}
+	if string(current.Content) != "first" || current.Rendered {
+		t.Fatalf("restored asset has content %q and rendered %v", string(current.Content), current.Rendered)
+	}
+
+	second, secondErr := model.GetAssetVersion("versioned.html", 2)
+	if secondErr != nil {
+		t.Fatalf("restoring should have kept version 2: %v", secondErr)
+	}
+	if string(second.Content) != "second" {
+		t.Fatalf("version 2 has content %q", string(second.Content))
+	}
+
+	dbTeardown()
+}
+
+func TestContentPublishing(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	parent := model.NewContent("Publishing parent", "", "", "", "")
+	if saveErr := parent.Save(); saveErr != nil {
+		t.Fatalf("Saving parent Content resulted in database error: %v", saveErr)
+	}
+	if !parent.IsPublished() {
+		t.Fatal("new Content should be published by default")
+	}
+
+	draft := model.NewContent("Draft child", "", "", "", "")
+	draft.Parent = parent.ID
+	draft.Status = ContentDraft
+
+	scheduledPast := model.NewContent("Past child", "", "", "", "")
+	scheduledPast.Parent = parent.ID
+	scheduledPast.Status = ContentScheduled
+	scheduledPast.PublishAt.Set(time.Now().Add(-time.Hour))
+
+	scheduledFuture := model.NewContent("Future child", "", "", "", "")
+	scheduledFuture.Parent = parent.ID
+	scheduledFuture.Status = ContentScheduled
+
+	if unsetErr := scheduledFuture.Save(); unsetErr == nil {
+		t.Fatal("scheduled Content without a PublishAt time should not save")
+	}
+	scheduledFuture.PublishAt.Set(time.Now().Add(time.Hour))
+
+	for _, child := range []*Content{draft, scheduledPast, scheduledFuture} {
+		if saveErr := child.Save(); saveErr != nil {
+			t.Fatalf("Saving %s resulted in database error: %v", child.Title, saveErr)
+		}
+	}
+
+	if draft.IsPublished() || !scheduledPast.IsPublished() || scheduledFuture.IsPublished() {
+		t.Fatal("IsPublished gave the wrong answer for a child")
+	}
+
+	loadedFuture, loadErr := model.GetContent(scheduledFuture.ID)
+	if loadErr != nil {
+		t.Fatalf("GetContent failed with error: %v", loadErr)
+	}
+	if loadedFuture.Status != ContentScheduled || loadedFuture.PublishAt.Unix() != scheduledFuture.PublishAt.Unix() {
+		t.Fatalf("scheduled Content was not loaded correctly: %+v", loadedFuture)
+	}
+
+	parent.IncludeChildren()
+	if len(parent.Children) != 1 || parent.Children[0].ID != scheduledPast.ID {
+		t.Fatalf("expected only the past scheduled child, got %d children", len(parent.Children))
+	}
+
+	parent.Children = nil
+	parent.SetPreview(true)
+	parent.IncludeChildren()
+	if len(parent.Children) != 3 {
+		t.Fatalf("preview should include all 3 children, got %d", len(parent.Children))
+	}
+
+	dbTeardown()
+}
+
+func TestContentSearch(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	lizards := model.NewContent("Lizards of the desert", "Reptiles that like the heat",
+		"<p>The <em>chuckwalla</em> basks on rocks.</p>", "", "")
+	snakes := model.NewContent("Snakes", "More reptiles", "<div class=\"chuckwalla\">Rattlers</div>", "", "")
+	hidden := model.NewContent("Hidden lizards", "", "A draft about lizards", "", "")
+	hidden.Status = ContentDraft
+
+	for _, content := range []*Content{lizards, snakes, hidden} {
+		if saveErr := content.Save(); saveErr != nil {
+			t.Fatalf("Saving %s resulted in database error: %v", content.Title, saveErr)
+		}
+	}
+
+	results, searchErr := model.SearchContent("chuckwalla", 0, false)
+	if searchErr != nil {
+		t.Fatalf("SearchContent resulted in error: %v", searchErr)
+	}
+	if len(results) != 1 || results[0].Content.ID != lizards.ID {
+		t.Fatalf("expected only the lizards Content to match, got %d results", len(results))
+	}
+	if results[0].Snippet != "The <mark>chuckwalla</mark> basks on rocks." {
+		t.Fatalf("unexpected snippet %q", results[0].Snippet)
+	}
+
+	results, searchErr = model.SearchContent("lizard", 0, false)
+	if searchErr != nil {
+		t.Fatalf("SearchContent resulted in error: %v", searchErr)
+	}
+	if len(results) != 1 {
+		t.Fatalf("unpublished Content should not be found; got %d results", len(results))
+	}
+
+	results, searchErr = model.SearchContent("lizards", 0, true)
+	if searchErr != nil {
+		t.Fatalf("SearchContent resulted in error: %v", searchErr)
+	}
+	if len(results) != 2 || results[0].Content.ID != hidden.ID {
+		t.Fatal("a match in the title should rank above a match in the body")
+	}
+
+	if _, quotedErr := model.SearchContent(`reptiles" OR (`, 0, false); quotedErr != nil {
+		t.Fatalf("search terms should not be treated as query syntax: %v", quotedErr)
+	}
+
+	snakes.Body = "Vipers"
+	if saveErr := snakes.Save(); saveErr != nil {
+		t.Fatalf("Saving updated Content resulted in database error: %v", saveErr)
+	}
+	if results, _ = model.SearchContent("rattlers", 0, false); len(results) != 0 {
+		t.Fatal("search index was not updated when Content was saved")
+	}
+
+	if deleteErr := lizards.Delete(); deleteErr != nil {
+		t.Fatalf("Deleting Content resulted in error: %v", deleteErr)
+	}
+	if results, _ = model.SearchContent("chuckwalla", 0, true); len(results) != 0 {
+		t.Fatal("deleted Content was still found")
+	}
+}
+
+func TestContentTags(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	unsaved := model.NewContent("Unsaved", "", "", "", "")
+	if tagErr := unsaved.Tag("go"); tagErr == nil {
+		t.Fatal("tagging unsaved Content should fail")
+	}
+
+	first := model.NewContent("First tagged", "", "", "", "")
+	second := model.NewContent("Second tagged", "", "", "", "")
+	draft := model.NewContent("Draft tagged", "", "", "", "")
+	draft.Status = ContentDraft
+
+	for _, content := range []*Content{first, second, draft} {
+		if saveErr := content.Save(); saveErr != nil {
+			t.Fatalf("Saving %s resulted in database error: %v", content.Title, saveErr)
+		}
+		if tagErr := content.Tag("Go", "  Web   Development "); tagErr != nil {
+			t.Fatalf("Tagging %s resulted in error: %v", content.Title, tagErr)
+		}
+	}
+
+	if tagErr := first.Tag("go/lang"); tagErr == nil {
+		t.Fatal("a tag name with a slash should not be allowed")
+	}
+	if tagErr := first.Tag("databases"); tagErr != nil {
+		t.Fatalf("Tagging resulted in error: %v", tagErr)
+	}
+
+	tags := first.Tags()
+	if len(tags) != 3 || tags[0].Name != "databases" || tags[1].Name != "go" || tags[2].Name != "web development" {
+		t.Fatalf("unexpected tags on Content: %v", tags)
+	}
+
+	tagged, taggedErr := model.ContentsWithTag("GO", false)
+	if taggedErr != nil {
+		t.Fatalf("ContentsWithTag resulted in error: %v", taggedErr)
+	}
+	if len(tagged) != 2 {
+		t.Fatalf("expected 2 published Content tagged go, found %d", len(tagged))
+	}
+
+	goTag, goErr := model.GetTag("go")
+	if goErr != nil {
+		t.Fatalf("GetTag resulted in error: %v", goErr)
+	}
+	goTag.SetPreview(true)
+	if len(goTag.Contents()) != 3 {
+		t.Fatal("previewing a Tag should include unpublished Content")
+	}
+
+	if untagErr := first.Untag("databases"); untagErr != nil {
+		t.Fatalf("Untag resulted in error: %v", untagErr)
+	}
+	if _, gone := model.GetTag("databases"); gone == nil {
+		t.Fatal("a tag that is no longer used should be deleted")
+	}
+
+	if setErr := second.SetTags([]string{"web development"}); setErr != nil {
+		t.Fatalf("SetTags resulted in error: %v", setErr)
+	}
+	if tags = second.Tags(); len(tags) != 1 || tags[0].Name != "web development" {
+		t.Fatalf("unexpected tags after SetTags: %v", tags)
+	}
+
+	if deleteErr := first.Delete(); deleteErr != nil {
+		t.Fatalf("Deleting Content resulted in error: %v", deleteErr)
+	}
+	if tagged, _ = model.ContentsWithTag("go", true); len(tagged) != 1 || tagged[0].ID != draft.ID {
+		t.Fatal("deleted Content should no longer be tagged")
+	}
+}
+
+func TestComments(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	post := model.NewContent("Commented post", "", "", "", "")
+	if saveErr := post.Save(); saveErr != nil {
+		t.Fatalf("Saving Content resulted in database error: %v", saveErr)
+	}
+
+	first := model.NewComment(post.ID, 0, "Reader", "reader@example.com", "First!")
+	pending := model.NewComment(post.ID, 0, "Lurker", "", "Still waiting")
+	for _, comment := range []*Comment{first, pending} {
+		if saveErr := comment.Save(); saveErr != nil {
+			t.Fatalf("Saving Comment resulted in database error: %v", saveErr)
+		}
+	}
+
+	if len(post.Comments()) != 0 {
+		t.Fatal("pending comments should not be shown")
+	}
+
+	first.Status = CommentApproved
+	if saveErr := first.Save(); saveErr != nil {
+		t.Fatalf("Approving Comment resulted in database error: %v", saveErr)
+	}
+
+	reply := model.NewComment(post.ID, first.ID, "Writer", "", "Thanks")
+	reply.Status = CommentApproved
+	orphan := model.NewComment(post.ID, pending.ID, "Writer", "", "Hidden reply")
+	orphan.Status = CommentApproved
+	for _, comment := range []*Comment{reply, orphan} {
+		if saveErr := comment.Save(); saveErr != nil {
+			t.Fatalf("Saving reply resulted in database error: %v", saveErr)
+		}
+	}
+
+	comments := post.Comments()
+	if len(comments) != 1 || comments[0].ID != first.ID {
+		t.Fatalf("expected only the approved top-level comment, got %d", len(comments))
+	}
+	if len(comments[0].Replies) != 1 || comments[0].Replies[0].Body != "Thanks" {
+		t.Fatal("approved reply was not threaded under its parent")
+	}
+
+	pendingList, listErr := model.AllComments(CommentPending)
+	if listErr != nil {
+		t.Fatalf("AllComments resulted in error: %v", listErr)
+	}
+	if len(pendingList) != 1 || pendingList[0].ID != pending.ID {
+		t.Fatal("AllComments did not filter by status")
+	}
+
+	if deleteErr := first.Delete(); deleteErr != nil {
+		t.Fatalf("Deleting Comment resulted in error: %v", deleteErr)
+	}
+	if _, replyErr := model.GetComment(reply.ID); replyErr == nil {
+		t.Fatal("deleting a comment should delete its replies")
+	}
+
+	if deleteErr := post.Delete(); deleteErr != nil {
+		t.Fatalf("Deleting Content resulted in error: %v", deleteErr)
+	}
+	if remaining, _ := model.AllComments(""); len(remaining) != 0 {
+		t.Fatal("deleting Content should delete its comments")
+	}
+}
+
+func TestRenderedBody(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	post := model.NewContent("Formatted", "", "Some *emphasis* & <b>bold</b>", "", "")
+	if saveErr := post.Save(); saveErr != nil {
+		t.Fatalf("Saving Content resulted in database error: %v", saveErr)
+	}
+
+	if post.RenderedBody() != post.Body {
+		t.Fatal("HTML bodies should be rendered as they are")
+	}
+
+	post.BodyFormat = "textile"
+	if saveErr := post.Save(); saveErr == nil {
+		t.Fatal("an unknown body format should not save")
+	}
+
+	post.BodyFormat = BodyMarkdown
+	if saveErr := post.Save(); saveErr != nil {
+		t.Fatalf("Saving Content resulted in database error: %v", saveErr)
+	}
+
+	expected := "<p>Some <em>emphasis</em> &amp; <b>bold</b></p>\n"
+	if rendered := post.RenderedBody(); rendered != expected {
+		t.Fatalf("unexpected Markdown rendering %q", rendered)
+	}
+
+	revisions, _ := model.ContentRevisions(post.ID)
+	latest := revisions[len(revisions)-1]
+	var cached string
+	model.db.DB.QueryRow(`select rendered from content_revisions where content = ? and revision = ?`,
+		post.ID, latest.Revision).Scan(&cached)
+	if cached != expected {
+		t.Fatal("rendered body was not cached with the revision")
+	}
+
+	loaded, _ := model.GetContent(post.ID)
+	if loaded.BodyFormat != BodyMarkdown || loaded.RenderedBody() != expected {
+		t.Fatal("body format was not loaded with the Content")
+	}
+
+	post.BodyFormat = BodyPlain
+	post.Body = "a < b\nc\n\nd"
+	if rendered := post.RenderedBody(); rendered != "<p>a &lt; b<br />\nc</p>\n<p>d</p>\n" {
+		t.Fatalf("unexpected plain rendering %q", rendered)
+	}
+
+	if restoreErr := post.Restore(latest.Revision - 1); restoreErr != nil {
+		t.Fatalf("Restore resulted in error: %v", restoreErr)
+	}
+	if post.BodyFormat != BodyHTML {
+		t.Fatal("restoring a revision should restore its body format")
+	}
+}
+
+func TestNamedQueries(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	broken := model.NewNamedQuery("broken", "select nothing from nowhere")
+	if saveErr := broken.Save(); saveErr == nil {
+		t.Fatal("a query that cannot be prepared should not save")
+	}
+
+	titles := model.NewNamedQuery("titles", "select title from content where id > ? order by id")
+	if saveErr := titles.Save(); saveErr != nil {
+		t.Fatalf("Saving NamedQuery resulted in error: %v", saveErr)
+	}
+	if dupErr := model.NewNamedQuery("titles", "select 1").Save(); dupErr == nil {
+		t.Fatal("two queries should not be able to share a name")
+	}
+
+	for _, title := range []string{"First", "Second"} {
+		if saveErr := model.NewContent(title, "", "", "", "").Save(); saveErr != nil {
+			t.Fatalf("Saving Content resulted in database error: %v", saveErr)
+		}
+	}
+
+	loaded, loadErr := model.GetNamedQuery("titles")
+	if loadErr != nil {
+		t.Fatalf("GetNamedQuery resulted in error: %v", loadErr)
+	}
+	if loaded.ID != titles.ID || loaded.Query != titles.Query || loaded.Added.IsNull() {
+		t.Fatal("loaded NamedQuery did not match the saved one")
+	}
+
+	results, runErr := model.MakeNamedQuerier(loaded)([]interface{}{0})
+	if runErr != nil {
+		t.Fatalf("running NamedQuery resulted in error: %v", runErr)
+	}
+	rows, rowsErr := results.All()
+	if rowsErr != nil || len(rows) != 2 || rows[1]["title"] != "Second" {
+		t.Fatalf("unexpected results %v (%v)", rows, rowsErr)
+	}
+
+	loaded.Query = "select title from"
+	if saveErr := loaded.Save(); saveErr == nil {
+		t.Fatal("an update that cannot be prepared should not save")
+	}
+	loaded.Query = "select count(*) as total from content"
+	loaded.Public = true
+	loaded.Params = "status=published"
+	if saveErr := loaded.Save(); saveErr != nil {
+		t.Fatalf("Updating NamedQuery resulted in error: %v", saveErr)
+	}
+	if reloaded, _ := model.GetNamedQuery("titles"); !reloaded.Public || reloaded.Params != "status=published" {
+		t.Fatal("public and params of NamedQuery were not saved")
+	}
+	if _, loadedFuncs := model.LoadNamedQueries()["titles"]; !loadedFuncs {
+		t.Fatal("LoadNamedQueries did not load the saved query")
+	}
+
+	if deleteErr := loaded.Delete(); deleteErr != nil {
+		t.Fatalf("Deleting NamedQuery resulted in error: %v", deleteErr)
+	}
+	if remaining, _ := model.AllNamedQueries(); len(remaining) != 0 {
+		t.Fatal("deleted NamedQuery was still listed")
+	}
+}
+
+func TestNamedQueryRegistry(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	for _, title := range []string{"First", "Second"} {
+		if saveErr := model.NewContent(title, "", "", "", "").Save(); saveErr != nil {
+			t.Fatalf("Saving Content resulted in database error: %v", saveErr)
+		}
+	}
+
+	titles := model.NewNamedQuery("titles", "select title from content order by id")
+	if saveErr := titles.Save(); saveErr != nil {
+		t.Fatalf("Saving NamedQuery resulted in error: %v", saveErr)
+	}
+
+	registry, loadErr := model.NewNamedQueryRegistry()
+	if loadErr != nil {
+		t.Fatalf("NewNamedQueryRegistry resulted in error: %v", loadErr)
+	}
+	defer registry.Close()
+
+	if !registry.Exists("titles") || registry.Exists("counts") {
+		t.Fatal("registry did not hold exactly the saved queries")
+	}
+	if reloaded, _ := registry.ReloadIfChanged(); reloaded {
+		t.Fatal("registry reloaded when nothing had changed")
+	}
+
+	oldFuncs := registry.Queries()
+	inFlight, runErr := oldFuncs["titles"](nil)
+	if runErr != nil {
+		t.Fatalf("running NamedQuery resulted in error: %v", runErr)
+	}
+
+	titles.Query = "select title from content order by id desc"
+	if saveErr := titles.Save(); saveErr != nil {
+		t.Fatalf("Updating NamedQuery resulted in error: %v", saveErr)
+	}
+	if saveErr := model.NewNamedQuery("counts", "select count(*) as total from content").Save(); saveErr != nil {
+		t.Fatalf("Saving NamedQuery resulted in error: %v", saveErr)
+	}
+	if reloaded, reloadErr := registry.ReloadIfChanged(); !reloaded || reloadErr != nil {
+		t.Fatalf("registry did not reload after a change (%v)", reloadErr)
+	}
+
+	// A second change in the same second must be noticed too.
+	titles.MaxRows = 10
+	if saveErr := titles.Save(); saveErr != nil {
+		t.Fatalf("Updating NamedQuery resulted in error: %v", saveErr)
+	}
+	if reloaded, reloadErr := registry.ReloadIfChanged(); !reloaded || reloadErr != nil {
+		t.Fatalf("registry did not reload after a second change (%v)", reloadErr)
+	}
+
+	// Rows from the old statement must still be readable after the swap.
+	oldRows, oldErr := inFlight.All()
+	if oldErr != nil || len(oldRows) != 2 || oldRows[0]["title"] != "First" {
+		t.Fatalf("in-flight results were disturbed by the reload: %v (%v)", oldRows, oldErr)
+	}
+
+	// A func taken before the reload runs the new statement.
+	results, _ := oldFuncs["titles"](nil)
+	newRows, _ := results.All()
+	if len(newRows) != 2 || newRows[0]["title"] != "Second" {
+		t.Fatalf("reloaded query was not used: %v", newRows)
+	}
+	if !registry.Exists("counts") {
+		t.Fatal("added query was not loaded")
+	}
+
+	counts, countsFunc := registry.Lookup("counts")
+	if counts == nil || counts.Name != "counts" || countsFunc == nil {
+		t.Fatal("Lookup did not give the loaded query")
+	}
+	if missing, missingFunc := registry.Lookup("missing"); missing != nil || missingFunc != nil {
+		t.Fatal("Lookup gave a query that is not loaded")
+	}
+	counts.Query = "select count(*) as total from content where id > 1"
+	if saveErr := counts.Save(); saveErr != nil {
+		t.Fatalf("Updating NamedQuery resulted in error: %v", saveErr)
+	}
+	registry.Reload()
+	if _, staleErr := countsFunc(nil); staleErr == nil {
+		t.Fatal("a func from Lookup should not run a query that has since changed")
+	}
+
+	if deleteErr := titles.Delete(); deleteErr != nil {
+		t.Fatalf("Deleting NamedQuery resulted in error: %v", deleteErr)
+	}
+	if reloadErr := registry.Reload(); reloadErr != nil {
+		t.Fatalf("Reload resulted in error: %v", reloadErr)
+	}
+	if _, goneErr := oldFuncs["titles"](nil); goneErr == nil {
+		t.Fatal("a removed query should not run")
+	}
+}
+
+func TestReadOnlyNamedQueries(t *testing.T) {
+	model := NewModel(dbSetup())
+
+	for _, query := range []string{
+		"delete from users",
+		"select 1; delete from users",
+		"with doomed as (select id from users) delete from users where id in doomed",
+		"pragma query_only = off",
+		"-- select\nupdate content set title = 'x'",
+	} {
+		if CheckReadOnly(query) == nil {
+			t.Errorf("%q should not pass as read-only", query)
+		}
+		if saveErr := model.NewNamedQuery("writer", query).Save(); saveErr == nil {
+			t.Errorf("%q should not save", query)
+		}
+	}
+	for _, query := range []string{
+		"select replace(title, 'a', 'b') from content -- delete",
+		"select 'delete from users; drop table content' as text;",
+		`with recent as (select * from content order by added desc) select "update" from recent`,
+	} {
+		if readOnlyErr := CheckReadOnly(query); readOnlyErr != nil {
+			t.Errorf("%q should pass as read-only: %v", query, readOnlyErr)
+		}
+	}
+
+	// A query that was put into the table without being checked must still not write.
+	user := model.NewUser("reader@example.com", "Reader")
+	if saveErr := user.Save(); saveErr != nil {
+		t.Fatalf("Saving User resulted in database error: %v", saveErr)
+	}
+	sneaky := model.NewNamedQuery("sneaky", "delete from users")
+	if _, runErr := model.MakeNamedQuerier(sneaky)(nil); runErr == nil {
+		t.Fatal("a query that writes should not run")
+	}
+	model.db.DB.Exec(`insert into queries (name, query) values ('sneaky', 'delete from users')`)
+	registry, loadErr := model.NewNamedQueryRegistry()
+	if loadErr == nil || registry.Exists("sneaky") {
+		t.Fatal("a query that writes should not be loaded")
+	}
+	defer registry.Close()
+
+	// Even if the check is got around, the connection will not write.
+	stmt, _ := model.db.DB.Prepare("delete from users")
+	if results, runErr := model.runReadOnly(sneaky, stmt, nil); runErr == nil {
+		if _, rowsErr := results.All(); rowsErr == nil {
+			t.Fatal("a query run read-only should not be able to delete")
+		}
+	}
+	if _, getErr := model.GetUser(user.ID); getErr != nil {
+		t.Fatal("a read-only query deleted a User")
+	}
+	if saveErr := model.NewContent("Still writable", "", "", "", "").Save(); saveErr != nil {
+		t.Fatalf("connections were left read-only: %v", saveErr)
+	}
+
+	limited := model.NewNamedQuery("limited", "with recursive n(i) as (select 1 union all select i + 1 from n) select i from n")
+	limited.MaxRows = 10
+	results, _ := model.MakeNamedQuerier(limited)(nil)
+	if rows, rowsErr := results.All(); rowsErr == nil || len(rows) != 10 {
+		t.Fatalf("row limit was not enforced: %d rows (%v)", len(rows), rowsErr)
+	}
+
+	limited.MaxRows = 1 << 30
+	limited.Timeout = 50 * time.Millisecond
+	results, _ = model.MakeNamedQuerier(limited)(nil)
+	start := time.Now()
+	for results.Next() {
+		if time.Since(start) > 5*time.Second {
+			break
+		}
+	}
+	if results.Err() == nil || !strings.Contains(results.Err().Error(), "longer than") {
+		t.Fatalf("timeout was not enforced: %v", results.Err())
+	}
+}
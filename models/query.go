@@ -1,116 +1,341 @@
 package model
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"sync"
 	"time"
 )
 
-type namedQuery struct {
+// namedQueryColumns lists the columns that readNamedQueryFromRow expects, in order.
+const namedQueryColumns = `id, name, query, added, modified, timeout, max_rows, public, params`
+
+// NamedQuery is a query that is stored in the database, so that templates can ask for
+// its results by name. Named queries may only read from the database.
+type NamedQuery struct {
+	model    *GrogModel
 	ID       int64
 	Name     string
 	Query    string
 	Added    NullTime
 	Modified NullTime
+	Timeout  time.Duration // How long the query may run, or 0 for DefaultQueryTimeout
+	MaxRows  int           // Most rows the query may return, or 0 for DefaultQueryRowLimit
+	Public   bool          // Whether anyone may run the query through /q/{name}
+	Params   string        // The parameters that /q/{name} passes, written as for .model
+}
+
+// NewNamedQuery creates a new NamedQuery, which is not stored until it is saved.
+func (model *GrogModel) NewNamedQuery(name string, query string) *NamedQuery {
+	newQuery := new(NamedQuery)
+	newQuery.ID = -1 // Not set value
+	newQuery.Name = name
+	newQuery.Query = query
+	newQuery.model = model
+
+	return newQuery
 }
 
-func (model *GrogModel) getNamedQueries() ([]*namedQuery, error) {
-	var foundQueries []*namedQuery
+// GetNamedQuery retrieves the NamedQuery with the given name.
+func (model *GrogModel) GetNamedQuery(name string) (*NamedQuery, error) {
+	var foundQuery *NamedQuery
 	var err error
 
-	rows, rowsErr := model.db.DB.Query("select id, name, query, added, modified from queries")
+	rows, queryErr := model.db.DB.Query(`select `+namedQueryColumns+` from queries where name = ?`, name)
 
-	if rowsErr == nil {
+	if queryErr == nil {
 		defer rows.Close()
 
+		foundQuery = model.readNamedQueryFromRow(rows)
+
+		if foundQuery == nil {
+			err = fmt.Errorf("no NamedQuery named %s", name)
+		}
+	} else {
+		err = fmt.Errorf("database error while reading NamedQuery: %v", queryErr)
+	}
+
+	return foundQuery, err
+}
+
+// AllNamedQueries loads every NamedQuery, in order of name.
+func (model *GrogModel) AllNamedQueries() ([]*NamedQuery, error) {
+	var foundQueries []*NamedQuery
+
+	rows, rowsErr := model.db.DB.Query(`select ` + namedQueryColumns + ` from queries order by name`)
+	if rowsErr != nil {
+		return nil, fmt.Errorf("database error while reading NamedQueries: %v", rowsErr)
+	}
+
+	defer rows.Close()
+
+	for foundQuery := model.readNamedQueryFromRow(rows); foundQuery != nil; foundQuery = model.readNamedQueryFromRow(rows) {
+		foundQueries = append(foundQueries, foundQuery)
+	}
+
+	return foundQueries, nil
+}
+
+func (model *GrogModel) readNamedQueryFromRow(rows *sql.Rows) *NamedQuery {
+	var foundQuery *NamedQuery
+
+	if rows.Next() {
 		var (
-			id     int64
-			qname  string
-			query  string
-			added  int64
-			edited int64
+			id       int64
+			qname    string
+			query    string
+			added    sql.NullInt64 // Queries added with raw SQL may not have these set
+			modified sql.NullInt64
+			timeout  int64
+			maxRows  int
+			public   bool
+			params   string
 		)
 
-		foundQueries = make([]*namedQuery, 0, 10) // 10 is arbitrary
+		if rows.Scan(&id, &qname, &query, &added, &modified, &timeout, &maxRows, &public, &params) != sql.ErrNoRows {
+			foundQuery = model.NewNamedQuery(qname, query)
+			foundQuery.ID = id
+			foundQuery.Timeout = time.Duration(timeout) * time.Millisecond
+			foundQuery.MaxRows = maxRows
+			foundQuery.Public = public
+			foundQuery.Params = params
+			if added.Valid {
+				foundQuery.Added.Set(time.Unix(added.Int64, 0))
+			}
+			if modified.Valid {
+				foundQuery.Modified.Set(time.Unix(modified.Int64, 0))
+			}
+		}
+	}
 
-		for rows.Next() {
-			if rows.Scan(&id, &qname, &query, &added, &edited) != sql.ErrNoRows {
-				foundQuery := new(namedQuery)
-				foundQuery.ID = id
-				foundQuery.Name = qname
-				foundQuery.Query = query
-				foundQuery.Added.Set(time.Unix(added, 0))
-				foundQuery.Modified.Set(time.Unix(edited, 0))
+	return foundQuery
+}
 
-				foundQueries = append(foundQueries, foundQuery)
-			}
+// Validate checks that the NamedQuery has a name, that its query only reads from the
+// database and that the database can prepare it, so that a query with a mistake in it
+// is found before it is saved rather than when a template runs it.
+func (query *NamedQuery) Validate() error {
+	if len(query.Name) == 0 {
+		return fmt.Errorf("NamedQuery must have a name")
+	}
+	if query.Timeout < 0 || query.MaxRows < 0 {
+		return fmt.Errorf("namedquery[%s] cannot have a negative timeout or row limit", query.Name)
+	}
+	if readOnlyErr := CheckReadOnly(query.Query); readOnlyErr != nil {
+		return fmt.Errorf("namedquery[%s] is not valid: %v", query.Name, readOnlyErr)
+	}
+
+	stmt, prepErr := query.model.db.DB.Prepare(query.Query)
+	if prepErr != nil {
+		return fmt.Errorf("namedquery[%s] is not valid: %v", query.Name, prepErr)
+	}
+
+	return stmt.Close()
+}
+
+// Save validates the NamedQuery and writes it to the database. Names must be unique.
+func (query *NamedQuery) Save() error {
+	if validErr := query.Validate(); validErr != nil {
+		return validErr
+	}
+
+	var otherID int64
+	existsErr := query.model.db.DB.QueryRow(`select id from queries where name = ? and id != ?`,
+		query.Name, query.ID).Scan(&otherID)
+	if existsErr == nil {
+		return fmt.Errorf("a NamedQuery named %s already exists", query.Name)
+	} else if existsErr != sql.ErrNoRows {
+		return fmt.Errorf("error checking name of NamedQuery %s: %v", query.Name, existsErr)
+	}
+
+	if query.ID == -1 {
+		insertResult, err := query.model.db.DB.Exec(`insert into queries (name, query, added, modified,
+			timeout, max_rows, public, params) values (?, ?, strftime('%s','now'), strftime('%s','now'), ?, ?, ?, ?)`,
+			query.Name, query.Query, query.Timeout.Milliseconds(), query.MaxRows, query.Public, query.Params)
+		if err != nil {
+			return fmt.Errorf("error saving new NamedQuery: %v", err)
 		}
 
-	} else {
-		err = rowsErr
+		query.ID, err = insertResult.LastInsertId()
+		if err == nil {
+			now := time.Now()
+			query.Added.Set(now)
+			query.Modified.Set(now)
+		}
+
+		return err
 	}
 
-	return foundQueries, err
+	_, err := query.model.db.DB.Exec(`update queries set name = ?, query = ?, modified = strftime('%s','now'),
+		timeout = ?, max_rows = ?, public = ?, params = ? where id = ?`, query.Name, query.Query,
+		query.Timeout.Milliseconds(), query.MaxRows, query.Public, query.Params, query.ID)
+	if err != nil {
+		return fmt.Errorf("error updating NamedQuery %s: %v", query.Name, err)
+	}
+	query.Modified.Set(time.Now())
+
+	return nil
+}
+
+// Delete removes the NamedQuery from the database.
+func (query *NamedQuery) Delete() error {
+	_, err := query.model.db.DB.Exec(`delete from queries where id = ?`, query.ID)
+	if err != nil {
+		return fmt.Errorf("error deleting NamedQuery %s: %v", query.Name, err)
+	}
+
+	return nil
 }
 
 // NamedQueryFunc is the signature of a function that can be called to execute a query
 // that is stored in the database.
-type NamedQueryFunc func([]interface{}) ([]map[string]string, error)
+type NamedQueryFunc func([]interface{}) (*QueryRows, error)
 
 // NamedQueries stores NamedQueryFuncs according to the name of the namedquery.
 type NamedQueries map[string]NamedQueryFunc
 
-// MakeNamedQuerier returns a function that can be called to execute a named query from the
-// database.
-func (model *GrogModel) MakeNamedQuerier(query *namedQuery) NamedQueryFunc {
-	db := model.db.DB
-
-	return func(params []interface{}) ([]map[string]string, error) {
-		var queryResults []map[string]string
-		var err error
+// QueryRows gives the results of a named query a row at a time, so that a large set
+// of results need not be held in memory all at once. Each row maps the names of the
+// columns to their values, with the type that the database gave them: int64, float64,
+// string, []byte, time.Time, or nil for NULL.
+type QueryRows struct {
+	name      string
+	rows      *sql.Rows
+	columns   []string
+	row       map[string]interface{}
+	err       error
+	done      chan struct{}
+	closeOnce sync.Once
+	ctx       context.Context // Set, with timeout, maxRows and release, by runReadOnly
+	timeout   time.Duration
+	maxRows   int
+	count     int
+	release   func()
+}
 
-		nqResults, nqErr := db.Query(query.Query, params...)
+// NewQueryRows gives the rows of a query that has been run, under the name of the
+// named query that it was run for.
+func NewQueryRows(name string, rows *sql.Rows) (*QueryRows, error) {
+	columnNames, columnNamesErr := rows.Columns()
+	if columnNamesErr != nil {
+		rows.Close()
+		return nil, fmt.Errorf("namedquery[%s]: error getting names of columns from database: %v", name, columnNamesErr)
+	}
 
-		if nqErr == nil {
-			defer nqResults.Close()
+	return &QueryRows{name: name, rows: rows, columns: columnNames, done: make(chan struct{})}, nil
+}
 
-			queryResults = make([]map[string]string, 0, 10) // Cap of 10 is arbitrary.
-			columnNames, columnNamesErr := nqResults.Columns()
+// Columns gives the names of the columns of the results.
+func (results *QueryRows) Columns() []string {
+	return results.columns
+}
 
-			if columnNamesErr != nil {
-				panic(fmt.Sprintf("namedquery[%s]: error getting names of columns from database: %v", query.Name, columnNamesErr))
+// Next reads the next row, and reports whether there was one. The rows are closed
+// once the last has been read, or if there is an error reading them.
+func (results *QueryRows) Next() bool {
+	if results.err != nil || !results.rows.Next() {
+		if results.err == nil {
+			if rowsErr := results.rows.Err(); rowsErr != nil {
+				results.err = fmt.Errorf("namedquery[%s]: %v", results.name, describeQueryErr(results.ctx, results.timeout, rowsErr))
 			}
+		}
+		results.Close()
+		return false
+	}
 
-			nqRowResults := make([]interface{}, len(columnNames))
-			for i := range nqRowResults {
-				nqRowResults[i] = new(string)
-			}
+	results.count++
+	if results.maxRows > 0 && results.count > results.maxRows {
+		results.err = fmt.Errorf("namedquery[%s] returned more than its limit of %d rows", results.name, results.maxRows)
+		results.Close()
+		return false
+	}
+
+	values := make([]interface{}, len(results.columns))
+	valuePtrs := make([]interface{}, len(values))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+
+	if scanErr := results.rows.Scan(valuePtrs...); scanErr != nil {
+		results.err = fmt.Errorf("namedquery[%s]: error scanning results: %v", results.name, scanErr)
+		results.Close()
+		return false
+	}
+
+	results.row = make(map[string]interface{}, len(values))
+	for i, colName := range results.columns {
+		results.row[colName] = values[i]
+	}
+
+	return true
+}
+
+// Row gives the row read by the last call to Next.
+func (results *QueryRows) Row() map[string]interface{} {
+	return results.row
+}
+
+// Err gives the error, if any, that stopped the rows from being read.
+func (results *QueryRows) Err() error {
+	return results.err
+}
+
+// Close releases the rows. It need only be called if the rows are not read to the end.
+func (results *QueryRows) Close() error {
+	var err error
+	results.closeOnce.Do(func() {
+		close(results.done)
+		err = results.rows.Close()
+		if results.release != nil {
+			results.release()
+		}
+	})
 
-			for nqResults.Next() {
-				nqResErr := nqResults.Scan(nqRowResults...)
+	return err
+}
+
+// All reads every row that is left.
+func (results *QueryRows) All() ([]map[string]interface{}, error) {
+	allRows := make([]map[string]interface{}, 0, 10) // Cap of 10 is arbitrary.
+	for results.Next() {
+		allRows = append(allRows, results.row)
+	}
 
-				if nqResErr != nil {
-					panic(fmt.Sprintf("namedquery[%s]: error scanning results: %v", query.Name, nqResErr))
-				}
+	return allRows, results.err
+}
 
-				nqRowResultsMapped := make(map[string]string)
-				for i, colName := range columnNames {
-					nqRowResultsMapped[colName] = *nqRowResults[i].(*string)
-				}
+// Iter sends each row that is left on a channel, which is closed after the last row,
+// on an error, or when the rows are closed. This lets a template repeat the rows
+// without reading them all first.
+func (results *QueryRows) Iter() <-chan map[string]interface{} {
+	rowChan := make(chan map[string]interface{})
 
-				queryResults = append(queryResults, nqRowResultsMapped)
+	go func() {
+		defer close(rowChan)
+		for results.Next() {
+			select {
+			case rowChan <- results.row:
+			case <-results.done:
+				return
 			}
-		} else {
-			err = fmt.Errorf("database error while executing namedquery %s: %v", query.Name, nqErr)
 		}
+	}()
+
+	return rowChan
+}
 
-		return queryResults, err
+// MakeNamedQuerier returns a function that can be called to execute a named query from the
+// database.
+func (model *GrogModel) MakeNamedQuerier(query *NamedQuery) NamedQueryFunc {
+	return func(params []interface{}) (*QueryRows, error) {
+		return model.runReadOnly(query, nil, params)
 	}
 }
 
 // LoadNamedQueries retries all namedquery rows and creates an invoker func for each.
 func (model *GrogModel) LoadNamedQueries() map[string]NamedQueryFunc {
-	allQueries, allQueriesErr := model.getNamedQueries()
+	allQueries, allQueriesErr := model.AllNamedQueries()
 
 	if allQueriesErr != nil {
 		panic(fmt.Sprintf("error loading namedqueries: %v", allQueriesErr))
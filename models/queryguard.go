@@ -0,0 +1,219 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultQueryTimeout is how long a named query may run, including the time taken to
+// read its results, when the NamedQuery does not set its own Timeout.
+var DefaultQueryTimeout = 5 * time.Second
+
+// DefaultQueryRowLimit is the most rows that a named query may return when the
+// NamedQuery does not set its own MaxRows.
+var DefaultQueryRowLimit = 1000
+
+// CheckReadOnly reports an error if the text of a query is not a single select
+// statement. Named queries are run with parameters that come from requests, so they
+// must not be able to change the database. This check finds mistakes when a query is
+// saved; queries are also run in a way that stops them from writing, in case something
+// gets past it.
+func CheckReadOnly(query string) error {
+	statements := splitStatements(query)
+
+	switch {
+	case len(statements) == 0:
+		return fmt.Errorf("query is empty")
+	case len(statements) > 1:
+		return fmt.Errorf("query must be a single statement, but has %d", len(statements))
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(statements[0]), func(r rune) bool {
+		return !(r == '_' || r == '$' || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'))
+	})
+	if len(words) == 0 {
+		return fmt.Errorf("query must be read-only, so must be a select")
+	}
+	switch words[0] {
+	case "select", "with", "values":
+	default:
+		return fmt.Errorf("query must be read-only, so cannot begin with %s", words[0])
+	}
+
+	// A with clause can lead to a statement that writes, as in
+	// "with old as (...) delete from ...". These words are reserved in SQLite, so they
+	// cannot be the names of tables or columns unless they are quoted.
+	for i, word := range words {
+		switch word {
+		case "insert", "update", "delete", "drop", "alter", "create":
+			return fmt.Errorf("query must be read-only, so cannot use %s", word)
+		case "replace":
+			if i+1 < len(words) && words[i+1] == "into" {
+				return fmt.Errorf("query must be read-only, so cannot use replace")
+			}
+		}
+	}
+
+	return nil
+}
+
+// splitStatements divides the text of a query into its statements, with comments
+// removed and the contents of quoted strings and names blanked, so that only the
+// words of the SQL itself are left.
+func splitStatements(query string) []string {
+	var statements []string
+	var current strings.Builder
+
+	endStatement := func() {
+		if statement := strings.TrimSpace(current.String()); len(statement) > 0 {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+			current.WriteByte(' ')
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			current.WriteByte(' ')
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			// A doubled quote stands for itself, which this handles as two strings
+			// next to each other.
+			end := strings.IndexByte(query[i+1:], closing)
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 1
+			}
+			current.WriteString(" ? ")
+		case c == ';':
+			endStatement()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	endStatement()
+
+	return statements
+}
+
+// limits gives the timeout and row limit that apply to the NamedQuery.
+func (query *NamedQuery) limits() (time.Duration, int) {
+	timeout := query.Timeout
+	if timeout <= 0 {
+		timeout = DefaultQueryTimeout
+	}
+	maxRows := query.MaxRows
+	if maxRows <= 0 {
+		maxRows = DefaultQueryRowLimit
+	}
+
+	return timeout, maxRows
+}
+
+// runReadOnly runs a NamedQuery on a connection that SQLite has been told to keep
+// read-only, inside a transaction that is always rolled back, with its timeout and row
+// limit applied. If stmt is not nil, it is used rather than preparing the query again;
+// it must have been prepared from a query that passed CheckReadOnly. The connection is
+// held until the rows are closed.
+func (model *GrogModel) runReadOnly(query *NamedQuery, stmt *sql.Stmt, params []interface{}) (*QueryRows, error) {
+	if stmt == nil {
+		if readOnlyErr := CheckReadOnly(query.Query); readOnlyErr != nil {
+			return nil, fmt.Errorf("namedquery[%s] will not be run: %v", query.Name, readOnlyErr)
+		}
+	}
+
+	timeout, maxRows := query.limits()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+	conn, connErr := model.db.DB.Conn(ctx)
+	if connErr != nil {
+		cancel()
+		return nil, fmt.Errorf("namedquery[%s]: error getting database connection: %v", query.Name, connErr)
+	}
+
+	var tx *sql.Tx
+	release := func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+		// The connection goes back to the pool for other work, so it must be writable
+		// again; if that cannot be done, it is thrown away instead.
+		if _, resetErr := conn.ExecContext(context.Background(), "PRAGMA query_only = OFF"); resetErr != nil {
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+		cancel()
+	}
+
+	if _, pragmaErr := conn.ExecContext(ctx, "PRAGMA query_only = ON"); pragmaErr != nil {
+		release()
+		return nil, fmt.Errorf("namedquery[%s]: error making connection read-only: %v", query.Name, pragmaErr)
+	}
+
+	var txErr error
+	tx, txErr = conn.BeginTx(ctx, nil)
+	if txErr != nil {
+		release()
+		return nil, fmt.Errorf("namedquery[%s]: error beginning transaction: %v", query.Name, txErr)
+	}
+
+	var nqResults *sql.Rows
+	var nqErr error
+	if stmt != nil {
+		nqResults, nqErr = tx.StmtContext(ctx, stmt).QueryContext(ctx, params...)
+	} else {
+		nqResults, nqErr = tx.QueryContext(ctx, query.Query, params...)
+	}
+	if nqErr != nil {
+		release()
+		return nil, fmt.Errorf("database error while executing namedquery %s: %v", query.Name, describeQueryErr(ctx, timeout, nqErr))
+	}
+
+	results, resultsErr := NewQueryRows(query.Name, nqResults)
+	if resultsErr != nil {
+		release()
+		return nil, resultsErr
+	}
+	results.ctx = ctx
+	results.timeout = timeout
+	results.maxRows = maxRows
+	results.release = release
+
+	return results, nil
+}
+
+// describeQueryErr gives a clearer error for the ways that the limits on named queries
+// make them fail.
+func describeQueryErr(ctx context.Context, timeout time.Duration, err error) error {
+	if ctx != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("query took longer than its limit of %v", timeout)
+	}
+	if strings.Contains(err.Error(), "readonly database") {
+		return fmt.Errorf("query tried to change the database, but named queries are read-only")
+	}
+
+	return err
+}
@@ -0,0 +1,254 @@
+package model
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// NamedQueryRegistry holds every NamedQuery as a prepared statement, and can be
+// reloaded while the server is running. A reload prepares the new set of statements
+// first and then swaps it in all at once, so a query is always run with either the old
+// statement or the new one, never a mix. Statements are only prepared again when the
+// text of their query changes.
+type NamedQueryRegistry struct {
+	model      *GrogModel
+	lock       sync.RWMutex // guards the fields below
+	prepared   map[string]*preparedQuery
+	queryFuncs NamedQueries
+	signature  string
+	reloadLock sync.Mutex // stops two reloads from running at once
+}
+
+type preparedQuery struct {
+	query *NamedQuery
+	stmt  *sql.Stmt
+}
+
+// NewNamedQueryRegistry creates a registry and loads every NamedQuery into it. An
+// error is returned for any query that could not be loaded, but the registry holds
+// all of the others.
+func (model *GrogModel) NewNamedQueryRegistry() (*NamedQueryRegistry, error) {
+	registry := &NamedQueryRegistry{
+		model:      model,
+		prepared:   make(map[string]*preparedQuery),
+		queryFuncs: make(NamedQueries),
+	}
+
+	return registry, registry.Reload()
+}
+
+// querySignature gives a checksum of the queries table that changes whenever a query
+// is added, changed or removed, so that a reload can be skipped when nothing has. It
+// covers everything that is loaded rather than the modified times, which only change
+// once a second and are not set by changes made with plain SQL.
+func (model *GrogModel) querySignature() (string, error) {
+	rows, rowsErr := model.db.DB.Query(`select id, name, query, timeout, max_rows, public, params
+		from queries order by id`)
+	if rowsErr != nil {
+		return "", fmt.Errorf("error checking namedqueries for changes: %v", rowsErr)
+	}
+	defer rows.Close()
+
+	var (
+		id, timeout, maxRows int64
+		name, query, params  string
+		public               bool
+	)
+
+	checksum := sha256.New()
+	for rows.Next() {
+		if scanErr := rows.Scan(&id, &name, &query, &timeout, &maxRows, &public, &params); scanErr != nil {
+			return "", fmt.Errorf("error checking namedqueries for changes: %v", scanErr)
+		}
+		fmt.Fprintf(checksum, "%d\x00%s\x00%s\x00%d\x00%d\x00%t\x00%s\x00", id, name, query, timeout,
+			maxRows, public, params)
+	}
+	if rowsErr = rows.Err(); rowsErr != nil {
+		return "", fmt.Errorf("error checking namedqueries for changes: %v", rowsErr)
+	}
+
+	return hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// Reload reads every NamedQuery from the database again and swaps them in. Queries
+// that are not read-only or cannot be prepared are left out, and their errors are
+// returned together.
+func (registry *NamedQueryRegistry) Reload() error {
+	registry.reloadLock.Lock()
+	defer registry.reloadLock.Unlock()
+
+	return registry.reload()
+}
+
+// ReloadIfChanged reloads the registry only if a NamedQuery has been added, changed
+// or removed since it was last loaded, and reports whether it did.
+func (registry *NamedQueryRegistry) ReloadIfChanged() (bool, error) {
+	registry.reloadLock.Lock()
+	defer registry.reloadLock.Unlock()
+
+	signature, sigErr := registry.model.querySignature()
+	if sigErr != nil {
+		return false, sigErr
+	}
+
+	registry.lock.RLock()
+	unchanged := signature == registry.signature
+	registry.lock.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	return true, registry.reload()
+}
+
+func (registry *NamedQueryRegistry) reload() error {
+	// Read the signature first, so that a change made while loading is picked up by
+	// the next check rather than being missed.
+	signature, sigErr := registry.model.querySignature()
+	if sigErr != nil {
+		return sigErr
+	}
+
+	allQueries, allQueriesErr := registry.model.AllNamedQueries()
+	if allQueriesErr != nil {
+		return allQueriesErr
+	}
+
+	registry.lock.RLock()
+	current := registry.prepared
+	registry.lock.RUnlock()
+
+	prepared := make(map[string]*preparedQuery, len(allQueries))
+	queryFuncs := make(NamedQueries, len(allQueries))
+	reused := make(map[*sql.Stmt]bool)
+	var prepErrs []string
+
+	for _, query := range allQueries {
+		if readOnlyErr := CheckReadOnly(query.Query); readOnlyErr != nil {
+			prepErrs = append(prepErrs, fmt.Sprintf("namedquery[%s]: %v", query.Name, readOnlyErr))
+			continue
+		}
+
+		if old, found := current[query.Name]; found && old.query.Query == query.Query {
+			prepared[query.Name] = &preparedQuery{query, old.stmt}
+			reused[old.stmt] = true
+		} else {
+			stmt, prepErr := registry.model.db.DB.Prepare(query.Query)
+			if prepErr != nil {
+				prepErrs = append(prepErrs, fmt.Sprintf("namedquery[%s]: %v", query.Name, prepErr))
+				continue
+			}
+			prepared[query.Name] = &preparedQuery{query, stmt}
+		}
+
+		queryFuncs[query.Name] = registry.querier(query.Name)
+	}
+
+	registry.lock.Lock()
+	registry.prepared = prepared
+	registry.queryFuncs = queryFuncs
+	registry.signature = signature
+	registry.lock.Unlock()
+
+	// Nothing can start to use the old statements now. Rows that are still being read
+	// from them stay open, because database/sql only finishes closing a statement once
+	// its rows are closed.
+	for _, old := range current {
+		if !reused[old.stmt] {
+			old.stmt.Close()
+		}
+	}
+
+	if len(prepErrs) > 0 {
+		return fmt.Errorf("error preparing namedqueries: %s", strings.Join(prepErrs, "; "))
+	}
+
+	return nil
+}
+
+// querier gives a NamedQueryFunc that runs whichever statement the registry holds for
+// the name when it is called, so that a render that began before a reload still runs
+// statements that are open.
+func (registry *NamedQueryRegistry) querier(name string) NamedQueryFunc {
+	return func(params []interface{}) (*QueryRows, error) {
+		registry.lock.RLock()
+		pq, found := registry.prepared[name]
+		if !found {
+			registry.lock.RUnlock()
+			return nil, fmt.Errorf("namedquery %s no longer exists", name)
+		}
+		defer registry.lock.RUnlock()
+
+		return registry.model.runReadOnly(pq.query, pq.stmt, params)
+	}
+}
+
+// Queries gives the NamedQueryFuncs of every NamedQuery that is loaded. The map must
+// not be changed; a reload replaces it rather than changing it.
+func (registry *NamedQueryRegistry) Queries() NamedQueries {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	return registry.queryFuncs
+}
+
+// Exists reports whether a NamedQuery with the given name is loaded.
+func (registry *NamedQueryRegistry) Exists(name string) bool {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	_, found := registry.prepared[name]
+
+	return found
+}
+
+// Lookup gives the NamedQuery with the given name as it was when it was loaded, along
+// with a NamedQueryFunc that runs that same query, or nil and nil if no such query is
+// loaded. Both come from one snapshot of the registry, so they agree even if it is
+// reloaded in between; if the query's statement has been replaced by the time the
+// function is called, it returns an error rather than running the new one.
+func (registry *NamedQueryRegistry) Lookup(name string) (*NamedQuery, NamedQueryFunc) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	pq, found := registry.prepared[name]
+	if !found {
+		return nil, nil
+	}
+
+	// The registry's own NamedQuery must not be changed, so a copy is given.
+	snapshot := *pq.query
+
+	return &snapshot, func(params []interface{}) (*QueryRows, error) {
+		registry.lock.RLock()
+		defer registry.lock.RUnlock()
+
+		if current, found := registry.prepared[name]; !found || current.stmt != pq.stmt {
+			return nil, fmt.Errorf("namedquery %s changed before it could be run", name)
+		}
+
+		return registry.model.runReadOnly(pq.query, pq.stmt, params)
+	}
+}
+
+// Close closes every prepared statement. The registry cannot be used afterward.
+func (registry *NamedQueryRegistry) Close() error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	var err error
+	for _, pq := range registry.prepared {
+		if closeErr := pq.stmt.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	registry.prepared = make(map[string]*preparedQuery)
+	registry.queryFuncs = make(NamedQueries)
+
+	return err
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"database/sql"
+	"html"
+	"strings"
+
+	"github.com/adamcrossland/grog/markdown"
+)
+
+// RenderBody converts a body written in the given format into HTML. HTML bodies are
+// returned as they are.
+func RenderBody(format string, body string) string {
+	switch format {
+	case BodyMarkdown:
+		return markdown.Render(body)
+	case BodyPlain:
+		return renderPlain(body)
+	}
+
+	return body
+}
+
+// renderPlain escapes plain text and breaks it into paragraphs at blank lines.
+func renderPlain(body string) string {
+	var rendered strings.Builder
+
+	body = strings.Replace(body, "\r\n", "\n", -1)
+	for _, paragraph := range strings.Split(body, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if len(paragraph) == 0 {
+			continue
+		}
+
+		rendered.WriteString("<p>")
+		rendered.WriteString(strings.Replace(html.EscapeString(paragraph), "\n", "<br />\n", -1))
+		rendered.WriteString("</p>\n")
+	}
+
+	return rendered.String()
+}
+
+// RenderedBody gives the Content's Body as HTML. The result is cached with the
+// Content's latest revision, so each revision is only rendered once.
+func (content *Content) RenderedBody() string {
+	if content.BodyFormat == BodyHTML || content.BodyFormat == "" {
+		return content.Body
+	}
+
+	var revision int64
+	var body, format string
+	var rendered sql.NullString
+
+	row := content.model.db.DB.QueryRow(`select revision, body, body_format, rendered from content_revisions
+		where content = ? order by revision desc limit 1`, content.ID)
+	if row.Scan(&revision, &body, &format, &rendered) != nil ||
+		body != content.Body || format != content.BodyFormat {
+		// The Content has changed since it was last saved, so there is nothing to cache.
+		return RenderBody(content.BodyFormat, content.Body)
+	}
+
+	if rendered.Valid {
+		return rendered.String
+	}
+
+	// If the rendered body cannot be cached, it is simply rendered again next time.
+	renderedBody := RenderBody(content.BodyFormat, content.Body)
+	content.model.db.DB.Exec(`update content_revisions set rendered = ? where content = ? and revision = ?`,
+		renderedBody, content.ID, revision)
+
+	return renderedBody
+}
@@ -0,0 +1,225 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ContentRevision is a copy of a Content's title, summary and body as they were
+// after one particular call to Content.Save.
+type ContentRevision struct {
+	model      *GrogModel
+	ID         int64
+	Content    int64
+	Revision   int64
+	Title      string
+	Summary    string
+	Body       string
+	BodyFormat string
+	Author     int64
+	Added      NullTime
+}
+
+// saveRevision records the current state of the Content as its next revision.
+func (content *Content) saveRevision(db execer) error {
+	author := content.Editor
+	if author == 0 {
+		author = content.Author
+	}
+
+	_, err := db.Exec(`insert into content_revisions (content, revision, title, summary,
+		body, body_format, author, added) select ?, coalesce(max(revision), 0) + 1, ?, ?, ?, ?, ?,
+		strftime('%s','now') from content_revisions where content = ?`,
+		content.ID, content.Title, content.Summary, content.Body, content.BodyFormat, author, content.ID)
+	if err != nil {
+		return fmt.Errorf("error saving revision of Content %d: %v", content.ID, err)
+	}
+
+	return nil
+}
+
+// ContentRevisions loads every revision of the Content with the given id, oldest first.
+func (model *GrogModel) ContentRevisions(contentID int64) ([]*ContentRevision, error) {
+	var foundRevisions []*ContentRevision
+
+	rows, rowsErr := model.db.DB.Query(`select id, revision, title, summary, body, body_format, author, added
+		from content_revisions where content = ? order by revision`, contentID)
+	if rowsErr != nil {
+		return nil, fmt.Errorf("error loading revisions of Content %d: %v", contentID, rowsErr)
+	}
+
+	defer rows.Close()
+
+	for {
+		foundRevision := model.readRevisionFromRow(rows, contentID)
+		if foundRevision == nil {
+			break
+		}
+
+		foundRevisions = append(foundRevisions, foundRevision)
+	}
+
+	return foundRevisions, nil
+}
+
+// GetContentRevision retrieves one revision of the Content with the given id.
+func (model *GrogModel) GetContentRevision(contentID int64, revision int64) (*ContentRevision, error) {
+	var foundRevision *ContentRevision
+	var err error
+
+	rows, queryErr := model.db.DB.Query(`select id, revision, title, summary, body, body_format, author, added
+		from content_revisions where content = ? and revision = ?`, contentID, revision)
+
+	if queryErr == nil {
+		defer rows.Close()
+
+		foundRevision = model.readRevisionFromRow(rows, contentID)
+
+		if foundRevision == nil {
+			err = fmt.Errorf("no revision %d of Content %d", revision, contentID)
+		}
+	} else {
+		err = fmt.Errorf("database error while reading revision: %v", queryErr)
+	}
+
+	return foundRevision, err
+}
+
+func (model *GrogModel) readRevisionFromRow(rows *sql.Rows, contentID int64) *ContentRevision {
+	var foundRevision *ContentRevision
+
+	if rows.Next() {
+		var (
+			id       int64
+			revision int64
+			title    string
+			summary  string
+			body     string
+			format   string
+			author   int64
+			added    int64
+		)
+
+		if rows.Scan(&id, &revision, &title, &summary, &body, &format, &author, &added) != sql.ErrNoRows {
+			foundRevision = new(ContentRevision)
+			foundRevision.model = model
+			foundRevision.ID = id
+			foundRevision.Content = contentID
+			foundRevision.Revision = revision
+			foundRevision.Title = title
+			foundRevision.Summary = summary
+			foundRevision.Body = body
+			foundRevision.BodyFormat = format
+			foundRevision.Author = author
+			foundRevision.Added.Set(time.Unix(added, 0))
+		}
+	}
+
+	return foundRevision
+}
+
+// Diff describes the changes between this revision and a later one, line by line.
+// Only the fields that differ are included.
+func (rev *ContentRevision) Diff(to *ContentRevision) string {
+	var diffText strings.Builder
+
+	fmt.Fprintf(&diffText, "--- revision %d\n+++ revision %d\n", rev.Revision, to.Revision)
+
+	fields := []struct {
+		name     string
+		from, to string
+	}{
+		{"title", rev.Title, to.Title},
+		{"summary", rev.Summary, to.Summary},
+		{"body", rev.Body, to.Body},
+		{"format", rev.BodyFormat, to.BodyFormat},
+	}
+
+	for _, field := range fields {
+		if field.from == field.to {
+			continue
+		}
+
+		fmt.Fprintf(&diffText, "@@ %s @@\n", field.name)
+		for _, line := range diffLines(splitLines(field.from), splitLines(field.to)) {
+			diffText.WriteString(line)
+			diffText.WriteString("\n")
+		}
+	}
+
+	return diffText.String()
+}
+
+// Restore makes the given revision the current state of the Content. The restore
+// itself is saved as a new revision, so no history is lost.
+func (content *Content) Restore(revision int64) error {
+	rev, revErr := content.model.GetContentRevision(content.ID, revision)
+	if revErr != nil {
+		return revErr
+	}
+
+	content.Title = rev.Title
+	content.Summary = rev.Summary
+	content.Body = rev.Body
+	content.BodyFormat = rev.BodyFormat
+
+	return content.Save()
+}
+
+func splitLines(text string) []string {
+	if len(text) == 0 {
+		return nil
+	}
+
+	return strings.Split(text, "\n")
+}
+
+// diffLines compares two sets of lines and returns them marked up in the style of a
+// unified diff: unchanged lines start with a space, removed lines with '-' and added
+// lines with '+'.
+func diffLines(from []string, to []string) []string {
+	// lcs[i][j] holds the length of the longest common subsequence of from[i:] and to[j:].
+	lcs := make([][]int, len(from)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(to)+1)
+	}
+
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if from[i] == to[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	marked := make([]string, 0, len(from)+len(to))
+	i, j := 0, 0
+	for i < len(from) && j < len(to) {
+		switch {
+		case from[i] == to[j]:
+			marked = append(marked, " "+from[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			marked = append(marked, "-"+from[i])
+			i++
+		default:
+			marked = append(marked, "+"+to[j])
+			j++
+		}
+	}
+	for ; i < len(from); i++ {
+		marked = append(marked, "-"+from[i])
+	}
+	for ; j < len(to); j++ {
+		marked = append(marked, "+"+to[j])
+	}
+
+	return marked
+}
@@ -0,0 +1,292 @@
+package model
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// ContentSearchResult is one Content that matched a search, with a short excerpt of
+// the matching text. In the Snippet, matched terms are wrapped in <mark> elements and
+// everything else is HTML-escaped.
+type ContentSearchResult struct {
+	Content *Content
+	Rank    float64 // Lower is a better match
+	Snippet string
+}
+
+// Markers that FTS5 puts around matched terms in a snippet. They cannot appear in
+// searchable text, so they are safe to replace after the snippet is escaped.
+const (
+	snippetMatchStart = "\x02"
+	snippetMatchEnd   = "\x03"
+)
+
+var markupPattern = regexp.MustCompile(`<[^>]*>`)
+
+// SearchableText removes markup from a rendered Content body so that tag and attribute
+// names are not indexed, and collapses the whitespace that is left behind.
+func SearchableText(body string) string {
+	text := markupPattern.ReplaceAllString(body, " ")
+	text = strings.NewReplacer(snippetMatchStart, "", snippetMatchEnd, "").Replace(text)
+
+	return strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+}
+
+// index brings the Content's entry in the search index up to date.
+func (content *Content) index(db execer) error {
+	err := content.unindex(db)
+	if err == nil {
+		_, err = db.Exec(`insert into content_search (rowid, title, summary, body)
+			values (?, ?, ?, ?)`, content.ID, content.Title, content.Summary,
+			SearchableText(RenderBody(content.BodyFormat, content.Body)))
+	}
+
+	if err != nil {
+		return fmt.Errorf("error indexing Content %d: %v", content.ID, err)
+	}
+
+	return nil
+}
+
+func (content *Content) unindex(db execer) error {
+	_, err := db.Exec("delete from content_search where rowid = ?", content.ID)
+
+	return err
+}
+
+// SearchContent finds the Content that best matches the words in query, best match
+// first. Every word must appear in the title, summary or body; matches in the title
+// count for more than matches in the summary, which count for more than the body.
+// Unless includeUnpublished is true, only published Content is searched. A limit
+// of zero or less means no limit.
+func (model *GrogModel) SearchContent(query string, limit int, includeUnpublished bool) ([]*ContentSearchResult, error) {
+	var foundResults []*ContentSearchResult
+
+	words := searchWords(query)
+	if len(words) == 0 {
+		return foundResults, nil
+	}
+	if !model.fullTextSearch() {
+		return model.likeSearchContent(words, limit, includeUnpublished)
+	}
+	match := ftsQuery(words)
+
+	searchQuery := `select content_search.rowid, bm25(content_search, 10.0, 5.0, 1.0),
+		snippet(content_search, -1, '` + snippetMatchStart + `', '` + snippetMatchEnd + `', '…', 24)
+		from content_search join content on content.id = content_search.rowid
+		where content_search match ?`
+	if !includeUnpublished {
+		searchQuery += ` and ` + publishedCondition
+	}
+	searchQuery += ` order by bm25(content_search, 10.0, 5.0, 1.0)`
+	if limit > 0 {
+		searchQuery += fmt.Sprintf(` limit %d`, limit)
+	}
+
+	rows, rowsErr := model.db.DB.Query(searchQuery, match)
+	if rowsErr != nil {
+		return nil, fmt.Errorf("error searching Content: %v", rowsErr)
+	}
+
+	var (
+		id      int64
+		rank    float64
+		snippet string
+	)
+
+	for rows.Next() {
+		if scanErr := rows.Scan(&id, &rank, &snippet); scanErr != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error reading search results: %v", scanErr)
+		}
+
+		foundResults = append(foundResults, &ContentSearchResult{
+			Content: &Content{ID: id},
+			Rank:    rank,
+			Snippet: markSnippet(snippet),
+		})
+	}
+	rows.Close()
+
+	return model.loadSearchResults(foundResults)
+}
+
+// loadSearchResults loads the Content of each result. It is done once the search is
+// finished, because the database may only allow one open query at a time.
+func (model *GrogModel) loadSearchResults(foundResults []*ContentSearchResult) ([]*ContentSearchResult, error) {
+	for _, result := range foundResults {
+		content, contentErr := model.GetContent(result.Content.ID)
+		if contentErr != nil {
+			return nil, contentErr
+		}
+		result.Content = content
+	}
+
+	return foundResults, nil
+}
+
+// fullTextSearch reports whether content_search is an FTS5 table. It is a plain table
+// if the database was created by a build of SQLite without FTS5.
+func (model *GrogModel) fullTextSearch() bool {
+	model.fullTextOnce.Do(func() {
+		var tableSQL string
+		model.db.DB.QueryRow(`select sql from sqlite_master where name = 'content_search'`).Scan(&tableSQL)
+		model.fullText = strings.Contains(strings.ToLower(tableSQL), "fts5")
+	})
+
+	return model.fullText
+}
+
+// likeSearchContent is SearchContent for a database without FTS5. Each word must
+// appear somewhere in the title, summary or body, and is weighted as it is by bm25
+// in a full-text search; matches are found with LIKE, so they can be inside words.
+func (model *GrogModel) likeSearchContent(words []string, limit int, includeUnpublished bool) ([]*ContentSearchResult, error) {
+	var foundResults []*ContentSearchResult
+
+	var conditions, scores []string
+	var matchArgs, scoreArgs []interface{}
+	for _, word := range words {
+		// Words hold only letters and numbers, so they need no escaping for LIKE.
+		pattern := "%" + word + "%"
+		conditions = append(conditions, `(content_search.title like ? or content_search.summary like ?
+			or content_search.body like ?)`)
+		scores = append(scores, `10 * (content_search.title like ?) + 5 * (content_search.summary like ?)
+			+ (content_search.body like ?)`)
+		matchArgs = append(matchArgs, pattern, pattern, pattern)
+		scoreArgs = append(scoreArgs, pattern, pattern, pattern)
+	}
+
+	searchQuery := `select content_search.rowid, -(` + strings.Join(scores, " + ") + `) as rank,
+		content_search.title, content_search.summary, content_search.body
+		from content_search join content on content.id = content_search.rowid
+		where ` + strings.Join(conditions, " and ")
+	if !includeUnpublished {
+		searchQuery += ` and ` + publishedCondition
+	}
+	searchQuery += ` order by rank, content_search.rowid`
+	if limit > 0 {
+		searchQuery += fmt.Sprintf(` limit %d`, limit)
+	}
+
+	rows, rowsErr := model.db.DB.Query(searchQuery, append(scoreArgs, matchArgs...)...)
+	if rowsErr != nil {
+		return nil, fmt.Errorf("error searching Content: %v", rowsErr)
+	}
+
+	var (
+		id                   int64
+		rank                 float64
+		title, summary, body string
+	)
+
+	for rows.Next() {
+		if scanErr := rows.Scan(&id, &rank, &title, &summary, &body); scanErr != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error reading search results: %v", scanErr)
+		}
+
+		foundResults = append(foundResults, &ContentSearchResult{
+			Content: &Content{ID: id},
+			Rank:    rank,
+			Snippet: markSnippet(likeSnippet(words, body, summary, title)),
+		})
+	}
+	rows.Close()
+
+	return model.loadSearchResults(foundResults)
+}
+
+// snippetWords is how many words a snippet made without FTS5 holds, as FTS5's do.
+const snippetWords = 24
+
+// likeSnippet makes a snippet like FTS5's from the first of the texts that has a match
+// in it, marking each word that holds a match.
+func likeSnippet(words []string, texts ...string) string {
+	matches := func(field string) bool {
+		lowered := strings.ToLower(field)
+		for _, word := range words {
+			if strings.Contains(lowered, strings.ToLower(word)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, text := range texts {
+		fields := strings.Fields(text)
+
+		first := -1
+		for i, field := range fields {
+			if matches(field) {
+				first = i
+				break
+			}
+		}
+		if first < 0 {
+			continue
+		}
+
+		start := first - snippetWords/4
+		if start < 0 {
+			start = 0
+		}
+		end := start + snippetWords
+		if end > len(fields) {
+			end = len(fields)
+		}
+
+		var snippet []string
+		for _, field := range fields[start:end] {
+			if matches(field) {
+				// Punctuation around the word is left outside the mark, as FTS5 does.
+				core := strings.TrimFunc(field, notWordRune)
+				at := strings.Index(field, core)
+				field = field[:at] + snippetMatchStart + core + snippetMatchEnd + field[at+len(core):]
+			}
+			snippet = append(snippet, field)
+		}
+
+		joined := strings.Join(snippet, " ")
+		if start > 0 {
+			joined = "…" + joined
+		}
+		if end < len(fields) {
+			joined += "…"
+		}
+
+		return joined
+	}
+
+	return ""
+}
+
+func notWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// searchWords splits what someone searched for into words, leaving out punctuation
+// and anything else that is not a letter or number.
+func searchWords(query string) []string {
+	return strings.FieldsFunc(query, notWordRune)
+}
+
+// ftsQuery turns the words that someone searched for into an FTS5 query that matches
+// all of them. Each word is quoted so that FTS5 operators cannot appear in the search.
+// The final word is also matched as a prefix.
+func ftsQuery(words []string) string {
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = `"` + word + `"`
+	}
+	terms[len(terms)-1] += "*"
+
+	return strings.Join(terms, " ")
+}
+
+func markSnippet(snippet string) string {
+	return strings.NewReplacer(snippetMatchStart, "<mark>", snippetMatchEnd, "</mark>").
+		Replace(html.EscapeString(snippet))
+}
@@ -0,0 +1,105 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Session records that a User has logged in. The key that is handed to the browser
+// is never stored; only its hash is kept in the database.
+type Session struct {
+	model   *GrogModel
+	ID      string
+	User    int64
+	Added   NullTime
+	Expires NullTime
+}
+
+// newSecret returns a random, hex-encoded value that is suitable for use as a session
+// key or an API token.
+func newSecret() (string, error) {
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", fmt.Errorf("error generating secret: %v", err)
+	}
+
+	return hex.EncodeToString(secretBytes), nil
+}
+
+// hashSecret returns the value under which a secret is stored in the database.
+func hashSecret(secret string) string {
+	hashed := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(hashed[:])
+}
+
+// NewSession creates and saves a Session for the given user that lasts for the given
+// duration. The returned key must be presented to GetSession to find the Session again.
+func (model *GrogModel) NewSession(userID int64, lifetime time.Duration) (*Session, string, error) {
+	key, keyErr := newSecret()
+	if keyErr != nil {
+		return nil, "", keyErr
+	}
+
+	newSession := new(Session)
+	newSession.model = model
+	newSession.ID = hashSecret(key)
+	newSession.User = userID
+	newSession.Added.Set(time.Now())
+	newSession.Expires.Set(newSession.Added.Time.Add(lifetime))
+
+	_, err := model.db.DB.Exec("insert into sessions (id, user, added, expires) values (?, ?, ?, ?)",
+		newSession.ID, newSession.User, newSession.Added.Unix(), newSession.Expires.Unix())
+	if err != nil {
+		return nil, "", fmt.Errorf("error saving session: %v", err)
+	}
+
+	return newSession, key, nil
+}
+
+// GetSession retrieves the unexpired Session that was issued with the given key.
+func (model *GrogModel) GetSession(key string) (*Session, error) {
+	var foundSession *Session
+	var err error
+	var user int64
+	var added int64
+	var expires int64
+
+	id := hashSecret(key)
+	row := model.db.DB.QueryRow("select user, added, expires from sessions where id = ?", id)
+
+	if row.Scan(&user, &added, &expires) != sql.ErrNoRows {
+		if time.Now().Unix() < expires {
+			foundSession = new(Session)
+			foundSession.model = model
+			foundSession.ID = id
+			foundSession.User = user
+			foundSession.Added.Set(time.Unix(added, 0))
+			foundSession.Expires.Set(time.Unix(expires, 0))
+		} else {
+			err = fmt.Errorf("session has expired")
+		}
+	} else {
+		err = fmt.Errorf("no such session")
+	}
+
+	return foundSession, err
+}
+
+// Delete removes the Session from the database, logging it out.
+func (session Session) Delete() error {
+	_, err := session.model.db.DB.Exec("delete from sessions where id = ?", session.ID)
+
+	return err
+}
+
+// DeleteExpiredSessions removes every Session whose lifetime has passed.
+func (model *GrogModel) DeleteExpiredSessions() error {
+	_, err := model.db.DB.Exec("delete from sessions where expires <= strftime('%s','now')")
+
+	return err
+}
@@ -0,0 +1,217 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Tag is a label that can be attached to any number of Content, as a way of grouping
+// it apart from the Parent tree. Tag names are not case-sensitive; they are stored in
+// lower case.
+type Tag struct {
+	model   *GrogModel
+	ID      int64
+	Name    string
+	preview bool // Include unpublished Content
+}
+
+// NormalizeTagName puts a tag name into the form in which it is stored: lower case,
+// with runs of whitespace replaced by a single space.
+func NormalizeTagName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// ValidTagName reports whether name can be used as a tag. Names become part of /tag/
+// URLs and are given as comma-separated lists, so they cannot contain slashes or
+// commas.
+func ValidTagName(name string) bool {
+	name = NormalizeTagName(name)
+
+	return len(name) > 0 && !strings.ContainsAny(name, "/,")
+}
+
+// Tag attaches the named tags to the Content, creating any that do not already exist.
+// The Content must already have been saved.
+func (content *Content) Tag(names ...string) error {
+	if !content.IndexSet() {
+		return fmt.Errorf("Content must be saved before it can be tagged")
+	}
+
+	for _, name := range names {
+		if !ValidTagName(name) {
+			return fmt.Errorf("invalid tag name %q", name)
+		}
+		name = NormalizeTagName(name)
+
+		_, err := content.model.db.DB.Exec(`insert or ignore into tags (name) values (?)`, name)
+		if err == nil {
+			_, err = content.model.db.DB.Exec(`insert or ignore into content_tags (content, tag)
+				select ?, id from tags where name = ?`, content.ID, name)
+		}
+		if err != nil {
+			return fmt.Errorf("error tagging Content %d with %s: %v", content.ID, name, err)
+		}
+	}
+
+	return nil
+}
+
+// Untag removes the named tags from the Content. Tags that no Content uses any more
+// are deleted.
+func (content *Content) Untag(names ...string) error {
+	for _, name := range names {
+		_, err := content.model.db.DB.Exec(`delete from content_tags where content = ? and
+			tag = (select id from tags where name = ?)`, content.ID, NormalizeTagName(name))
+		if err != nil {
+			return fmt.Errorf("error removing tag %s from Content %d: %v", name, content.ID, err)
+		}
+	}
+
+	return content.model.deleteUnusedTags()
+}
+
+// SetTags replaces all of the Content's tags with the named ones.
+func (content *Content) SetTags(names []string) error {
+	var oldNames []string
+	for _, tag := range content.Tags() {
+		oldNames = append(oldNames, tag.Name)
+	}
+
+	untagErr := content.Untag(oldNames...)
+	if untagErr != nil {
+		return untagErr
+	}
+
+	return content.Tag(names...)
+}
+
+// Tags loads the tags attached to the Content, in alphabetical order.
+func (content *Content) Tags() []*Tag {
+	var foundTags []*Tag
+
+	rows, queryErr := content.model.db.DB.Query(`select tags.id, tags.name from tags
+		join content_tags on content_tags.tag = tags.id where content_tags.content = ?
+		order by tags.name`, content.ID)
+
+	if queryErr == nil {
+		defer rows.Close()
+
+		for foundTag := content.model.readTagFromRow(rows); foundTag != nil; foundTag = content.model.readTagFromRow(rows) {
+			foundTag.preview = content.preview
+			foundTags = append(foundTags, foundTag)
+		}
+	}
+
+	return foundTags
+}
+
+// GetTag retrieves the Tag with the given name.
+func (model *GrogModel) GetTag(name string) (*Tag, error) {
+	var foundTag *Tag
+	var err error
+
+	rows, queryErr := model.db.DB.Query(`select id, name from tags where name = ?`, NormalizeTagName(name))
+
+	if queryErr == nil {
+		defer rows.Close()
+
+		foundTag = model.readTagFromRow(rows)
+
+		if foundTag == nil {
+			err = fmt.Errorf("no Tag with name %s", name)
+		}
+	} else {
+		err = fmt.Errorf("database error while reading Tag: %v", queryErr)
+	}
+
+	return foundTag, err
+}
+
+// AllTags loads every Tag that is attached to some Content, in alphabetical order.
+func (model *GrogModel) AllTags() ([]*Tag, error) {
+	var foundTags []*Tag
+
+	rows, rowsErr := model.db.DB.Query(`select id, name from tags order by name`)
+	if rowsErr != nil {
+		return nil, fmt.Errorf("error loading all tags: %v", rowsErr)
+	}
+
+	defer rows.Close()
+
+	for foundTag := model.readTagFromRow(rows); foundTag != nil; foundTag = model.readTagFromRow(rows) {
+		foundTags = append(foundTags, foundTag)
+	}
+
+	return foundTags, nil
+}
+
+// ContentsWithTag loads the Content that has the named tag, newest first. Unless
+// includeUnpublished is true, only published Content is included.
+func (model *GrogModel) ContentsWithTag(name string, includeUnpublished bool) ([]*Content, error) {
+	var foundContents []*Content
+
+	tagQuery := `select ` + contentColumns + ` from Content where id in (select content
+		from content_tags where tag = (select id from tags where name = ?))`
+	if !includeUnpublished {
+		tagQuery += ` and ` + publishedCondition
+	}
+	tagQuery += ` order by added desc`
+
+	rows, rowsErr := model.db.DB.Query(tagQuery, NormalizeTagName(name))
+	if rowsErr != nil {
+		return nil, fmt.Errorf("error loading Content tagged %s: %v", name, rowsErr)
+	}
+
+	defer rows.Close()
+
+	for foundContent := model.readContentFromRow(rows); foundContent != nil; foundContent = model.readContentFromRow(rows) {
+		foundContent.preview = includeUnpublished
+		foundContents = append(foundContents, foundContent)
+	}
+
+	return foundContents, nil
+}
+
+// SetPreview controls whether Contents also finds unpublished Content.
+func (tag *Tag) SetPreview(preview bool) {
+	tag.preview = preview
+}
+
+// Contents loads the Content that has this tag, newest first. Unless the Tag is being
+// previewed, only published Content is included.
+func (tag *Tag) Contents() []*Content {
+	foundContents, _ := tag.model.ContentsWithTag(tag.Name, tag.preview)
+
+	return foundContents
+}
+
+func (model *GrogModel) readTagFromRow(rows *sql.Rows) *Tag {
+	var foundTag *Tag
+
+	if rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+
+		if rows.Scan(&id, &name) != sql.ErrNoRows {
+			foundTag = new(Tag)
+			foundTag.model = model
+			foundTag.ID = id
+			foundTag.Name = name
+		}
+	}
+
+	return foundTag
+}
+
+// deleteUnusedTags removes tags that are no longer attached to any Content.
+func (model *GrogModel) deleteUnusedTags() error {
+	_, err := model.db.DB.Exec(`delete from tags where id not in (select tag from content_tags)`)
+	if err != nil {
+		return fmt.Errorf("error removing unused tags: %v", err)
+	}
+
+	return nil
+}
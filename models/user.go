@@ -4,14 +4,38 @@ import (
 	"database/sql"
 	"fmt"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+// MinPasswordLength is the shortest password that SetUserPassword will accept.
+const MinPasswordLength = 8
+
+// The roles that a User can have, from most to least capable.
+const (
+	RoleAdmin  = "admin"  // may change anything
+	RoleEditor = "editor" // may change any Content
+	RoleAuthor = "author" // may add Content and change their own
+	RoleViewer = "viewer" // may only read, including unpublished Content
+)
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleEditor, RoleAuthor, RoleViewer:
+		return true
+	}
+
+	return false
+}
+
 // User comprises all of the information about a user of Grog
 type User struct {
 	model *GrogModel
 	ID    int64
 	Email string
 	Name  string
+	Role  string
 	Added NullTime
 }
 
@@ -22,22 +46,60 @@ func (model *GrogModel) NewUser(email string, name string) *User {
 	newUser.ID = -1
 	newUser.Email = email
 	newUser.Name = name
+	newUser.Role = RoleViewer
 
 	return newUser
 }
 
+// CanAddContent reports whether the User may create new Content.
+func (user User) CanAddContent() bool {
+	return user.Role == RoleAdmin || user.Role == RoleEditor || user.Role == RoleAuthor
+}
+
+// CanEditContent reports whether the User may change the given Content. Authors may
+// only change Content that they wrote.
+func (user User) CanEditContent(content *Content) bool {
+	switch user.Role {
+	case RoleAdmin, RoleEditor:
+		return true
+	case RoleAuthor:
+		return content.Author == user.ID
+	}
+
+	return false
+}
+
+// CanEditAssets reports whether the User may add, change or remove Assets.
+func (user User) CanEditAssets() bool {
+	return user.Role == RoleAdmin
+}
+
+// CanEditQueries reports whether the User may add, change or remove named queries.
+func (user User) CanEditQueries() bool {
+	return user.Role == RoleAdmin
+}
+
+// CanManageUsers reports whether the User may add, change or remove other Users.
+func (user User) CanManageUsers() bool {
+	return user.Role == RoleAdmin
+}
+
 // Save writes the User object to the database
 func (user *User) Save() error {
 	var saveError error
 
+	if !ValidRole(user.Role) {
+		return fmt.Errorf("unknown role %q", user.Role)
+	}
+
 	if user.ID == -1 {
 		// New, do insert
 		if user.Added.IsNull() {
 			user.Added.Set(time.Now())
 		}
 
-		insertResult, err := user.model.db.DB.Exec("insert into users (Email, Name, Added) values (?, ?, strftime('%s','now'))",
-			user.Email, user.Name)
+		insertResult, err := user.model.db.DB.Exec("insert into users (Email, Name, Role, Added) values (?, ?, ?, strftime('%s','now'))",
+			user.Email, user.Name, user.Role)
 		if err == nil {
 			user.ID, err = insertResult.LastInsertId()
 		}
@@ -45,8 +107,8 @@ func (user *User) Save() error {
 		saveError = err
 	} else {
 		// Exists, do update
-		_, err := user.model.db.DB.Exec(`update users set Email = ?, Name = ? where Id = ?`,
-			user.Email, user.Name, user.Added.Unix(), user.ID)
+		_, err := user.model.db.DB.Exec(`update users set Email = ?, Name = ?, Role = ? where Id = ?`,
+			user.Email, user.Name, user.Role, user.ID)
 		saveError = err
 	}
 
@@ -59,13 +121,15 @@ func (model *GrogModel) GetUser(id int64) (*User, error) {
 	var err error
 	var email string
 	var name string
+	var role string
 	var added int64
 
-	row := model.db.DB.QueryRow("select email, name, added from Users where id = ?", id)
+	row := model.db.DB.QueryRow("select email, name, role, added from Users where id = ?", id)
 
-	if row.Scan(&email, &name, &added) != sql.ErrNoRows {
+	if row.Scan(&email, &name, &role, &added) != sql.ErrNoRows {
 		foundUser = model.NewUser(email, name)
 		foundUser.ID = id
+		foundUser.Role = role
 		foundUser.Added.Set(time.Unix(added, 0))
 	} else {
 		err = fmt.Errorf("No user with id %d", id)
@@ -85,7 +149,7 @@ func (model *GrogModel) DeleteUser(id int64) error {
 func (model *GrogModel) AllUsers() ([]*User, error) {
 	var foundUsers []*User
 
-	rows, rowsErr := model.db.DB.Query(`select id, name, email, added from users`)
+	rows, rowsErr := model.db.DB.Query(`select id, name, email, role, added from users`)
 
 	if rowsErr != nil {
 		return nil, fmt.Errorf("error loading all users: %v", rowsErr)
@@ -97,13 +161,15 @@ func (model *GrogModel) AllUsers() ([]*User, error) {
 		id    int64
 		name  string
 		email string
+		role  string
 		added int64
 	)
 
 	for rows.Next() {
-		if rows.Scan(&id, &name, &email, &added) != sql.ErrNoRows {
+		if rows.Scan(&id, &name, &email, &role, &added) != sql.ErrNoRows {
 			foundUser := model.NewUser(email, name)
 			foundUser.ID = id
+			foundUser.Role = role
 			foundUser.Added.Set(time.Unix(added, 0))
 
 			if foundUsers == nil {
@@ -115,3 +181,125 @@ func (model *GrogModel) AllUsers() ([]*User, error) {
 
 	return foundUsers, nil
 }
+
+// GetUserByEmail retrieves the User object with the given email address from the database
+func (model *GrogModel) GetUserByEmail(email string) (*User, error) {
+	var foundUser *User
+	var err error
+	var id int64
+	var name string
+	var role string
+	var added int64
+
+	row := model.db.DB.QueryRow("select id, name, role, added from Users where email = ?", email)
+
+	if row.Scan(&id, &name, &role, &added) != sql.ErrNoRows {
+		foundUser = model.NewUser(email, name)
+		foundUser.ID = id
+		foundUser.Role = role
+		foundUser.Added.Set(time.Unix(added, 0))
+	} else {
+		err = fmt.Errorf("No user with email %s", email)
+	}
+
+	return foundUser, err
+}
+
+// SetUserPassword replaces the password of the user with the given id. Only a bcrypt
+// hash of the password is stored. The user's sessions and API tokens are ended, since
+// they may have been got by someone who knew the old password.
+func (model *GrogModel) SetUserPassword(id int64, password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", MinPasswordLength)
+	}
+
+	hashed, hashErr := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if hashErr != nil {
+		return fmt.Errorf("error hashing password: %v", hashErr)
+	}
+
+	tx, txErr := model.db.DB.Begin()
+	if txErr != nil {
+		return fmt.Errorf("error saving password for user %d: %v", id, txErr)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("update users set password = ? where id = ?", string(hashed), id)
+	if err != nil {
+		return fmt.Errorf("error saving password for user %d: %v", id, err)
+	}
+
+	rowsUpdated, rowsUpdatedErr := res.RowsAffected()
+	if rowsUpdatedErr == nil && rowsUpdated != 1 {
+		return fmt.Errorf("No user with id %d", id)
+	}
+
+	if _, err = tx.Exec("delete from sessions where user = ?", id); err != nil {
+		return fmt.Errorf("error ending sessions of user %d: %v", id, err)
+	}
+	if _, err = tx.Exec("delete from api_tokens where user = ?", id); err != nil {
+		return fmt.Errorf("error revoking API tokens of user %d: %v", id, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error saving password for user %d: %v", id, err)
+	}
+
+	return nil
+}
+
+// ResetUserPassword gives the user with the given id a new, randomly-generated password
+// and returns it so that it can be passed along to the user.
+func (model *GrogModel) ResetUserPassword(id int64) (string, error) {
+	secret, secretErr := newSecret()
+	if secretErr != nil {
+		return "", secretErr
+	}
+
+	// The full secret is needlessly long for someone to type in.
+	password := secret[:16]
+
+	return password, model.SetUserPassword(id, password)
+}
+
+// VerifyUserPassword returns the User with the given email address if password matches
+// the one stored for that User.
+func (model *GrogModel) VerifyUserPassword(email string, password string) (*User, error) {
+	var hashed string
+
+	foundUser, err := model.GetUserByEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	row := model.db.DB.QueryRow("select password from users where id = ?", foundUser.ID)
+	if row.Scan(&hashed) == sql.ErrNoRows || len(hashed) == 0 {
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) != nil {
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	return foundUser, nil
+}
+
+// AuthenticateUser returns the User with the given email address if secret is either
+// that User's password or one of that User's API tokens.
+func (model *GrogModel) AuthenticateUser(email string, secret string) (*User, error) {
+	if passwordUser, passwordErr := model.VerifyUserPassword(email, secret); passwordErr == nil {
+		return passwordUser, nil
+	}
+
+	foundUser, err := model.GetUserByEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	tokenUser, tokenErr := model.GetUserByAPIToken(secret)
+	if tokenErr != nil || tokenUser.ID != foundUser.ID {
+		return nil, fmt.Errorf("invalid credentials")
+	}
+
+	return foundUser, nil
+}
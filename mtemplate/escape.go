@@ -0,0 +1,571 @@
+package mtemplate
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// AutoEscape gives the setting of AutoEscape for Templates made by New, and so for
+// every template that is parsed with the package-level functions.
+var AutoEscape bool
+
+// The parts of an HTML document that a variable can appear in. Each one needs its
+// values escaped in a different way.
+const (
+	stateText        = iota // Between tags
+	stateRCDATA             // Inside a textarea or title element, where tags are not recognized
+	stateTag                // Inside a tag, but not in an attribute
+	stateAttrName           // In the name of an attribute
+	stateAfterName          // After the name of an attribute, perhaps before an =
+	stateBeforeValue        // After the = of an attribute, before its value
+	stateAttr               // In the value of an attribute
+	stateScript             // Inside a script element
+	stateStyle              // Inside a style element
+	stateComment            // Inside an HTML comment
+)
+
+// The kinds of attribute whose values are not plain text.
+const (
+	attrPlain = iota
+	attrURL
+	attrScript
+	attrStyle
+)
+
+// The parts of a URL, which are escaped differently.
+const (
+	urlStart = iota // Nothing of the URL has been seen, so its scheme could be given
+	urlPath         // The scheme, host and path
+	urlQuery        // The query string or fragment
+)
+
+// escapeContext records where in an HTML document the parser has reached, so that the
+// variables that it meets can be escaped to suit.
+type escapeContext struct {
+	state    int
+	element  string // Element whose contents are not HTML: script, style, textarea or title
+	attrName string // Name of the attribute being read, while in stateAttrName
+	attr     int    // Kind of attribute, while in an attribute
+	delim    byte   // Quote around the attribute value, or ' ' if it is not quoted
+	urlPart  int    // Part of a URL attribute that has been reached
+	quote    byte   // Quote around the JavaScript or CSS string that has been reached, or 0
+	comment  byte   // '/' or '*' while in a JavaScript line or block comment, otherwise 0
+}
+
+// advance returns the context that is reached after text.
+func (ctx escapeContext) advance(text []byte) escapeContext {
+	for i := 0; i < len(text); {
+		i = ctx.step(text, i)
+	}
+
+	return ctx
+}
+
+// step moves the context past the text at text[i:] and returns the index of the first
+// byte that it did not use.
+func (ctx *escapeContext) step(text []byte, i int) int {
+	c := text[i]
+
+	switch ctx.state {
+	case stateText:
+		if c != '<' {
+			return i + 1
+		}
+		if bytes.HasPrefix(text[i:], []byte("<!--")) {
+			ctx.state = stateComment
+			return i + 4
+		}
+		end := i + 1
+		if end < len(text) && text[end] == '/' {
+			end++
+		}
+		nameEnd := end
+		for nameEnd < len(text) && isTagNameByte(text[nameEnd], nameEnd == end) {
+			nameEnd++
+		}
+		if nameEnd == end {
+			return i + 1
+		}
+		ctx.state = stateTag
+		ctx.element = ""
+		if text[i+1] != '/' {
+			switch name := strings.ToLower(string(text[end:nameEnd])); name {
+			case "script", "style", "textarea", "title":
+				ctx.element = name
+			}
+		}
+		return nameEnd
+	case stateComment:
+		if bytes.HasPrefix(text[i:], []byte("-->")) {
+			ctx.state = stateText
+			return i + 3
+		}
+		return i + 1
+	case stateRCDATA, stateScript, stateStyle:
+		if c == '<' && hasEndTag(text[i:], ctx.element) {
+			next := i + 2 + len(ctx.element)
+			ctx.state = stateTag
+			ctx.element = ""
+			ctx.quote, ctx.comment = 0, 0
+			return next
+		}
+		if ctx.state == stateScript {
+			return ctx.stepScript(text, i)
+		} else if ctx.state == stateStyle {
+			ctx.stepStyle(c)
+		}
+		return i + 1
+	case stateTag:
+		switch {
+		case white(c) || c == '/':
+		case c == '>':
+			ctx.endTag()
+		default:
+			ctx.state = stateAttrName
+			ctx.attrName = string(c)
+		}
+		return i + 1
+	case stateAttrName:
+		switch {
+		case white(c):
+			ctx.state = stateAfterName
+		case c == '=':
+			ctx.state = stateBeforeValue
+		case c == '>':
+			ctx.endTag()
+		case c == '/':
+			ctx.state = stateTag
+		default:
+			ctx.attrName += string(c)
+			return i + 1
+		}
+		ctx.attr = attributeKind(ctx.attrName)
+		ctx.attrName = ""
+		return i + 1
+	case stateAfterName:
+		switch {
+		case white(c):
+		case c == '=':
+			ctx.state = stateBeforeValue
+		case c == '>':
+			ctx.endTag()
+		case c == '/':
+			ctx.state = stateTag
+		default:
+			ctx.state = stateAttrName
+			ctx.attrName = string(c)
+		}
+		return i + 1
+	case stateBeforeValue:
+		switch {
+		case white(c):
+			return i + 1
+		case c == '>':
+			ctx.endTag()
+			return i + 1
+		case c == '"' || c == '\'':
+			ctx.startValue(c)
+			return i + 1
+		}
+		ctx.startValue(' ')
+		return i
+	case stateAttr:
+		if (ctx.delim == ' ' && white(c)) || c == ctx.delim {
+			ctx.state = stateTag
+			return i + 1
+		}
+		if ctx.delim == ' ' && c == '>' {
+			ctx.endTag()
+			return i + 1
+		}
+		switch ctx.attr {
+		case attrURL:
+			if c == '?' || c == '#' {
+				ctx.urlPart = urlQuery
+			} else if ctx.urlPart == urlStart {
+				ctx.urlPart = urlPath
+			}
+		case attrScript:
+			return ctx.stepScript(text, i)
+		case attrStyle:
+			ctx.stepStyle(c)
+		}
+		return i + 1
+	}
+
+	return i + 1
+}
+
+// startValue moves into the value of the attribute whose name has been read.
+func (ctx *escapeContext) startValue(delim byte) {
+	ctx.state = stateAttr
+	ctx.delim = delim
+	ctx.urlPart = urlStart
+	ctx.quote, ctx.comment = 0, 0
+}
+
+// endTag moves past the > at the end of a tag, into the contents of its element.
+func (ctx *escapeContext) endTag() {
+	switch ctx.element {
+	case "script":
+		ctx.state = stateScript
+	case "style":
+		ctx.state = stateStyle
+	case "textarea", "title":
+		ctx.state = stateRCDATA
+	default:
+		ctx.state = stateText
+	}
+	ctx.quote, ctx.comment = 0, 0
+}
+
+// stepScript follows JavaScript strings and comments, which are where the escaping of
+// a value in a script has to change, and returns the index of the first byte that it
+// did not use. Regular expression literals are not recognized.
+func (ctx *escapeContext) stepScript(text []byte, i int) int {
+	c := text[i]
+	next := byte(0)
+	if i+1 < len(text) {
+		next = text[i+1]
+	}
+
+	switch {
+	case ctx.comment == '/':
+		if c == '\n' {
+			ctx.comment = 0
+		}
+	case ctx.comment == '*':
+		if c == '*' && next == '/' {
+			ctx.comment = 0
+			return i + 2
+		}
+	case ctx.quote != 0:
+		if c == '\\' {
+			// Pass over the escaped character too.
+			return i + 2
+		}
+		if c == ctx.quote {
+			ctx.quote = 0
+		}
+	case c == '"' || c == '\'' || c == '`':
+		ctx.quote = c
+	case c == '/' && (next == '/' || next == '*'):
+		ctx.comment = next
+		return i + 2
+	}
+
+	return i + 1
+}
+
+// stepStyle follows CSS strings.
+func (ctx *escapeContext) stepStyle(c byte) {
+	if ctx.quote != 0 {
+		if c == ctx.quote {
+			ctx.quote = 0
+		}
+	} else if c == '"' || c == '\'' {
+		ctx.quote = c
+	}
+}
+
+// canonical returns the context with the fields that do not matter in its state
+// cleared, so that two contexts that escape alike compare as equal.
+func (ctx escapeContext) canonical() escapeContext {
+	c := escapeContext{state: ctx.state}
+	switch ctx.state {
+	case stateTag, stateRCDATA, stateScript, stateStyle:
+		c.element = ctx.element
+	case stateAttrName:
+		c.element, c.attrName = ctx.element, ctx.attrName
+	case stateAfterName, stateBeforeValue:
+		c.element, c.attr = ctx.element, ctx.attr
+	case stateAttr:
+		c.element, c.attr, c.delim = ctx.element, ctx.attr, ctx.delim
+		if ctx.attr == attrURL {
+			c.urlPart = ctx.urlPart
+		}
+	}
+	if ctx.state == stateScript || ctx.state == stateStyle ||
+		(ctx.state == stateAttr && (ctx.attr == attrScript || ctx.attr == attrStyle)) {
+		c.quote, c.comment = ctx.quote, ctx.comment
+	}
+
+	return c
+}
+
+// afterVariable returns the context that follows a variable that was met in ctx.
+func (ctx escapeContext) afterVariable() escapeContext {
+	switch ctx.state {
+	case stateBeforeValue:
+		ctx.startValue(' ')
+		ctx.urlPart = urlPath
+	case stateAttr:
+		if ctx.urlPart == urlStart {
+			ctx.urlPart = urlPath
+		}
+	}
+
+	return ctx
+}
+
+// escaper returns the function that escapes a value for the context, or nil if the
+// output of the formatter named last needs no more escaping there.
+func (ctx escapeContext) escaper(last string) escapeFunc {
+	switch ctx.state {
+	case stateText, stateRCDATA, stateComment:
+		switch last {
+		case "html", "sanitize":
+			return nil
+		case "markdown":
+			return sanitizeMarkdown
+		}
+		return escapeHTML
+	case stateTag, stateAttrName, stateAfterName:
+		return escapeAttrName
+	case stateBeforeValue:
+		ctx.startValue(' ')
+	case stateScript:
+		return ctx.scriptEscaper()
+	case stateStyle:
+		return escapeCSS
+	}
+
+	var escape escapeFunc
+	switch ctx.attr {
+	case attrURL:
+		switch {
+		case ctx.urlPart == urlStart:
+			escape = filterURL
+		case ctx.urlPart == urlQuery && last == "urlsafe":
+		case ctx.urlPart == urlQuery:
+			escape = escapeURLQuery
+		default:
+			escape = normalizeURL
+		}
+	case attrScript:
+		escape = ctx.scriptEscaper()
+	case attrStyle:
+		escape = escapeCSS
+	default:
+		if last == "html" && ctx.delim != ' ' {
+			return nil
+		}
+	}
+
+	attrEscape := escapeHTML
+	if ctx.delim == ' ' {
+		attrEscape = escapeUnquotedAttr
+	}
+	if escape == nil {
+		return attrEscape
+	}
+
+	return func(s string, value []interface{}) string {
+		return attrEscape(escape(s, value), nil)
+	}
+}
+
+// scriptEscaper returns the escaper for a value in JavaScript.
+func (ctx escapeContext) scriptEscaper() escapeFunc {
+	if ctx.quote != 0 || ctx.comment != 0 {
+		return escapeJSString
+	}
+
+	return escapeJSValue
+}
+
+// An escapeFunc escapes s, the formatted value of a variable, for one context. value
+// holds the variable's values, or is nil if a formatter has changed them.
+type escapeFunc func(s string, value []interface{}) string
+
+func escapeHTML(s string, value []interface{}) string {
+	var buf bytes.Buffer
+	HTMLEscape(&buf, []byte(s))
+
+	return buf.String()
+}
+
+// sanitizeMarkdown makes the output of the markdown formatter safe in text. Markdown
+// passes raw HTML and any link through, so its output is sanitized with
+// DefaultSanitizePolicy rather than trusted as it is.
+func sanitizeMarkdown(s string, value []interface{}) string {
+	policy, found := SanitizePolicies[DefaultSanitizePolicy]
+	if !found {
+		return escapeHTML(s, value)
+	}
+
+	return policy.Sanitize(s)
+}
+
+// escapeUnquotedAttr escapes a value for an attribute that has no quotes around it, so
+// white space and other characters that would end the value are escaped too.
+func escapeUnquotedAttr(s string, value []interface{}) string {
+	var out strings.Builder
+	for _, r := range s {
+		switch r {
+		case '"', '\'', '&', '<', '>', '=', '`', ' ', '\t', '\n', '\r', '\f':
+			fmt.Fprintf(&out, "&#%d;", r)
+		default:
+			out.WriteRune(r)
+		}
+	}
+
+	return out.String()
+}
+
+// escapeAttrName lets a value through if it could only be the name of an attribute,
+// and replaces it otherwise. Whole attributes need the raw formatter.
+func escapeAttrName(s string, value []interface{}) string {
+	for i := 0; i < len(s); i++ {
+		if !isTagNameByte(s[i], false) || (i == 0 && s[i] == '-') {
+			return escapeRejected
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(s), "on") || strings.EqualFold(s, "style") {
+		return escapeRejected
+	}
+
+	return s
+}
+
+// escapeRejected replaces a value that cannot be made safe where it is used.
+const escapeRejected = "ZmtemplateZ"
+
+// filterURL replaces a URL whose scheme could run code, such as javascript:, and
+// normalizes any other.
+func filterURL(s string, value []interface{}) string {
+	if !defaultURLPolicy.allowedURL(s) {
+		return "#" + escapeRejected
+	}
+
+	return normalizeURL(s, value)
+}
+
+// The schemes that a URL given by a variable may have.
+var defaultURLPolicy = &SanitizePolicy{URLSchemes: []string{"http", "https", "mailto", "tel"}}
+
+// normalizeURL percent-encodes the characters that cannot appear in a URL, leaving the
+// URL's structure and any escapes already in it as they are.
+func normalizeURL(s string, value []interface{}) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c > ' ' && c < 0x7f && !strings.ContainsRune(`"'<>\^`+"`{|}", rune(c)) {
+			out.WriteByte(c)
+		} else {
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+
+	return out.String()
+}
+
+// escapeURLQuery percent-encodes everything in a value but the characters that can
+// stand for themselves in part of a query string.
+func escapeURLQuery(s string, value []interface{}) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAlphaNumeric(c) || c == '-' || c == '_' || c == '.' || c == '~' {
+			out.WriteByte(c)
+		} else {
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+
+	return out.String()
+}
+
+// escapeJSString escapes a value to go inside a JavaScript string. Everything that
+// could end the string, the script or the attribute around it is written as a
+// \u escape.
+func escapeJSString(s string, value []interface{}) string {
+	var out strings.Builder
+	for _, r := range s {
+		if r < ' ' || r == 0x7f || r == 0x2028 || r == 0x2029 ||
+			strings.ContainsRune(`"'`+"`"+`\<>&=/$+`, r) {
+			fmt.Fprintf(&out, `\u%04X`, r)
+		} else {
+			out.WriteRune(r)
+		}
+	}
+
+	return out.String()
+}
+
+// escapeJSValue writes a value where a JavaScript expression is expected. Numbers and
+// booleans are written as they are, and everything else as a string.
+func escapeJSValue(s string, value []interface{}) string {
+	if len(value) == 1 && value[0] != nil {
+		switch reflect.ValueOf(value[0]).Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return " " + fmt.Sprint(value[0]) + " "
+		}
+	}
+
+	return `"` + escapeJSString(s, nil) + `"`
+}
+
+// escapeCSS writes every character of a value that could end a CSS string, property or
+// rule, or start a comment or function call, as a CSS escape.
+func escapeCSS(s string, value []interface{}) string {
+	var out strings.Builder
+	for _, r := range s {
+		if r < utf8.RuneSelf && (isAlphaNumeric(byte(r)) || strings.ContainsRune("#.%-_, ", r)) {
+			out.WriteRune(r)
+		} else {
+			fmt.Fprintf(&out, `\%X `, r)
+		}
+	}
+
+	return out.String()
+}
+
+// attributeKind classifies an attribute by its name.
+func attributeKind(name string) int {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return attrScript
+	case name == "style":
+		return attrStyle
+	case sanitizeURLAttributes[name]:
+		return attrURL
+	}
+
+	return attrPlain
+}
+
+// hasEndTag reports whether text starts with the end tag of element.
+func hasEndTag(text []byte, element string) bool {
+	end := 2 + len(element)
+	if len(text) < end || text[1] != '/' || !strings.EqualFold(string(text[2:end]), element) {
+		return false
+	}
+
+	return len(text) == end || !isTagNameByte(text[end], false)
+}
+
+func isTagNameByte(c byte, first bool) bool {
+	if first {
+		return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
+
+	return isAlphaNumeric(c) || c == '-' || c == '_' || c == ':'
+}
+
+func isAlphaNumeric(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// RawFormatter writes a value as it is, even when the template escapes variables
+// automatically. It is for values that are known to be safe where they are used.
+func RawFormatter(w io.Writer, format string, data *TemplateData, value ...interface{}) {
+	StringFormatter(w, format, data, value...)
+}
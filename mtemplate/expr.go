@@ -0,0 +1,320 @@
+package mtemplate
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The expressions of .if and .elif directives are parsed into a tree of exprNodes.
+type exprNode interface{}
+
+// A string, number or boolean written in the expression.
+type exprLiteral struct {
+	value interface{}
+}
+
+// A field, looked up as a variable would be.
+type exprField struct {
+	name string
+}
+
+// not, or !
+type exprNot struct {
+	operand exprNode
+}
+
+// and, or, or a comparison.
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+
+// exprParser turns the text of an expression into a tree of exprNodes. Errors are
+// reported with the Template's parseError.
+type exprParser struct {
+	t      *Template
+	text   string
+	tokens []string
+	pos    int
+}
+
+// Allocate the expression for an .if or .elif directive.
+func (t *Template) parseExpr(text string) exprNode {
+	p := &exprParser{t: t, text: text}
+	p.tokenize()
+	node := p.parseOr()
+	if p.pos < len(p.tokens) {
+		p.error("unexpected %s", p.tokens[p.pos])
+	}
+
+	return node
+}
+
+// tokenize splits the text of the expression into operators, literals and field names.
+func (p *exprParser) tokenize() {
+	text := p.text
+	var tokens []string
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case white(c):
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(text) && text[end] != c {
+				if text[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(text) {
+				p.error("unterminated string")
+			}
+			tokens = append(tokens, text[i:end+1])
+			i = end + 1
+		case strings.HasPrefix(text[i:], "==") || strings.HasPrefix(text[i:], "!=") ||
+			strings.HasPrefix(text[i:], "<=") || strings.HasPrefix(text[i:], ">=") ||
+			strings.HasPrefix(text[i:], "&&") || strings.HasPrefix(text[i:], "||"):
+			tokens = append(tokens, text[i:i+2])
+			i += 2
+		case strings.IndexByte("<>!()", c) >= 0:
+			tokens = append(tokens, text[i:i+1])
+			i++
+		default:
+			end := i + 1
+			for end < len(text) && !white(text[end]) && strings.IndexByte(`<>!=()&|"'`, text[end]) < 0 {
+				end++
+			}
+			tokens = append(tokens, text[i:end])
+			i = end
+		}
+	}
+
+	p.tokens = tokens
+}
+
+func (p *exprParser) error(err string, args ...interface{}) {
+	p.t.parseError("bad expression %q: %s", p.text, fmt.Sprintf(err, args...))
+}
+
+// next returns the next token, or "" at the end of the expression.
+func (p *exprParser) next() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *exprParser) parseOr() exprNode {
+	node := p.parseAnd()
+	for op := p.next(); op == "or" || op == "||"; op = p.next() {
+		p.pos++
+		node = &exprBinary{"or", node, p.parseAnd()}
+	}
+
+	return node
+}
+
+func (p *exprParser) parseAnd() exprNode {
+	node := p.parseNot()
+	for op := p.next(); op == "and" || op == "&&"; op = p.next() {
+		p.pos++
+		node = &exprBinary{"and", node, p.parseNot()}
+	}
+
+	return node
+}
+
+func (p *exprParser) parseNot() exprNode {
+	if op := p.next(); op == "not" || op == "!" {
+		p.pos++
+		return &exprNot{p.parseNot()}
+	}
+
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() exprNode {
+	node := p.parseOperand()
+	switch op := p.next(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.pos++
+		node = &exprBinary{op, node, p.parseOperand()}
+	}
+
+	return node
+}
+
+func (p *exprParser) parseOperand() exprNode {
+	token := p.next()
+	p.pos++
+
+	switch {
+	case token == "":
+		p.error("missing operand")
+	case token == "(":
+		node := p.parseOr()
+		if p.next() != ")" {
+			p.error("missing )")
+		}
+		p.pos++
+		return node
+	case token == "true" || token == "false":
+		return &exprLiteral{token == "true"}
+	case token[0] == '"' || token[0] == '\'':
+		return &exprLiteral{unquoteExprString(token)}
+	case token[0] == '-' || token[0] == '.' || (token[0] >= '0' && token[0] <= '9'):
+		if number, err := strconv.ParseFloat(token, 64); err == nil {
+			return &exprLiteral{number}
+		}
+		p.error("bad number %s", token)
+	case strings.IndexByte("<>=!)&|", token[0]) >= 0 || token == "and" || token == "or" || token == "not":
+		p.error("unexpected %s", token)
+	}
+
+	return &exprField{token}
+}
+
+// unquoteExprString gives the value of a quoted string. A backslash makes the
+// character after it stand for itself.
+func unquoteExprString(token string) string {
+	var value strings.Builder
+	for i := 1; i < len(token)-1; i++ {
+		if token[i] == '\\' {
+			i++
+		}
+		value.WriteByte(token[i])
+	}
+
+	return value.String()
+}
+
+// Evaluate an expression. Fields are looked up as variables are, in the cursor and
+// then in outer sections.
+func (t *Template) evalExpr(node exprNode, st *state) interface{} {
+	switch n := node.(type) {
+	case *exprLiteral:
+		return n.value
+	case *exprField:
+		field := indirect(t.varValue(n.name, st))
+		if !field.IsValid() || !field.CanInterface() {
+			return nil
+		}
+		return field.Interface()
+	case *exprNot:
+		return !truth(t.evalExpr(n.operand, st))
+	case *exprBinary:
+		left := t.evalExpr(n.left, st)
+		switch n.op {
+		case "and":
+			return truth(left) && truth(t.evalExpr(n.right, st))
+		case "or":
+			return truth(left) || truth(t.evalExpr(n.right, st))
+		}
+		return compare(n.op, left, t.evalExpr(n.right, st))
+	}
+
+	return nil
+}
+
+// truth reports whether a value counts as true in an expression. False, zero, nil and
+// empty strings, slices and maps are false; everything else is true.
+func truth(value interface{}) bool {
+	v := indirect(reflect.ValueOf(value))
+	if !v.IsValid() {
+		return false
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() != 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() != 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() != 0
+	case reflect.String, reflect.Array, reflect.Slice, reflect.Map, reflect.Chan:
+		return v.Len() > 0
+	case reflect.Func:
+		return !v.IsNil()
+	}
+
+	return true
+}
+
+// compare applies a comparison operator. Two values are compared as numbers if both
+// can be read as numbers, so that the text of a query result can be compared with a
+// number; booleans are compared by their truth; anything else is compared as text.
+func compare(op string, left interface{}, right interface{}) bool {
+	var order int
+
+	leftNumber, leftIsNumber := exprNumber(left)
+	rightNumber, rightIsNumber := exprNumber(right)
+	_, leftIsBool := left.(bool)
+	_, rightIsBool := right.(bool)
+
+	switch {
+	case leftIsNumber && rightIsNumber:
+		if leftNumber < rightNumber {
+			order = -1
+		} else if leftNumber > rightNumber {
+			order = 1
+		}
+	case leftIsBool || rightIsBool:
+		if truth(left) != truth(right) {
+			order = 1
+		}
+	default:
+		order = strings.Compare(exprString(left), exprString(right))
+	}
+
+	switch op {
+	case "==":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	}
+
+	return order >= 0
+}
+
+// exprNumber gives a value as a number, if it is one or is text that can be read as one.
+func exprNumber(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.String:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v.String()), 64)
+		return number, err == nil
+	}
+
+	return 0, false
+}
+
+// exprString gives a value as text, as the default formatter would write it.
+func exprString(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+
+	return fmt.Sprint(value)
+}
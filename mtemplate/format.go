@@ -11,8 +11,11 @@ import (
 	"fmt"
 	"io"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
+
+	"github.com/adamcrossland/grog/markdown"
 )
 
 // FormatterFunc is the signature which a function intended to be an mtemplate
@@ -29,6 +32,10 @@ func StringFormatter(w io.Writer, format string, data *TemplateData, value ...in
 			w.Write(b)
 			return
 		}
+		if value[0] == nil {
+			// Such as a NULL column in the results of a named query
+			return
+		}
 	}
 	fmt.Fprint(w, value...)
 }
@@ -88,6 +95,9 @@ func HTMLFormatter(w io.Writer, format string, data *TemplateData, value ...inte
 	var b []byte
 	if len(value) == 1 {
 		b, ok = value[0].([]byte)
+		if value[0] == nil {
+			return
+		}
 	}
 	if !ok {
 		var buf bytes.Buffer
@@ -97,6 +107,13 @@ func HTMLFormatter(w io.Writer, format string, data *TemplateData, value ...inte
 	HTMLEscape(w, b)
 }
 
+// MarkdownFormatter renders a CommonMark-formatted value as HTML
+func MarkdownFormatter(w io.Writer, format string, data *TemplateData, value ...interface{}) {
+	var buf bytes.Buffer
+	StringFormatter(&buf, format, data, value...)
+	io.WriteString(w, markdown.Render(buf.String()))
+}
+
 // URLFormatter formats arbitrary values for inclusion in URL
 // paramters
 func URLFormatter(w io.Writer, format string, data *TemplateData, value ...interface{}) {
@@ -162,24 +179,32 @@ func PaginationFormatter(w io.Writer, format string, data *TemplateData, value .
 		showPage = 1
 	}
 
-	realData := value[0].([]map[string]string)
+	// Any slice can be paginated, such as the rows of a named query.
+	realData := reflect.ValueOf(value[0])
+	for realData.Kind() == reflect.Ptr || realData.Kind() == reflect.Interface {
+		realData = realData.Elem()
+	}
+	if realData.Kind() != reflect.Slice {
+		panic(fmt.Sprintf("paginationFormatter: cannot paginate a value of type %T", value[0]))
+	}
+	dataLength := int64(realData.Len())
 
 	// Calculate how many potential pages there are.
-	totalPages := int64(len(realData)) / pageSize
-	if int64(len(realData))%pageSize != 0 {
+	totalPages := dataLength / pageSize
+	if dataLength%pageSize != 0 {
 		totalPages++
 	}
 
 	dataOffset := (showPage - 1) * pageSize
-	resultCount := int64(len(realData[dataOffset:]))
+	if dataOffset > dataLength {
+		dataOffset = dataLength
+	}
+	resultCount := dataLength - dataOffset
 	if resultCount < pageSize {
 		pageSize = resultCount
 	}
 
-	paginatedData := make([]map[string]string, pageSize)
-
-	copy(paginatedData, realData[dataOffset:])
-	data.data[pageKey(key)] = paginatedData
+	data.data[pageKey(key)] = realData.Slice(int(dataOffset), int(dataOffset+pageSize)).Interface()
 
 	data.data[pageTotalPagesKey((key))] = totalPages
 
@@ -0,0 +1,167 @@
+package mtemplate
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The ways that a template can deal with a .model whose query cannot be run, because
+// the query does not exist, a parameter is missing or invalid, or the query fails.
+const (
+	// ModelErrorFail stops the template, and Execute returns the error.
+	ModelErrorFail = "fail"
+	// ModelErrorOr stores an empty set of results, so that the .or blocks of the
+	// sections that use them are executed, and stores the error's message under the
+	// results' name with "-error" added.
+	ModelErrorOr = "or"
+	// ModelErrorLog logs the error and goes on without storing any results.
+	ModelErrorLog = "log"
+)
+
+// DefaultModelErrorPolicy names the way that a failed .model is dealt with when the
+// TemplateData does not name one.
+var DefaultModelErrorPolicy = ModelErrorFail
+
+// NamedQueryExists can be set by the calling code to report whether a named query
+// exists, so that a .model for a query that does not can be found when the template
+// is parsed rather than when it is executed.
+var NamedQueryExists func(name string) bool
+
+// The types that a ModelParameter can have.
+const (
+	ParamString = "string"
+	ParamInt    = "int"
+	ParamFloat  = "float"
+	ParamBool   = "bool"
+)
+
+// ModelParameter is a parameter of a .model directive, written as
+// name[:type][?][=default]. Its value is taken from the form value of the request with
+// the same name and converted to its type. A parameter with neither a default nor a ?
+// is required; an optional one that the request does not give is passed as nil.
+type ModelParameter struct {
+	Name       string
+	Type       string
+	Default    string
+	HasDefault bool
+	Optional   bool
+}
+
+// ParseModelParameter reads the description of a parameter.
+func ParseModelParameter(spec string) (*ModelParameter, error) {
+	param := &ModelParameter{Type: ParamString}
+
+	if equals := strings.IndexByte(spec, '='); equals >= 0 {
+		param.Default = spec[equals+1:]
+		param.HasDefault = true
+		param.Optional = true
+		spec = spec[:equals]
+	}
+	if strings.HasSuffix(spec, "?") {
+		param.Optional = true
+		spec = spec[:len(spec)-1]
+	}
+	if colon := strings.IndexByte(spec, ':'); colon >= 0 {
+		param.Type = spec[colon+1:]
+		spec = spec[:colon]
+	}
+	param.Name = spec
+
+	if len(param.Name) == 0 {
+		return nil, fmt.Errorf("parameter %q has no name", spec)
+	}
+	switch param.Type {
+	case ParamString, ParamInt, ParamFloat, ParamBool:
+	default:
+		return nil, fmt.Errorf("parameter %s has unknown type %s", param.Name, param.Type)
+	}
+	if param.HasDefault {
+		if _, err := param.Convert(param.Default); err != nil {
+			return nil, fmt.Errorf("default for parameter %s: %v", param.Name, err)
+		}
+	}
+
+	return param, nil
+}
+
+// ParseModelParameters reads a list of parameters separated by spaces, such as the
+// Params of a NamedQuery.
+func ParseModelParameters(specs string) ([]*ModelParameter, error) {
+	var params []*ModelParameter
+
+	for _, spec := range strings.Fields(specs) {
+		param, paramErr := ParseModelParameter(spec)
+		if paramErr != nil {
+			return nil, paramErr
+		}
+		params = append(params, param)
+	}
+
+	return params, nil
+}
+
+// Convert turns the text of a value into the parameter's type.
+func (param *ModelParameter) Convert(value string) (interface{}, error) {
+	var converted interface{}
+	var err error
+
+	switch param.Type {
+	case ParamInt:
+		converted, err = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	case ParamFloat:
+		converted, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+	case ParamBool:
+		converted, err = strconv.ParseBool(strings.TrimSpace(value))
+	default:
+		converted = value
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid %s for parameter %s", value, param.Type, param.Name)
+	}
+
+	return converted, nil
+}
+
+// Value gives the parameter's value for a request. An empty value is replaced by the
+// default, if there is one; otherwise a parameter that the request gives, even as an
+// empty string, is not missing.
+func (param *ModelParameter) Value(r *http.Request) (interface{}, error) {
+	var value string
+	var given bool
+	if r != nil {
+		// FormValue parses the form, so r.Form holds the parameter if it was given.
+		value = r.FormValue(param.Name)
+		_, given = r.Form[param.Name]
+	}
+
+	if !given || (value == "" && param.HasDefault) {
+		switch {
+		case param.HasDefault:
+			value = param.Default
+		case param.Optional:
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("missing required parameter %s", param.Name)
+		}
+	}
+
+	return param.Convert(value)
+}
+
+// modelErrorPolicy gives the policy for a failed .model: the TemplateData's own, or
+// DefaultModelErrorPolicy if it has none.
+func (data *TemplateData) modelErrorPolicy() string {
+	if len(data.ModelErrorPolicy) > 0 {
+		return data.ModelErrorPolicy
+	}
+
+	return DefaultModelErrorPolicy
+}
+
+// modelErrorKey gives the name that a failed .model stores its error under, when the
+// policy is ModelErrorOr.
+func modelErrorKey(binding string) string {
+	return binding + "-error"
+}
@@ -0,0 +1,250 @@
+package mtemplate
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// SanitizePolicy lists the markup that survives sanitizing. Elements that are not
+// listed are removed but their contents are kept, except for elements such as script
+// and style whose contents are removed too. Attributes that are not listed for their
+// element, or globally, are removed, as are URLs whose scheme is not allowed.
+type SanitizePolicy struct {
+	Elements         map[string][]string // Allowed elements, with the attributes allowed on each
+	GlobalAttributes []string            // Attributes allowed on every allowed element
+	URLSchemes       []string            // Schemes allowed in URL attributes; relative URLs are always allowed
+	LinkRel          string              // If set, given as the rel attribute of every link
+}
+
+// SanitizePolicies holds the policies that the sanitize formatter can be asked for by
+// name. Calling code may add its own.
+//
+// "basic" suits markup from people who are not trusted, such as comments: simple
+// inline formatting, lists, quotes, code and links that search engines are told not
+// to follow. "relaxed" adds the structure that an article needs: headings, images,
+// tables and the like.
+var SanitizePolicies = map[string]*SanitizePolicy{
+	"basic": {
+		Elements: map[string][]string{
+			"a": {"href", "title"}, "b": nil, "blockquote": {"cite"}, "br": nil, "code": nil,
+			"em": nil, "i": nil, "li": nil, "ol": {"start"}, "p": nil, "pre": nil, "s": nil,
+			"strong": nil, "sub": nil, "sup": nil, "u": nil, "ul": nil,
+		},
+		URLSchemes: []string{"http", "https", "mailto"},
+		LinkRel:    "nofollow ugc",
+	},
+	"relaxed": {
+		Elements: map[string][]string{
+			"a": {"href", "title", "name"}, "abbr": {"title"}, "b": nil, "blockquote": {"cite"},
+			"br": nil, "caption": nil, "cite": nil, "code": nil, "dd": nil, "del": nil, "div": nil,
+			"dl": nil, "dt": nil, "em": nil, "figcaption": nil, "figure": nil, "h1": nil, "h2": nil,
+			"h3": nil, "h4": nil, "h5": nil, "h6": nil, "hr": nil, "i": nil,
+			"img": {"src", "alt", "title", "width", "height"}, "ins": nil, "kbd": nil, "li": nil,
+			"mark": nil, "ol": {"start"}, "p": nil, "pre": nil, "q": {"cite"}, "s": nil,
+			"small": nil, "span": nil, "strong": nil, "sub": nil, "sup": nil, "table": nil,
+			"tbody": nil, "td": {"colspan", "rowspan"}, "tfoot": nil, "th": {"colspan", "rowspan", "scope"},
+			"thead": nil, "tr": nil, "u": nil, "ul": nil,
+		},
+		GlobalAttributes: []string{"class", "id", "lang", "title"},
+		URLSchemes:       []string{"http", "https", "mailto", "tel"},
+	},
+}
+
+// DefaultSanitizePolicy names the policy that the sanitize formatter uses when neither
+// the template nor the TemplateData asks for another.
+var DefaultSanitizePolicy = "relaxed"
+
+// Elements whose contents are removed along with them.
+var sanitizeDropContents = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true, "embed": true,
+	"noscript": true, "template": true, "textarea": true, "title": true, "svg": true, "math": true,
+}
+
+// Elements that never have contents or an end tag.
+var sanitizeVoidElements = map[string]bool{
+	"area": true, "br": true, "col": true, "embed": true, "hr": true, "img": true, "input": true,
+	"source": true, "track": true, "wbr": true,
+}
+
+// Attributes whose values are URLs.
+var sanitizeURLAttributes = map[string]bool{
+	"href": true, "src": true, "cite": true, "action": true, "formaction": true,
+	"background": true, "poster": true, "longdesc": true,
+}
+
+var (
+	sanitizeStartTag  = regexp.MustCompile(`^<([a-zA-Z][a-zA-Z0-9-]*)((?:\s+[^\s"'>/=]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*)\s*/?>`)
+	sanitizeEndTag    = regexp.MustCompile(`^</([a-zA-Z][a-zA-Z0-9-]*)\s*>`)
+	sanitizeComment   = regexp.MustCompile(`^<!--[\s\S]*?-->`)
+	sanitizeDirective = regexp.MustCompile(`^<[!?][^>]*>`)
+	sanitizeAttribute = regexp.MustCompile(`([^\s"'>/=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+)
+
+// Sanitize removes everything from markup that the policy does not allow. The result
+// is well-formed: text is escaped and every element that is opened is closed.
+func (policy *SanitizePolicy) Sanitize(markup string) string {
+	var out strings.Builder
+	var open []string
+
+	for len(markup) > 0 {
+		tagStart := strings.IndexByte(markup, '<')
+		if tagStart < 0 {
+			out.WriteString(escapeText(markup))
+			break
+		}
+
+		out.WriteString(escapeText(markup[:tagStart]))
+		markup = markup[tagStart:]
+
+		if match := sanitizeStartTag.FindStringSubmatch(markup); match != nil {
+			markup = markup[len(match[0]):]
+			name := strings.ToLower(match[1])
+
+			if sanitizeDropContents[name] {
+				markup = skipElement(markup, name)
+				continue
+			}
+
+			allowedAttributes, allowed := policy.Elements[name]
+			if !allowed {
+				continue
+			}
+
+			out.WriteString("<" + name)
+			out.WriteString(policy.sanitizeAttributes(name, match[2], allowedAttributes))
+			if name == "a" && len(policy.LinkRel) > 0 {
+				out.WriteString(` rel="` + html.EscapeString(policy.LinkRel) + `"`)
+			}
+			out.WriteString(">")
+
+			if !sanitizeVoidElements[name] {
+				open = append(open, name)
+			}
+		} else if match := sanitizeEndTag.FindStringSubmatch(markup); match != nil {
+			markup = markup[len(match[0]):]
+			name := strings.ToLower(match[1])
+
+			// Close the element, and any left open inside it, if it is open at all.
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == name {
+					for j := len(open) - 1; j >= i; j-- {
+						out.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+		} else if match := sanitizeComment.FindString(markup); match != "" {
+			markup = markup[len(match):]
+		} else if match := sanitizeDirective.FindString(markup); match != "" {
+			markup = markup[len(match):]
+		} else {
+			out.WriteString("&lt;")
+			markup = markup[1:]
+		}
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i] + ">")
+	}
+
+	return out.String()
+}
+
+func (policy *SanitizePolicy) sanitizeAttributes(element string, attributes string, allowed []string) string {
+	var out strings.Builder
+	seen := make(map[string]bool)
+
+	for _, match := range sanitizeAttribute.FindAllStringSubmatch(attributes, -1) {
+		name := strings.ToLower(match[1])
+		if seen[name] || !(containsString(allowed, name) || containsString(policy.GlobalAttributes, name)) {
+			continue
+		}
+		seen[name] = true
+
+		value := html.UnescapeString(match[2] + match[3] + match[4])
+		if sanitizeURLAttributes[name] && !policy.allowedURL(value) {
+			continue
+		}
+
+		out.WriteString(" " + name + `="` + html.EscapeString(value) + `"`)
+	}
+
+	return out.String()
+}
+
+// allowedURL reports whether the URL is relative or has one of the allowed schemes.
+func (policy *SanitizePolicy) allowedURL(url string) bool {
+	// Browsers ignore whitespace and control characters in a scheme, so they must be
+	// ignored here too to see the scheme as a browser would.
+	cleaned := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, url)
+
+	colon := strings.IndexByte(cleaned, ':')
+	if colon < 0 || strings.ContainsAny(cleaned[:colon], "/?#") {
+		return true
+	}
+
+	return containsString(policy.URLSchemes, strings.ToLower(cleaned[:colon]))
+}
+
+// skipElement skips past the end tag of an element whose contents are being removed.
+func skipElement(markup string, name string) string {
+	endTag := strings.Index(strings.ToLower(markup), "</"+name)
+	if endTag < 0 {
+		return ""
+	}
+
+	markup = markup[endTag:]
+	if tagEnd := strings.IndexByte(markup, '>'); tagEnd >= 0 {
+		return markup[tagEnd+1:]
+	}
+
+	return ""
+}
+
+// escapeText escapes text, leaving entities that are already in it as they are.
+func escapeText(text string) string {
+	return html.EscapeString(html.UnescapeString(text))
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SanitizeFormatter removes markup that is not allowed by a SanitizePolicy, so that
+// HTML from untrusted sources can be included in a page. The policy can be named in
+// the template, as in {Body|sanitize basic}; otherwise the TemplateData's
+// SanitizePolicy is used, or DefaultSanitizePolicy if that is not set.
+func SanitizeFormatter(w io.Writer, format string, data *TemplateData, value ...interface{}) {
+	policyName := DefaultSanitizePolicy
+	if data != nil && len(data.SanitizePolicy) > 0 {
+		policyName = data.SanitizePolicy
+	}
+	if params := strings.Fields(format); len(params) > 1 {
+		policyName = params[1]
+	}
+
+	policy, found := SanitizePolicies[policyName]
+	if !found {
+		panic(&Error{Msg: fmt.Sprintf("sanitize formatter: no policy named %s", policyName)})
+	}
+
+	var buf bytes.Buffer
+	StringFormatter(&buf, format, data, value...)
+	io.WriteString(w, policy.Sanitize(buf.String()))
+}
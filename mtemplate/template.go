@@ -19,7 +19,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"reflect"
+	"sort"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -56,6 +58,13 @@ const (
 	tokBlock
 	tokInclude
 	tokModel
+	tokIf
+	tokElif
+	tokElse
+	tokLet
+	tokMacro
+	tokCall
+	tokImport
 )
 
 // FormatterMap is the type describing the mapping from formatter
@@ -64,12 +73,15 @@ type FormatterMap map[string]FormatterFunc
 
 // Built-in formatters.
 var builtins = FormatterMap{
-	"html":    HTMLFormatter,
-	"str":     StringFormatter,
-	"urlsafe": URLFormatter,
-	"int":     IntFormatter,
+	"html":     HTMLFormatter,
+	"str":      StringFormatter,
+	"urlsafe":  URLFormatter,
+	"int":      IntFormatter,
+	"markdown": MarkdownFormatter,
 	"paginate": PaginationFormatter,
-	"":        StringFormatter,
+	"raw":      RawFormatter,
+	"sanitize": SanitizeFormatter,
+	"":         StringFormatter,
 }
 
 // The parsed state of a template is a vector of xxxElement structs.
@@ -88,8 +100,32 @@ type literalElement struct {
 // A variable invocation to be evaluated
 type variableElement struct {
 	linenum int
-	word    []string // The fields in the invocation.
-	fmts    []string // Names of formatters to apply. len(fmts) > 0
+	word    []string      // The fields in the invocation.
+	fmts    []string      // Names of formatters to apply. len(fmts) > 0
+	escape  escapeFunc    // Escaper for the variable's context, if the template escapes automatically
+	ctx     escapeContext // The context that escape was chosen for
+}
+
+// A .let binding a name to the value of a variable
+type letElement struct {
+	name  string           // The name that is bound
+	value *variableElement // The fields and formatters that give the value
+}
+
+// A .macro definition
+type macroElement struct {
+	name   string        // The name that the macro is called by
+	params []string      // The names that the arguments of a call are bound to
+	elems  *elemlist     // The elements that a call executes
+	ctx    escapeContext // The context that the body is escaped for
+}
+
+// A .call of a macro
+type callElement struct {
+	linenum int
+	name    string        // The name of the macro
+	args    []exprNode    // Fields or literals, one for each parameter
+	ctx     escapeContext // The context that the call is made in
 }
 
 // A .section block, possibly with a .or
@@ -101,6 +137,20 @@ type sectionElement struct {
 	end     int    // one beyond last element
 }
 
+// An .if block, with any .elif and .else blocks that follow it
+type ifElement struct {
+	linenum  int        // of .if itself
+	branches []ifBranch // the .if block, then each .elif block, then any .else block
+	end      int        // one beyond last element
+}
+
+// One block of an .if
+type ifBranch struct {
+	cond  exprNode // nil for an .else block
+	start int      // first element
+	end   int      // one beyond last element
+}
+
 // A .repeated block, possibly with a .or and a .alternates
 type repeatedElement struct {
 	sectionElement     // It has the same structure...
@@ -133,21 +183,37 @@ type includeElement struct {
 }
 
 type modelElement struct {
-	modelName  string   // The name of the saved query to execute
-	parameters []string // The parameters to be passed to the prepared query
+	linenum    int
+	modelName  string            // The name of the saved query to execute
+	binding    string            // The name that the results are stored under
+	stream     bool              // Whether the rows are read as they are repeated
+	parameters []*ModelParameter // The parameters to be passed to the prepared query
 }
 
+// defaultModelBinding is the name that a .model stores its results under, unless it
+// is given another with as.
+const defaultModelBinding = "model"
+
 // Template is the type that represents a template definition.
 // It is unchanged after parsing.
 type Template struct {
 	fmap FormatterMap // formatters for variables
+	// AutoEscape makes the template escape every variable to suit where it appears
+	// in the HTML: text, an attribute, a URL, a script or a style. It must be set
+	// before the template is parsed.
+	AutoEscape bool
 	// Used during parsing:
-	ldelim, rdelim []byte // delimiters; default {}
-	buf            []byte // input text to process
-	p              int    // position in buf
-	linenum        int    // position in input
+	ldelim, rdelim []byte        // delimiters; default {}
+	buf            []byte        // input text to process
+	p              int           // position in buf
+	linenum        int           // position in input
+	lineEnded      bool          // the last item ended its line
+	escapeCtx      escapeContext // position in the HTML, when escaping automatically
 	// Parsed results:
-	elems *elemlist
+	elems     *elemlist
+	macros    map[string]*macroElement // defined in the template or imported into it
+	calls     []*callElement           // checked against macros once parsing is done
+	importing []string                 // files whose parsing led to this one, to find import cycles
 	// mtemplate:
 	// Used during execution
 	parent    *parentElement
@@ -164,6 +230,8 @@ func (t Template) clone() (copyT *Template) {
 	copyT.childData = t.childData
 	copyT.blockData = t.blockData
 	copyT.fmap = t.fmap
+	copyT.AutoEscape = t.AutoEscape
+	copyT.macros = t.macros
 
 	return copyT
 }
@@ -172,10 +240,22 @@ func (t Template) clone() (copyT *Template) {
 // the data item descends into the fields associated with sections, etc.
 // Parent is used to walk upwards to find variables higher in the tree.
 type state struct {
-	parent *state          // parent in hierarchy
-	data   reflect.Value   // the driver data for this section etc.
-	wr     io.Writer       // where to send output
-	buf    [2]bytes.Buffer // alternating buffers used when chaining formatters
+	parent *state                   // parent in hierarchy
+	data   reflect.Value            // the driver data for this section etc.
+	wr     io.Writer                // where to send output
+	buf    [2]bytes.Buffer          // alternating buffers used when chaining formatters
+	vars   map[string]reflect.Value // names bound by .let in this section etc.
+	fmts   map[string][]string      // the formatters that gave names bound to formatted text
+	loop   *loopState               // the iteration of a .repeated section, if this is one
+	calls  int                      // how many .calls deep this is
+}
+
+// Where a .repeated section has got to, for the loop variables.
+type loopState struct {
+	index  int           // 0 for the first item
+	length int           // number of items, or -1 if it is not known
+	last   bool          // whether this is the last item
+	key    reflect.Value // map key, or index of an array, slice or iterator
 }
 
 // mtemplate: caching of parsed template files is all custom.
@@ -186,7 +266,7 @@ func init() {
 }
 
 func (parent *state) clone(data reflect.Value) *state {
-	return &state{parent: parent, data: data, wr: parent.wr}
+	return &state{parent: parent, data: data, wr: parent.wr, calls: parent.calls}
 }
 
 // New creates a new template with the specified formatter map (which
@@ -194,9 +274,11 @@ func (parent *state) clone(data reflect.Value) *state {
 func New(fmap FormatterMap) *Template {
 	t := new(Template)
 	t.fmap = fmap
+	t.AutoEscape = AutoEscape
 	t.ldelim = lbrace
 	t.rdelim = rbrace
 	t.elems = NewElemlist()
+	t.macros = make(map[string]*macroElement)
 	// mtemplate:
 	t.childData = make(map[string]*bytes.Buffer)
 	t.blockData = make(map[string]*bytes.Buffer)
@@ -214,6 +296,21 @@ func (t *Template) parseError(err string, args ...interface{}) {
 	panic(&Error{t.linenum, fmt.Sprintf(err, args...)})
 }
 
+// joinContexts is given the contexts that the branches of a block end in. Any of them
+// may be the one that is executed, so when the template escapes automatically they
+// must all leave the HTML in the same place, which is where parsing goes on from.
+func (t *Template) joinContexts(block string, ends []escapeContext) {
+	if !t.AutoEscape {
+		return
+	}
+	for _, ctx := range ends[1:] {
+		if ctx.canonical() != ends[0].canonical() {
+			t.parseError("the branches of %s end in different places in the HTML", block)
+		}
+	}
+	t.escapeCtx = ends[0]
+}
+
 // Is this an exported - upper case - name?
 func isExported(name string) bool {
 	rune, _ := utf8.DecodeRuneInString(name)
@@ -246,6 +343,10 @@ func equal(s []byte, n int, t []byte) bool {
 // Action tokens on a line by themselves drop any space on
 // either side, up to and including the newline.
 func (t *Template) nextItem() []byte {
+	if t.lineEnded {
+		t.linenum++
+		t.lineEnded = false
+	}
 	startOfLine := t.p == 0 || t.buf[t.p-1] == '\n'
 	start := t.p
 	var i int
@@ -295,8 +396,10 @@ func (t *Template) nextItem() []byte {
 					// It's special and the first thing on the line. Is it the last?
 					for j := right; j < len(t.buf) && white(t.buf[j]); j++ {
 						if t.buf[j] == '\n' {
-							// Yes it is. Drop the surrounding space and return the {.foo}
-							t.linenum++
+							// Yes it is. Drop the surrounding space and return the {.foo}.
+							// The line is counted when the next item is read, so that
+							// errors in this one are reported on its own line.
+							t.lineEnded = true
 							t.p = j + 1
 							return t.buf[left:right]
 						}
@@ -354,33 +457,18 @@ func words(buf []byte) []string {
 }
 
 // Turn a byte array into an array of strings, special variable-parsing rules.
+// Formatters, which may have space-separated parameters of their own, run from
+// the first pipe symbol to the end and are kept with the last field.
 func varWords(buf []byte) []string {
-	foundBar := false
+	formatters := ""
+	if bar := bytes.IndexByte(buf, '|'); bar >= 0 {
+		formatters = strings.TrimSpace(string(buf[bar:]))
+		buf = buf[:bar]
+	}
 
-	s := make([]string, 0, 5)
-	p := 0 // position in buf
-	// one word per loop
-	for i := 0; ; i++ {
-		// skip white space
-		for ; p < len(buf) && white(buf[p]); p++ {
-		}
-		// grab word
-		start := p
-		if !foundBar {
-			for ; p < len(buf) && !white(buf[p]) && buf[p] != '|'; p++ {
-			}
-			if p < len(buf) && buf[p] == '|' {
-				foundBar = true
-			}
-			s = append(s, string(buf[start:p]))
-		} else {
-			p = len(buf) - 1
-			s = append(s, string(buf[start:]))
-			break
-		}
-		if start == p { // no text left
-			break
-		}
+	s := words(buf)
+	if len(s) > 0 {
+		s[len(s)-1] += formatters
 	}
 
 	return s
@@ -482,6 +570,52 @@ func (t *Template) analyze(item []byte) (tok int, w []string) {
 		}
 		tok = tokInclude
 		return
+	case ".if", ".elif":
+		// The expression is parsed from the text as written, so that the white
+		// space in its strings is kept.
+		expr := strings.TrimSpace(string(item[len(t.ldelim) : len(item)-len(t.rdelim)]))
+		expr = strings.TrimSpace(expr[len(w[0]):])
+		if len(expr) == 0 {
+			t.parseError("%s must include an expression", w[0])
+			return
+		}
+		w = []string{w[0], expr}
+		tok = tokIf
+		if w[0] == ".elif" {
+			tok = tokElif
+		}
+		return
+	case ".else":
+		tok = tokElse
+		return
+	case ".let":
+		if len(w) < 4 || w[2] != "=" {
+			t.parseError("incorrect fields for .let: %s", item)
+			return
+		}
+		tok = tokLet
+		return
+	case ".macro":
+		if len(w) < 2 {
+			t.parseError(".macro must include a name")
+			return
+		}
+		tok = tokMacro
+		return
+	case ".call":
+		if len(w) < 2 {
+			t.parseError(".call must include the name of a macro")
+			return
+		}
+		tok = tokCall
+		return
+	case ".import":
+		if len(w) != 2 {
+			t.parseError(".import must specify the name of a file to import macros from")
+			return
+		}
+		tok = tokImport
+		return
 	case ".model":
 		 if len(w) < 2 {
 			 t.parseError(".model must include the name of a query to execute")
@@ -509,6 +643,31 @@ func (t *Template) formatter(name string) FormatterFunc {
 
 // Allocate a new variable-evaluation element.
 func (t *Template) newVariable(words []string) *variableElement {
+	v := t.parseVariable(words)
+	if t.AutoEscape {
+		// The last formatter may already escape its output well enough for the context,
+		// and a raw formatter anywhere in the chain turns escaping off.
+		v.ctx = t.escapeCtx
+		v.escape = variableEscaper(t.escapeCtx, v.fmts)
+		t.escapeCtx = t.escapeCtx.afterVariable()
+	}
+
+	return v
+}
+
+// variableEscaper gives the escaper for a variable with the given formatters in a
+// context, or nil if its output can be written as it is.
+func variableEscaper(ctx escapeContext, fmts []string) escapeFunc {
+	for _, f := range fmts {
+		if strings.Split(f, " ")[0] == "raw" {
+			return nil
+		}
+	}
+	return ctx.escaper(strings.Split(fmts[len(fmts)-1], " ")[0])
+}
+
+// Parse the fields and formatters of a variable.
+func (t *Template) parseVariable(words []string) *variableElement {
 	// After the final space-separated argument, formatters may be specified separated
 	// by pipe symbols, for example: {a b c|d|e}
 
@@ -533,7 +692,7 @@ func (t *Template) newVariable(words []string) *variableElement {
 		}
 	}
 
-	return &variableElement{t.linenum, words, formatters}
+	return &variableElement{linenum: t.linenum, word: words, fmts: formatters}
 }
 
 // Grab the next item.  If it's simple, just append it to the template.
@@ -546,20 +705,28 @@ func (t *Template) parseSimple(item []byte, elems *elemlist) (done bool, tok int
 		return
 	case tokText:
 		elems.Push(&textElement{item})
+		if t.AutoEscape {
+			t.escapeCtx = t.escapeCtx.advance(item)
+		}
 		return
 	case tokLiteral:
+		var literal []byte
 		switch w[0] {
 		case ".meta-left":
-			elems.Push(&literalElement{t.ldelim})
+			literal = t.ldelim
 		case ".meta-right":
-			elems.Push(&literalElement{t.rdelim})
+			literal = t.rdelim
 		case ".space":
-			elems.Push(&literalElement{space})
+			literal = space
 		case ".tab":
-			elems.Push(&literalElement{tab})
+			literal = tab
 		default:
 			t.parseError("internal error: unknown literal: %s", w[0])
 		}
+		elems.Push(&literalElement{literal})
+		if t.AutoEscape {
+			t.escapeCtx = t.escapeCtx.advance(literal)
+		}
 		return
 	case tokVariable:
 		// Need to strip the leading ! off of our variable declaration.
@@ -585,10 +752,14 @@ func (t *Template) parseRepeated(words []string, elems *elemlist) *repeatedEleme
 	r.linenum = t.linenum
 	r.field = words[2]
 	// Scan section, collecting true and false (.or) blocks.
-	r.start = t.elems.Len()
+	r.start = elems.Len()
 	r.or = -1
 	r.altstart = -1
 	r.altend = -1
+	// Each block starts where the section does, and must end there too, since the
+	// body can be executed any number of times.
+	start := t.escapeCtx
+	ends := []escapeContext{start}
 Loop:
 	for {
 		item := t.nextItem()
@@ -610,10 +781,20 @@ Loop:
 			}
 			r.altend = elems.Len()
 			r.or = elems.Len()
+			ends = append(ends, t.escapeCtx)
+			t.escapeCtx = start
 		case tokSection:
 			t.parseSection(w, elems)
 		case tokRepeated:
 			t.parseRepeated(w, elems)
+		case tokIf:
+			t.parseIf(w, elems)
+		case tokLet:
+			t.parseLet(item, w, elems)
+		case tokCall:
+			t.parseCall(item, w, elems)
+		case tokElif, tokElse:
+			t.parseError("%s not in .if", w[0])
 		case tokAlternates:
 			if r.altstart >= 0 {
 				t.parseError("extra .alternates in .repeated section")
@@ -624,6 +805,8 @@ Loop:
 				break Loop
 			}
 			r.altstart = elems.Len()
+			ends = append(ends, t.escapeCtx)
+			t.escapeCtx = start
 		default:
 			t.parseError("internal error: unknown repeated section item: %s", item)
 			break Loop
@@ -633,6 +816,7 @@ Loop:
 		r.altend = elems.Len()
 	}
 	r.end = elems.Len()
+	t.joinContexts(".repeated section "+r.field, append(ends, t.escapeCtx))
 	return r
 }
 
@@ -672,6 +856,9 @@ func (t *Template) parseInclude(words []string, elems *elemlist) {
 		// used to provide this file. That could greatly improve performance.
 		tempTemplate := MustParseFile(newInclude.fileName, nil)
 		newInclude.elems = tempTemplate.elems
+		for name, m := range tempTemplate.macros {
+			t.macros[name] = m
+		}
 		elems.Push(newInclude)
 	}
 }
@@ -679,8 +866,37 @@ func (t *Template) parseInclude(words []string, elems *elemlist) {
 func (t *Template) parseModel(words []string, elems *elemlist) {
 	if len(words) >= 2 {
 		newModel := new(modelElement)
+		newModel.linenum = t.linenum
 		newModel.modelName = words[1]
-		newModel.parameters = words[2:]
+		newModel.binding = defaultModelBinding
+		paramSpecs := words[2:]
+
+		if NamedQueryExists != nil && !NamedQueryExists(newModel.modelName) {
+			t.parseError(".model: no named query %s", newModel.modelName)
+		}
+
+		// {.model query as name ...} stores the results under name.
+		if len(words) >= 3 && words[2] == "as" {
+			if len(words) < 4 || strings.ContainsAny(words[3], ".*@|=") {
+				t.parseError(".model %s as must be followed by a name for the results", words[1])
+			}
+			newModel.binding = words[3]
+			paramSpecs = words[4:]
+		}
+
+		// {.model query ... stream ...} leaves the rows to be read as they are repeated.
+		if len(paramSpecs) > 0 && paramSpecs[0] == "stream" {
+			newModel.stream = true
+			paramSpecs = paramSpecs[1:]
+		}
+
+		for _, spec := range paramSpecs {
+			param, paramErr := ParseModelParameter(spec)
+			if paramErr != nil {
+				t.parseError(".model %s: %v", newModel.modelName, paramErr)
+			}
+			newModel.parameters = append(newModel.parameters, param)
+		}
 
 		elems.Push(newModel)
 	}
@@ -692,8 +908,11 @@ func (t *Template) parseSection(words []string, elems *elemlist) *sectionElement
 	s.linenum = t.linenum
 	s.field = words[1]
 	// Scan section, collecting true and false (.or) blocks.
-	s.start = t.elems.Len()
+	s.start = elems.Len()
 	s.or = -1
+	// The .or block starts where the section does.
+	start := t.escapeCtx
+	var ends []escapeContext
 Loop:
 	for {
 		item := t.nextItem()
@@ -714,10 +933,20 @@ Loop:
 				break Loop
 			}
 			s.or = elems.Len()
+			ends = append(ends, t.escapeCtx)
+			t.escapeCtx = start
 		case tokSection:
 			t.parseSection(w, elems)
 		case tokRepeated:
 			t.parseRepeated(w, elems)
+		case tokIf:
+			t.parseIf(w, elems)
+		case tokLet:
+			t.parseLet(item, w, elems)
+		case tokCall:
+			t.parseCall(item, w, elems)
+		case tokElif, tokElse:
+			t.parseError("%s not in .if", w[0])
 		case tokAlternates:
 			t.parseError(".alternates not in .repeated")
 		case tokInclude:
@@ -727,13 +956,117 @@ Loop:
 		}
 	}
 	s.end = elems.Len()
+	ends = append(ends, t.escapeCtx)
+	if s.or < 0 {
+		// Without a .or, nothing is written when the field is empty.
+		ends = append(ends, start)
+	}
+	t.joinContexts(".section "+s.field, ends)
 	return s
 }
 
-func (t *Template) parse(elems *elemlist, exitOnEnd bool) {
+func (t *Template) parseLet(item []byte, words []string, elems *elemlist) {
+	name := words[1]
+	if strings.ContainsAny(name, ".*@|") {
+		t.parseError("bad name for .let: %s", name)
+	}
+
+	// The value is parsed from the text after the = as a variable is, so that
+	// formatters keep their parameters.
+	text := item[len(t.ldelim) : len(item)-len(t.rdelim)]
+	w := varWords(text[bytes.IndexByte(text, '=')+1:])
+	if len(w) == 0 {
+		t.parseError(".let %s has no value", name)
+	}
+	elems.Push(&letElement{name, t.parseVariable(w)})
+}
+
+func (t *Template) parseMacro(words []string) {
+	m := &macroElement{name: words[1], params: words[2:], elems: NewElemlist()}
+	if _, found := t.macros[m.name]; found {
+		t.parseError("macro %s is already defined", m.name)
+	}
+	for _, param := range m.params {
+		if strings.ContainsAny(param, ".*@|") {
+			t.parseError("bad parameter name for .macro %s: %s", m.name, param)
+		}
+	}
+	// The body is escaped for HTML text, wherever the macro is defined, and writes
+	// nothing where it is defined.
+	outer := t.escapeCtx
+	t.escapeCtx = m.ctx
+	t.parse(m.elems, true)
+	if t.AutoEscape && t.escapeCtx.canonical() != m.ctx.canonical() {
+		t.parseError("macro %s must end in the place in the HTML that it starts in", m.name)
+	}
+	t.escapeCtx = outer
+	t.macros[m.name] = m
+}
+
+func (t *Template) parseCall(item []byte, words []string, elems *elemlist) {
+	c := &callElement{linenum: t.linenum, name: words[1], ctx: t.escapeCtx}
+
+	// The arguments are read as the operands of an expression would be, from the
+	// text as written so that the white space in strings is kept.
+	text := strings.TrimSpace(string(item[len(t.ldelim) : len(item)-len(t.rdelim)]))
+	text = strings.TrimSpace(strings.TrimSpace(text[len(words[0]):])[len(c.name):])
+	p := &exprParser{t: t, text: text}
+	p.tokenize()
+	for p.pos < len(p.tokens) {
+		c.args = append(c.args, p.parseOperand())
+	}
+
+	elems.Push(c)
+	t.calls = append(t.calls, c)
+}
+
+func (t *Template) parseImport(words []string) {
+	for _, filename := range t.importing {
+		if filename == words[1] {
+			t.parseError("import cycle: %s", strings.Join(append(t.importing, words[1]), " imports "))
+		}
+	}
+	imported, err := parseFile(words[1], t.fmap, t.importing)
+	if err != nil {
+		t.parseError("cannot import %s: %v", words[1], err)
+	}
+	for name, m := range imported.macros {
+		t.macros[name] = m
+	}
+}
+
+// checkCalls reports the first .call of a macro that has not been defined or
+// imported, or that is given more arguments than the macro has parameters.
+func (t *Template) checkCalls() {
+	for _, c := range t.calls {
+		m, found := t.macros[c.name]
+		if !found {
+			panic(&Error{c.linenum, fmt.Sprintf("no macro named %s", c.name)})
+		}
+		if len(c.args) > len(m.params) {
+			panic(&Error{c.linenum, fmt.Sprintf("too many arguments for macro %s", c.name)})
+		}
+		if t.AutoEscape && c.ctx.canonical() != m.ctx.canonical() {
+			panic(&Error{c.linenum, fmt.Sprintf("macro %s is escaped for HTML text, and cannot be called here", c.name)})
+		}
+	}
+}
+
+func (t *Template) parseIf(words []string, elems *elemlist) *ifElement {
+	e := new(ifElement)
+	elems.Push(e)
+	e.linenum = t.linenum
+	// Scan the blocks, each of which ends where the next begins.
+	e.branches = append(e.branches, ifBranch{cond: t.parseExpr(words[1]), start: elems.Len()})
+	hasElse := false
+	// Each block starts where the .if does.
+	start := t.escapeCtx
+	var ends []escapeContext
+Loop:
 	for {
 		item := t.nextItem()
 		if len(item) == 0 {
+			t.parseError("missing .end for .if")
 			break
 		}
 		done, tok, w := t.parseSimple(item, elems)
@@ -741,12 +1074,81 @@ func (t *Template) parse(elems *elemlist, exitOnEnd bool) {
 			continue
 		}
 		switch tok {
+		case tokEnd:
+			break Loop
+		case tokElif, tokElse:
+			if hasElse {
+				t.parseError("%s after .else in .if", w[0])
+				break Loop
+			}
+			e.branches[len(e.branches)-1].end = elems.Len()
+			branch := ifBranch{start: elems.Len()}
+			if tok == tokElif {
+				branch.cond = t.parseExpr(w[1])
+			} else {
+				hasElse = true
+			}
+			e.branches = append(e.branches, branch)
+			ends = append(ends, t.escapeCtx)
+			t.escapeCtx = start
+		case tokSection:
+			t.parseSection(w, elems)
+		case tokRepeated:
+			t.parseRepeated(w, elems)
+		case tokIf:
+			t.parseIf(w, elems)
+		case tokLet:
+			t.parseLet(item, w, elems)
+		case tokCall:
+			t.parseCall(item, w, elems)
 		case tokOr, tokAlternates:
+			t.parseError("%s not in .section or .repeated", w[0])
+		case tokInclude:
+			t.parseInclude(w, elems)
+		case tokModel:
+			t.parseModel(w, elems)
+		default:
+			t.parseError("internal error: unknown .if item: %s", item)
+		}
+	}
+	e.end = elems.Len()
+	e.branches[len(e.branches)-1].end = e.end
+	ends = append(ends, t.escapeCtx)
+	if !hasElse {
+		// Without a .else, nothing is written when no condition is true.
+		ends = append(ends, start)
+	}
+	t.joinContexts(".if", ends)
+	return e
+}
+
+func (t *Template) parse(elems *elemlist, exitOnEnd bool) {
+	for {
+		item := t.nextItem()
+		if len(item) == 0 {
+			break
+		}
+		done, tok, w := t.parseSimple(item, elems)
+		if done {
+			continue
+		}
+		switch tok {
+		case tokOr, tokAlternates, tokElif, tokElse:
 			t.parseError("unexpected %s", w[0])
+		case tokMacro:
+			t.parseMacro(w)
+		case tokImport:
+			t.parseImport(w)
 		case tokSection:
 			t.parseSection(w, elems)
 		case tokRepeated:
 			t.parseRepeated(w, elems)
+		case tokIf:
+			t.parseIf(w, elems)
+		case tokLet:
+			t.parseLet(item, w, elems)
+		case tokCall:
+			t.parseCall(item, w, elems)
 			// mtemplate:
 		case tokParent:
 			t.parseParentPage(w)
@@ -800,7 +1202,10 @@ func (t *Template) lookup(st *state, v reflect.Value, name string) reflect.Value
 			}
 			return av.FieldByName(name)
 		case reflect.Map:
-			if v := av.MapIndex(reflect.ValueOf(name)); v.IsValid() {
+			if typ.Key().Kind() != reflect.String {
+				return reflect.Zero(typ.Elem())
+			}
+			if v := av.MapIndex(reflect.ValueOf(name).Convert(typ.Key())); v.IsValid() {
 				return v
 			}
 			return reflect.Zero(typ.Elem())
@@ -859,7 +1264,14 @@ func (t *Template) findVar(st *state, s string) reflect.Value {
 	if s == "@" {
 		return indirectPtr(data, numStars)
 	}
-	for _, elem := range strings.Split(s, ".") {
+	elems := strings.Split(s, ".")
+	if local, found := st.local(elems[0]); found {
+		data = local
+		elems = elems[1:]
+	} else if strings.HasPrefix(s, "@") {
+		return reflect.Value{}
+	}
+	for _, elem := range elems {
 		// Look up field; data must be a struct or map.
 		data = t.lookup(st, data, elem)
 		if !data.IsValid() {
@@ -869,6 +1281,52 @@ func (t *Template) findVar(st *state, s string) reflect.Value {
 	return indirectPtr(data, numStars)
 }
 
+// letFormatters gives the formatters that made the text a name is bound to by .let,
+// and reports whether it is bound to formatted text.
+func (st *state) letFormatters(name string) ([]string, bool) {
+	for ; st != nil; st = st.parent {
+		if _, found := st.vars[name]; found {
+			fmts, formatted := st.fmts[name]
+			return fmts, formatted
+		}
+	}
+	return nil, false
+}
+
+// local finds a name bound by .let, or a loop variable, in this state or the ones
+// that enclose it. @root is the data at the top level of the template, where .model
+// stores its results.
+func (st *state) local(name string) (reflect.Value, bool) {
+	if name == "@root" {
+		for st.parent != nil {
+			st = st.parent
+		}
+		return st.data, true
+	}
+	for ; st != nil; st = st.parent {
+		if value, found := st.vars[name]; found {
+			return value, true
+		}
+		if st.loop == nil {
+			continue
+		}
+		switch name {
+		case "@index":
+			return reflect.ValueOf(st.loop.index), true
+		case "@first":
+			return reflect.ValueOf(st.loop.index == 0), true
+		case "@last":
+			return reflect.ValueOf(st.loop.last), true
+		case "@length":
+			return reflect.ValueOf(st.loop.length), true
+		case "@key":
+			return st.loop.key, true
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
 // Is there no data to look at?
 func empty(v reflect.Value) bool {
 	v = indirect(v)
@@ -918,7 +1376,7 @@ func (t *Template) format(wr io.Writer, fmt string, val []interface{}, v *variab
 
 // Evaluate a variable, looking up through the parent if necessary.
 // If it has a formatter attached ({var|formatter}) run that too.
-func (t *Template) writeVariable(v *variableElement, st *state, data *TemplateData) {
+func (t *Template) writeVariable(wr io.Writer, v *variableElement, st *state, data *TemplateData) {
 	// Turn the words of the invocation into values.
 
 	val := make([]interface{}, len(v.word))
@@ -926,6 +1384,7 @@ func (t *Template) writeVariable(v *variableElement, st *state, data *TemplateDa
 		val[i] = t.varValue(word, st).Interface()
 	}
 
+	values := val
 	for i, fmat := range v.fmts[:len(v.fmts)-1] {
 		b := &st.buf[i&1]
 		b.Reset()
@@ -933,7 +1392,56 @@ func (t *Template) writeVariable(v *variableElement, st *state, data *TemplateDa
 		val = val[0:1]
 		val[0] = b.Bytes()
 	}
-	t.format(st.wr, v.fmts[len(v.fmts)-1], val, v, st, data)
+	escape := v.escape
+	if escape != nil && len(v.word) == 1 && len(v.fmts) == 1 && v.fmts[0] == "" {
+		// A name bound by .let to formatted text is escaped as its formatters were.
+		if fmts, found := st.letFormatters(v.word[0]); found {
+			escape = variableEscaper(v.ctx, fmts)
+		}
+	}
+	if escape == nil {
+		t.format(wr, v.fmts[len(v.fmts)-1], val, v, st, data)
+		return
+	}
+
+	// The escaper is given the original values when no formatter has changed them, so
+	// that it can tell a number from a string.
+	if len(v.fmts) > 1 || len(v.fmts[0]) > 0 {
+		values = nil
+	}
+	var formatted bytes.Buffer
+	t.format(&formatted, v.fmts[len(v.fmts)-1], val, v, st, data)
+	io.WriteString(wr, escape(formatted.String(), values))
+}
+
+// Execute a .let, binding the name in the current section. A value given by a single
+// field with no formatter is bound as it is, so that it can drive a section; otherwise
+// the formatted text is bound, along with its formatters, so that it is not escaped
+// again when it is written out.
+func (t *Template) executeLet(l *letElement, st *state, data *TemplateData) {
+	var value reflect.Value
+	var fmts []string
+	if len(l.value.word) == 1 && len(l.value.fmts) == 1 && l.value.fmts[0] == "" {
+		value = t.varValue(l.value.word[0], st)
+	} else {
+		var formatted bytes.Buffer
+		t.writeVariable(&formatted, l.value, st, data)
+		value = reflect.ValueOf(formatted.String())
+		fmts = l.value.fmts
+	}
+
+	if st.vars == nil {
+		st.vars = make(map[string]reflect.Value)
+	}
+	st.vars[l.name] = value
+	if fmts == nil {
+		delete(st.fmts, l.name)
+		return
+	}
+	if st.fmts == nil {
+		st.fmts = make(map[string][]string)
+	}
+	st.fmts[l.name] = fmts
 }
 
 // Execute element i.  Return next index to execute.
@@ -946,7 +1454,13 @@ func (t *Template) executeElement(elems *elemlist, i int, st *state, data *Templ
 		st.wr.Write(elem.text)
 		return i + 1
 	case *variableElement:
-		t.writeVariable(elem, st, data)
+		t.writeVariable(st.wr, elem, st, data)
+		return i + 1
+	case *letElement:
+		t.executeLet(elem, st, data)
+		return i + 1
+	case *callElement:
+		t.executeCall(elem, st, data)
 		return i + 1
 	case *sectionElement:
 		t.executeSection(elems, elem, st, data)
@@ -954,6 +1468,9 @@ func (t *Template) executeElement(elems *elemlist, i int, st *state, data *Templ
 	case *repeatedElement:
 		t.executeRepeated(elems, elem, st, data)
 		return elem.end
+	case *ifElement:
+		t.executeIf(elems, elem, st, data)
+		return elem.end
 	// mtemplate:
 	case *childElement:
 		if blockBuffer, ok := t.childData[elem.name]; ok {
@@ -962,7 +1479,7 @@ func (t *Template) executeElement(elems *elemlist, i int, st *state, data *Templ
 		return i + 1
 	case *blockElement:
 		blockBuffer := new(bytes.Buffer)
-		t.execute(elem.elems, &state{parent: st.parent, data: st.data, wr: blockBuffer}, data)
+		t.execute(elem.elems, &state{parent: st.parent, data: st.data, wr: blockBuffer, calls: st.calls}, data)
 		t.blockData[elem.name] = blockBuffer
 
 		return i + 1
@@ -1013,14 +1530,74 @@ func (t *Template) executeSection(elems *elemlist, s *sectionElement, st *state,
 	}
 }
 
+// Execute a .call. The macro's elements are executed at the cursor of the call, with
+// its parameters bound to the values of the arguments; parameters that are not given
+// an argument are bound to the empty string.
+func (t *Template) executeCall(c *callElement, st *state, data *TemplateData) {
+	m, found := t.macros[c.name]
+	if !found {
+		t.execError(st, c.linenum, "no macro named %s", c.name)
+	}
+	if st.calls >= MaxCallDepth {
+		t.execError(st, c.linenum, "macro %s: calls nested more than %d deep", c.name, MaxCallDepth)
+	}
+
+	callst := st.clone(st.data)
+	callst.calls = st.calls + 1
+	callst.vars = make(map[string]reflect.Value)
+	for i, param := range m.params {
+		value := reflect.ValueOf("")
+		if i < len(c.args) {
+			if arg := reflect.ValueOf(t.evalExpr(c.args[i], st)); arg.IsValid() {
+				value = arg
+			}
+		}
+		callst.vars[param] = value
+	}
+
+	for i := 0; i < m.elems.Len(); {
+		i = t.executeElement(m.elems, i, callst, data)
+	}
+}
+
+// Execute an .if, running the first block whose expression is true, or the .else
+// block if none is.
+func (t *Template) executeIf(elems *elemlist, e *ifElement, st *state, data *TemplateData) {
+	for _, branch := range e.branches {
+		if branch.cond == nil || truth(t.evalExpr(branch.cond, st)) {
+			for i := branch.start; i < branch.end; {
+				i = t.executeElement(elems, i, st, data)
+			}
+			return
+		}
+	}
+}
+
+// sortedKeys gives the keys of a map in order: numerically for numbers, and by their
+// text for anything else.
+func sortedKeys(m reflect.Value) []reflect.Value {
+	keys := m.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := indirect(keys[i]), indirect(keys[j])
+		if aNumber, ok := exprNumber(a.Interface()); ok && a.Kind() != reflect.String {
+			if bNumber, ok := exprNumber(b.Interface()); ok && b.Kind() != reflect.String {
+				return aNumber < bNumber
+			}
+		}
+		return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+	})
+
+	return keys
+}
+
 // Return the result of calling the Iter method on v, or nil.
 func iter(v reflect.Value) reflect.Value {
 	for j := 0; j < v.Type().NumMethod(); j++ {
 		mth := v.Type().Method(j)
 		fv := v.Method(j)
 		ft := fv.Type()
-		// TODO(rsc): NumIn() should return 0 here, because ft is from a curried FuncValue.
-		if mth.Name != "Iter" || ft.NumIn() != 1 || ft.NumOut() != 1 {
+		// ft is from a method value, so the receiver is not among its inputs.
+		if mth.Name != "Iter" || ft.NumIn() != 0 || ft.NumOut() != 1 {
 			continue
 		}
 		ct := ft.Out(0)
@@ -1041,6 +1618,11 @@ func (t *Template) executeRepeated(elems *elemlist, r *repeatedElement, st *stat
 	if !field.IsValid() {
 		t.execError(st, r.linenum, ".repeated: cannot find field %s in %s", r.field, st.data.Type())
 	}
+	// An Iter method may need the pointer to be called, so keep it for iter.
+	iterable := field
+	for iterable.Kind() == reflect.Interface {
+		iterable = iterable.Elem()
+	}
 	field = indirect(field)
 
 	start, end := r.start, r.or
@@ -1052,8 +1634,68 @@ func (t *Template) executeRepeated(elems *elemlist, r *repeatedElement, st *stat
 	}
 	first := true
 
-	// Code common to all the loops.
-	loopBody := func(newst *state) {
+	// next gives the items one at a time, with their keys, so that an iterator's
+	// items need not all be held at once. The number of items an iterator has is
+	// not known, so its length is -1.
+	var next func() (item reflect.Value, key reflect.Value, ok bool)
+	// An iterator that can stop early because of an error, such as the rows of a
+	// streamed .model, reports it with an Err method.
+	var iterErr func() error
+	length := -1
+	index := 0
+	if array := field; array.Kind() == reflect.Array || array.Kind() == reflect.Slice {
+		length = array.Len()
+		next = func() (reflect.Value, reflect.Value, bool) {
+			if index >= array.Len() {
+				return reflect.Value{}, reflect.Value{}, false
+			}
+			index++
+			return array.Index(index - 1), reflect.ValueOf(index - 1), true
+		}
+	} else if m := field; m.Kind() == reflect.Map {
+		// Maps are repeated in the order of their keys, rather than at random.
+		keys := sortedKeys(m)
+		length = len(keys)
+		next = func() (reflect.Value, reflect.Value, bool) {
+			if index >= len(keys) {
+				return reflect.Value{}, reflect.Value{}, false
+			}
+			index++
+			return m.MapIndex(keys[index-1]), keys[index-1], true
+		}
+	} else if !field.IsValid() {
+		// A nil value, such as a column that a row does not have, has no items.
+		length = 0
+		next = func() (reflect.Value, reflect.Value, bool) {
+			return reflect.Value{}, reflect.Value{}, false
+		}
+	} else if ch := iter(iterable); ch.IsValid() {
+		if iterable.CanInterface() {
+			if errer, ok := iterable.Interface().(interface{ Err() error }); ok {
+				iterErr = errer.Err
+			}
+		}
+		next = func() (reflect.Value, reflect.Value, bool) {
+			e, ok := ch.Recv()
+			if !ok {
+				return reflect.Value{}, reflect.Value{}, false
+			}
+			index++
+			return e, reflect.ValueOf(index - 1), true
+		}
+	} else {
+		t.execError(st, r.linenum, ".repeated: cannot repeat %s (type %s)",
+			r.field, field.Type())
+	}
+
+	// Each item is executed once the one after it has been fetched, so that @last
+	// can be given.
+	item, key, more := next()
+	for j := 0; more; j++ {
+		nextItem, nextKey, nextMore := next()
+
+		newst := st.clone(item)
+		newst.loop = &loopState{index: j, length: length, last: !nextMore, key: key}
 		// .alternates between elements
 		if !first && r.altstart >= 0 {
 			for i := r.altstart; i < r.altend; {
@@ -1064,27 +1706,17 @@ func (t *Template) executeRepeated(elems *elemlist, r *repeatedElement, st *stat
 		for i := start; i < end; {
 			i = t.executeElement(elems, i, newst, data)
 		}
+
+		item, key, more = nextItem, nextKey, nextMore
 	}
 
-	if array := field; array.Kind() == reflect.Array || array.Kind() == reflect.Slice {
-		for j := 0; j < array.Len(); j++ {
-			loopBody(st.clone(array.Index(j)))
-		}
-	} else if m := field; m.Kind() == reflect.Map {
-		for _, key := range m.MapKeys() {
-			loopBody(st.clone(m.MapIndex(key)))
-		}
-	} else if ch := iter(field); ch.IsValid() {
-		for {
-			e, ok := ch.Recv()
-			if !ok {
-				break
+	if iterErr != nil {
+		if err := iterErr(); err != nil {
+			if data.modelErrorPolicy() == ModelErrorFail {
+				t.execError(st, r.linenum, ".repeated %s: %v", r.field, err)
 			}
-			loopBody(st.clone(e))
+			log.Print(&Error{r.linenum, fmt.Sprintf(".repeated %s: %v", r.field, err)})
 		}
-	} else {
-		t.execError(st, r.linenum, ".repeated: cannot repeat %s (type %s)",
-			r.field, field.Type())
 	}
 
 	if first {
@@ -1100,34 +1732,59 @@ func (t *Template) executeRepeated(elems *elemlist, r *repeatedElement, st *stat
 	}
 }
 
+// Execute a .model, storing the results of its query. If the query cannot be run,
+// the TemplateData's ModelErrorPolicy, or DefaultModelErrorPolicy, says what is done.
 func (t *Template) executeModel(m *modelElement, st *state, data *TemplateData) {
-	// Build up values of parameters that are meant to be passed in.
+	model, modelErr := m.run(data)
+	if modelErr == nil {
+		data.data[m.binding] = model
+		return
+	}
+
+	switch policy := data.modelErrorPolicy(); policy {
+	case ModelErrorFail:
+		t.execError(st, m.linenum, "%v", modelErr)
+	case ModelErrorOr:
+		data.data[m.binding] = []map[string]interface{}{}
+		data.data[modelErrorKey(m.binding)] = modelErr.Error()
+	case ModelErrorLog:
+		log.Print(&Error{m.linenum, modelErr.Error()})
+	default:
+		t.execError(st, m.linenum, "unknown model error policy %q", policy)
+	}
+}
+
+// run executes the .model's query with the values of its parameters. The rows are
+// all read, unless the .model streams them.
+func (m *modelElement) run(data *TemplateData) (interface{}, error) {
+	query := data.NamedQueries[m.modelName]
+	if query == nil {
+		return nil, fmt.Errorf(".model: no named query %s", m.modelName)
+	}
+
 	paramValues := make([]interface{}, len(m.parameters))
-	for i, p := range m.parameters {
-		// A parameter can have two parts, the name of a form value that is expected
-		// to come in with the request and a default value if the parameter is missing.
-		// Like this: postId|1 
-		paramParts := strings.Split(p, "=")
-
-		inValue := data.request.FormValue(paramParts[0])
-		if inValue == "" {
-			if len(paramParts) == 2 {
-				inValue = paramParts[1]
-			}
-			// TODO: If the value is missing and no default parameter is supplied, what to do?
-			// Not decided yet, but tha behavior should be added here when it is known.
+	for i, param := range m.parameters {
+		value, valueErr := param.Value(data.request)
+		if valueErr != nil {
+			return nil, fmt.Errorf(".model %s: %v", m.modelName, valueErr)
 		}
-
-		paramValues[i] = inValue
+		paramValues[i] = value
 	}
 
-	model, modelErr := data.NamedQueries[m.modelName](paramValues)
+	rows, modelErr := query(paramValues)
+	if modelErr == nil && m.stream {
+		data.streams = append(data.streams, rows)
+		return rows, nil
+	}
+	var model []map[string]interface{}
 	if modelErr == nil {
-		data.data["model"] = model
+		model, modelErr = rows.All()
+	}
+	if modelErr != nil {
+		return nil, fmt.Errorf(".model %s: query failed: %v", m.modelName, modelErr)
 	}
 
-	// TODO:  As above, what is the correct behavior if the attempt to retrieve a named query
-	// fails? Add here later.
+	return model, nil
 }
 
 // A valid delimiter must contain no white space and be non-empty.
@@ -1172,7 +1829,10 @@ func (t *Template) Parse(s string) (err error) {
 	t.buf = []byte(s)
 	t.p = 0
 	t.linenum = 1
+	t.lineEnded = false
+	t.escapeCtx = escapeContext{}
 	t.parse(t.elems, false)
+	t.checkCalls()
 	return nil
 }
 
@@ -1192,6 +1852,7 @@ func (t *Template) Execute(wr io.Writer, data *TemplateData) (err error) {
 	// Extract the driver data.
 	val := reflect.ValueOf(data.data)
 	defer checkError(&err)
+	defer data.closeStreams()
 	t.p = 0
 	// mtemplate: parent/child-specific functionality
 	if t.parent != nil {
@@ -1209,7 +1870,7 @@ func (t *Template) Execute(wr io.Writer, data *TemplateData) (err error) {
 		parentTemplateCopy := parentTemplate.clone()
 		parentTemplateCopy.childData = t.blockData
 		parentTemplateCopy.childData[""] = childDocWriter
-		parentTemplateCopy.Execute(wr, data)
+		return parentTemplateCopy.Execute(wr, data)
 	} else {
 		// mtemplate: this code handles templates that do not use
 		// the parent/child functionality
@@ -1270,6 +1931,12 @@ func ParseWithParentPage(s string, parentBody string, fmap FormatterMap) (t *Tem
 // may be nil, defines auxiliary functions for formatting variables.
 // The template is returned. If any errors occur, err will be non-nil.
 func ParseFile(filename string, fmap FormatterMap) (t *Template, err error) {
+	return parseFile(filename, fmap, nil)
+}
+
+// parseFile is ParseFile for a file that is imported while the files in importing are
+// being parsed.
+func parseFile(filename string, fmap FormatterMap, importing []string) (t *Template, err error) {
 	template, ok := parsedCache[filename]
 	if !ok || !Cache {
 		b, err := TemplateSourceReader(filename)
@@ -1277,7 +1944,14 @@ func ParseFile(filename string, fmap FormatterMap) (t *Template, err error) {
 			return nil, err
 		}
 
-		t, err = Parse(string(b), fmap)
+		if fmap == nil {
+			fmap = CustomFormatters
+		}
+		t = New(fmap)
+		t.importing = append(append([]string(nil), importing...), filename)
+		if err = t.Parse(string(b)); err != nil {
+			return nil, err
+		}
 		if Cache {
 			parsedCache[filename] = t
 		}
@@ -1333,8 +2007,7 @@ func RenderFile(filename string, wr io.Writer, data *TemplateData) (err error) {
 		return err
 	}
 
-	template.Execute(wr, data)
-	return
+	return template.Execute(wr, data)
 }
 
 // MustRenderFile reads, parses amd executes a templaet from the given filename
@@ -1364,4 +2037,8 @@ var Cache bool
 
 // CustomFormatters can be set by the calling code to a FormatterMap that is specific to its
 // needs.
-var CustomFormatters FormatterMap
\ No newline at end of file
+var CustomFormatters FormatterMap
+
+// MaxCallDepth is how deeply .calls may be nested, so that a macro that calls itself
+// without end stops the template with an error rather than overflowing the stack.
+var MaxCallDepth = 100
\ No newline at end of file
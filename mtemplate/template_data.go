@@ -12,6 +12,14 @@ type TemplateData struct {
 	response     http.ResponseWriter
 	request      *http.Request
 	NamedQueries map[string]model.NamedQueryFunc
+	// SanitizePolicy names the policy in SanitizePolicies that the sanitize formatter
+	// uses when the template does not name one. If empty, DefaultSanitizePolicy is used.
+	SanitizePolicy string
+	// ModelErrorPolicy says what is done when the query of a .model cannot be run:
+	// ModelErrorFail, ModelErrorOr or ModelErrorLog. If empty, DefaultModelErrorPolicy
+	// is used.
+	ModelErrorPolicy string
+	streams          []*model.QueryRows // rows of .model directives that stream, closed after execution
 }
 
 // NewTemplateData returns a new TemplateData object
@@ -29,6 +37,15 @@ func NewTemplateData(wr http.ResponseWriter, r *http.Request, namedQueries map[s
 	return newData
 }
 
+// closeStreams closes the rows of streaming .model directives, in case they were not
+// repeated to the end.
+func (data *TemplateData) closeStreams() {
+	for _, rows := range data.streams {
+		rows.Close()
+	}
+	data.streams = nil
+}
+
 // SetCookie sets a cookie in the response
 func (data *TemplateData) SetCookie(cookie *http.Cookie) {
 	http.SetCookie(data.response, cookie)
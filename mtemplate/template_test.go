@@ -0,0 +1,242 @@
+package mtemplate
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testData = map[string]interface{}{
+	"V":     `<b>"x'&`,
+	"Attr":  "x onmouseover=alert(1)",
+	"N":     42,
+	"JS":    "javascript:alert(1)",
+	"URL":   "http://e.com/a b?q=1&r=2",
+	"CSS":   "red; background: url(x)",
+	"Name":  "data-x",
+	"Title": `"a<b"`,
+	"Body":  `<b>x</b><script>y</script>`,
+	"MD":    "*hi* <script>x</script>",
+	"Y":     true,
+	"Empty": "",
+	"S":     "published",
+	"Q":     "7",
+	"List":  []string{"a", "b"},
+}
+
+// render parses tmpl, with AutoEscape set as given, and executes it on testData.
+func render(t *testing.T, tmpl string, autoEscape bool) string {
+	t.Helper()
+
+	tm := New(nil)
+	tm.AutoEscape = autoEscape
+	if parseErr := tm.Parse(tmpl); parseErr != nil {
+		t.Fatalf("parsing %s failed with error: %v", tmpl, parseErr)
+	}
+
+	td := NewTemplateData(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), nil, nil)
+	td.data = testData
+	var b bytes.Buffer
+	if execErr := tm.Execute(&b, td); execErr != nil {
+		t.Fatalf("executing %s failed with error: %v", tmpl, execErr)
+	}
+
+	return b.String()
+}
+
+func TestAutoEscapeContexts(t *testing.T) {
+	cases := []struct {
+		tmpl string
+		want string
+	}{
+		// Text
+		{`<p>{! V}</p>`, `<p>&lt;b&gt;&#34;x&#39;&amp;</p>`},
+		{`<p>{! V|html}</p>`, `<p>&lt;b&gt;&#34;x&#39;&amp;</p>`},
+		{`<textarea>{! V}</textarea>`, `<textarea>&lt;b&gt;&#34;x&#39;&amp;</textarea>`},
+		// Quoted and unquoted attributes
+		{`<a title="{! V}">`, `<a title="&lt;b&gt;&#34;x&#39;&amp;">`},
+		{`<a title='{! Attr}'>`, `<a title='x onmouseover=alert(1)'>`},
+		{`<a title={! V}>`, `<a title=&#60;b&#62;&#34;x&#39;&#38;>`},
+		{`<a title={! Attr}>`, `<a title=x&#32;onmouseover&#61;alert(1)>`},
+		// URLs
+		{`<a href="{! JS}">`, `<a href="#ZmtemplateZ">`},
+		{`<a href="{! URL}">`, `<a href="http://e.com/a%20b?q=1&amp;r=2">`},
+		{`<a href="/s?q={! V}">`, `<a href="/s?q=%3Cb%3E%22x%27%26">`},
+		{`<a href="/s/{! JS}">`, `<a href="/s/javascript:alert(1)">`},
+		// Scripts
+		{`<script>var s = "{! V}";</script>`, `<script>var s = "\u003Cb\u003E\u0022x\u0027\u0026";</script>`},
+		{`<script>var n = {! N}; var t = {! V};</script>`, `<script>var n =  42 ; var t = "\u003Cb\u003E\u0022x\u0027\u0026";</script>`},
+		{`<button onclick="f('{! V}')">`, `<button onclick="f('\u003Cb\u003E\u0022x\u0027\u0026')">`},
+		// CSS
+		{`<div style="color: {! CSS}">`, `<div style="color: red\3B  background\3A  url\28 x\29 ">`},
+		// Inside a tag
+		{`<div {! Attr}>`, `<div ZmtemplateZ>`},
+		{`<div {! Name}>`, `<div data-x>`},
+		// raw turns escaping off, wherever it is in the chain.
+		{`<p>{! V|raw}</p>`, `<p><b>"x'&</p>`},
+		{`<p>{! V|raw|str}</p>`, `<p><b>"x'&</p>`},
+		// Markdown is sanitized, not trusted.
+		{`{! MD|markdown}`, "<p><em>hi</em> </p>\n"},
+		// A formatted .let is escaped once, as its formatters' output would be.
+		{`{.let n = Title|html}{! n}`, `&#34;a&lt;b&#34;`},
+		{`{.let n = Title}{! n}`, `&#34;a&lt;b&#34;`},
+		{`{.let n = Title|str}{! n}`, `&#34;a&lt;b&#34;`},
+		{`{.let n = Body|sanitize}{! n}`, `<b>x</b>`},
+		{`{.let n = Body|raw}{! n}`, `<b>x</b><script>y</script>`},
+		// Branches that end in the same place
+		{`{.section Y}<a title={! Attr}>{.or}<b title={! Attr}>{.end}`, `<a title=x&#32;onmouseover&#61;alert(1)>`},
+		{`<a title="{.section Y}{! Attr}{.or}n{.end}">`, `<a title="x onmouseover=alert(1)">`},
+		{`{.if Y}<a title={.else}<b title={.end}{! Attr}>`, `<a title=x&#32;onmouseover&#61;alert(1)>`},
+		{`{.repeated section List}<i>{! @}</i>{.alternates with}, {.end}`, `<i>a</i>, <i>b</i>`},
+		{`{.macro m u}<i>{! u}</i>{.end}<a title={! Attr}>{.call m V}`, `<a title=x&#32;onmouseover&#61;alert(1)><i>&lt;b&gt;&#34;x&#39;&amp;</i>`},
+	}
+
+	for _, c := range cases {
+		if got := render(t, c.tmpl, true); got != c.want {
+			t.Errorf("%s\n got: %q\nwant: %q", c.tmpl, got, c.want)
+		}
+	}
+
+	if got := render(t, `<p>{! V}</p>`, false); got != `<p><b>"x'&</p>` {
+		t.Errorf("a template that does not escape automatically escaped its output: %q", got)
+	}
+}
+
+func TestAutoEscapeRejectsMismatchedContexts(t *testing.T) {
+	bad := []string{
+		`{.section Y}<a title={.or}<b>{.end}{! Attr}>`,
+		`{.section Y}<a title={.end}{! Attr}>`,
+		`{.repeated section List}<a title={.end}{! Attr}>`,
+		`{.repeated section List}x{.or}<a title={.end}{! Attr}>`,
+		`{.repeated section List}x{.alternates with}<a title={.end}`,
+		`{.if Y}<a title={.else}<b>{.end}{! Attr}>`,
+		`{.if Y}<a title={.end}{! Attr}>`,
+		`{.if Y}x{.elif S}<a title={.else}y{.end}`,
+		`{.macro m u}{! u}{.end}<a title={.call m Attr}>`,
+		`<a title={.call m Attr}>{.macro m u}{! u}{.end}`,
+		`{.macro m}<a title={.end}`,
+	}
+
+	for _, tmpl := range bad {
+		tm := New(nil)
+		tm.AutoEscape = true
+		if parseErr := tm.Parse(tmpl); parseErr == nil {
+			t.Errorf("%s was parsed", tmpl)
+		}
+
+		// Without AutoEscape, the contexts do not matter.
+		if parseErr := New(nil).Parse(strings.Replace(tmpl, "{.call m Attr}", "", 1)); parseErr != nil {
+			t.Errorf("%s failed to parse without AutoEscape: %v", tmpl, parseErr)
+		}
+	}
+}
+
+func TestSanitizePolicies(t *testing.T) {
+	basic := SanitizePolicies["basic"]
+	relaxed := SanitizePolicies["relaxed"]
+	cases := []struct {
+		policy *SanitizePolicy
+		in     string
+		want   string
+	}{
+		{basic, `<p onclick="x()">Hi <b>there</b><script>alert(1)</script></p>`, `<p>Hi <b>there</b></p>`},
+		{basic, `<a href="javascript:alert(1)">x</a>`, `<a rel="nofollow ugc">x</a>`},
+		{basic, `<a href=" jav&#x09;ascript:alert(1)">x</a>`, `<a rel="nofollow ugc">x</a>`},
+		{basic, `<a href="/rel?a=1&amp;b=2" title='t"q'>x</a>`, `<a href="/rel?a=1&amp;b=2" title="t&#34;q" rel="nofollow ugc">x</a>`},
+		{basic, `<div><em>open`, `<em>open</em>`},
+		{basic, `a < b & c &amp; d <!-- c --> <img src=x onerror=alert(1)>`, `a &lt; b &amp; c &amp; d  `},
+		{relaxed, `<img SRC="http://x/y.png" alt=hi style="x"><h2 class="c">T</h2></i>`, `<img src="http://x/y.png" alt="hi"><h2 class="c">T</h2>`},
+		{relaxed, `<STYLE>body{}</STYLE><ul><li>a<li>b</ul>`, `<ul><li>a<li>b</li></li></ul>`},
+		{relaxed, `<img src="data:image/png;base64,xx">`, `<img>`},
+	}
+
+	for _, c := range cases {
+		if got := c.policy.Sanitize(c.in); got != c.want {
+			t.Errorf("Sanitize(%q)\n got: %q\nwant: %q", c.in, got, c.want)
+		}
+	}
+
+	var b bytes.Buffer
+	SanitizeFormatter(&b, "sanitize basic", &TemplateData{}, "<h1>x</h1>")
+	if b.String() != "x" {
+		t.Errorf("the sanitize formatter with the basic policy gave %q", b.String())
+	}
+}
+
+func TestIfExpressions(t *testing.T) {
+	cases := []struct {
+		tmpl string
+		want string
+	}{
+		{`{.if S == "published"}y{.else}n{.end}`, `y`},
+		{`{.if S != 'published'}y{.else}n{.end}`, `n`},
+		{`{.if N < 50}y{.else}n{.end}`, `y`},
+		{`{.if N <= 42}y{.else}n{.end}`, `y`},
+		{`{.if N > 42}y{.else}n{.end}`, `n`},
+		{`{.if N >= 42}y{.else}n{.end}`, `y`},
+		{`{.if Q > 5}y{.else}n{.end}`, `y`},
+		{`{.if Q == 7}y{.else}n{.end}`, `y`},
+		{`{.if -1 < 0.5}y{.else}n{.end}`, `y`},
+		{`{.if Y and Empty}y{.else}n{.end}`, `n`},
+		{`{.if Y && S}y{.else}n{.end}`, `y`},
+		{`{.if Empty or Y}y{.else}n{.end}`, `y`},
+		{`{.if Empty || Missing}y{.else}n{.end}`, `n`},
+		{`{.if not Empty}y{.else}n{.end}`, `y`},
+		{`{.if !Y}y{.else}n{.end}`, `n`},
+		// and binds more tightly than or, and not more tightly than and.
+		{`{.if Y or Y and Empty}y{.else}n{.end}`, `y`},
+		{`{.if (Y or Y) and Empty}y{.else}n{.end}`, `n`},
+		{`{.if not Y and Empty}y{.else}n{.end}`, `n`},
+		{`{.if not (Empty or Y)}y{.else}n{.end}`, `n`},
+		{`{.if N < 10}a{.elif N < 50}b{.else}c{.end}`, `b`},
+		{`{.if "a b" == "a b"}y{.end}`, `y`},
+		{`{.repeated section List}{.if @ == "b"}{! @}{.end}{.end}`, `b`},
+	}
+
+	for _, c := range cases {
+		if got := render(t, c.tmpl, false); got != c.want {
+			t.Errorf("%s\n got: %q\nwant: %q", c.tmpl, got, c.want)
+		}
+	}
+
+	bad := []string{`{.if}x{.end}`, `{.if a ==}x{.end}`, `{.if a}x`, `{.else}`,
+		`{.if a}{.else}{.elif b}{.end}`, `{.if (a}{.end}`, `{.if "a}{.end}`}
+	for _, tmpl := range bad {
+		if parseErr := New(nil).Parse(tmpl); parseErr == nil {
+			t.Errorf("%s was parsed", tmpl)
+		}
+	}
+}
+
+func TestModelParameterValue(t *testing.T) {
+	cases := []struct {
+		spec  string
+		query string
+		want  interface{}
+	}{
+		{"q", "?q=", ""},
+		{"q?", "", nil},
+		{"q=x", "", "x"},
+		{"q=x", "?q=", "x"},
+		{"q=x", "?q=y", "y"},
+		{"limit:int=5", "?limit=", int64(5)},
+		{"limit:int=5", "?limit=7", int64(7)},
+	}
+
+	for _, c := range cases {
+		param, paramErr := ParseModelParameter(c.spec)
+		if paramErr != nil {
+			t.Fatalf("ParseModelParameter(%q) failed with error: %v", c.spec, paramErr)
+		}
+		got, valueErr := param.Value(httptest.NewRequest("GET", "/"+c.query, nil))
+		if valueErr != nil || got != c.want {
+			t.Errorf("%s with %q gave %#v, %v; want %#v", c.spec, c.query, got, valueErr, c.want)
+		}
+	}
+
+	required, _ := ParseModelParameter("q")
+	if _, missingErr := required.Value(httptest.NewRequest("GET", "/", nil)); missingErr == nil {
+		t.Error("a required parameter that the request does not give was not reported as missing")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	model "github.com/adamcrossland/grog/models"
+	"github.com/gorilla/mux"
+)
+
+// The JSON API gives programs, such as deploy tools and frontends that do their own
+// rendering, the same access to Content, Assets, Users and named queries that the rest
+// of the server and grogcmd give. Requests are authenticated as any other, most often
+// with an API token in the Authorization header.
+
+// apiDefaultPerPage and apiMaxPerPage are the default and largest number of items
+// in one page of a list.
+const (
+	apiDefaultPerPage = 50
+	apiMaxPerPage     = 200
+)
+
+// apiMaxBodySize is the largest request body, in bytes, that the API accepts. It is
+// large so that assets can be uploaded.
+var apiMaxBodySize int64 = 32 << 20
+
+// apiErrorResponse is the body of every response that reports an error.
+type apiErrorResponse struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// apiList is the body of every response that gives a list, one page at a time.
+type apiList struct {
+	Items      interface{} `json:"items"`
+	Page       int         `json:"page"`
+	PerPage    int         `json:"per_page"`
+	Total      int         `json:"total"`
+	TotalPages int         `json:"total_pages"`
+}
+
+// registerAPIRoutes adds the routes of the JSON API to the router. They must be added
+// before the routes that serve assets, which would match them otherwise.
+func registerAPIRoutes(r *mux.Router) {
+	api := r.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/content", apiRequest(apiContentsController))
+	api.HandleFunc("/content/{id:[0-9]+}", apiRequest(apiContentController))
+	api.HandleFunc("/assets", apiRequest(apiAssetsController))
+	api.HandleFunc("/assets/{name:[a-zA-Z0-9/\\-_\\.]+}", apiRequest(apiAssetController))
+	api.HandleFunc("/users", apiRequest(apiUsersController))
+	api.HandleFunc("/users/{id:[0-9]+}", apiRequest(apiUserController))
+	api.HandleFunc("/queries", apiRequest(apiQueriesController))
+	api.HandleFunc("/queries/{name}", apiRequest(apiQueryController))
+
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiError(w, http.StatusNotFound, "no such API endpoint: %s", r.URL.Path)
+	})
+}
+
+// apiRequest wraps an API handler so that the User who made the request, if any, is
+// available through requestUser. Unlike authorizeWrites, it leaves it to the handler
+// to decide what needs authentication, so that every error can be given as JSON.
+func apiRequest(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if user := authenticate(r); user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+		}
+
+		if r.ContentLength > apiMaxBodySize {
+			apiError(w, http.StatusRequestEntityTooLarge, "request body cannot be larger than %d bytes", apiMaxBodySize)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, apiMaxBodySize)
+
+		next(w, r)
+	}
+}
+
+// apiRequireUser returns the User who made the request, or answers it with an error
+// and returns nil if it was anonymous.
+func apiRequireUser(w http.ResponseWriter, r *http.Request) *model.User {
+	user := requestUser(r)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="grog"`)
+		apiError(w, http.StatusUnauthorized, "authentication required")
+	}
+
+	return user
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if encodeErr := encoder.Encode(value); encodeErr != nil {
+		log.Printf("error writing API response: %v", encodeErr)
+	}
+}
+
+// apiError answers the request with an error.
+func apiError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeAPIJSON(w, status, apiErrorResponse{apiErrorDetail{status, fmt.Sprintf(format, args...)}})
+}
+
+// apiMethodNotAllowed answers a request whose method the endpoint does not support.
+func apiMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed string) {
+	w.Header().Set("Allow", allowed)
+	apiError(w, http.StatusMethodNotAllowed, "%s is not allowed here; use %s", r.Method, allowed)
+}
+
+// readAPIJSON decodes the JSON body of the request. If it cannot, the request is
+// answered with an error and false is returned.
+func readAPIJSON(w http.ResponseWriter, r *http.Request, into interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if decodeErr := decoder.Decode(into); decodeErr != nil {
+		apiError(w, http.StatusBadRequest, "request body is not valid: %v", decodeErr)
+		return false
+	}
+
+	return true
+}
+
+// apiPage reads the page and per_page parameters of a list request, and gives the
+// list for that page of total items along with the bounds of the items it holds.
+func apiPage(r *http.Request, total int) (list apiList, start int, end int, err error) {
+	list.Page = 1
+	list.PerPage = apiDefaultPerPage
+
+	if pageParam := r.URL.Query().Get("page"); pageParam != "" {
+		list.Page, err = strconv.Atoi(pageParam)
+		if err != nil || list.Page < 1 {
+			return list, 0, 0, fmt.Errorf("page must be a positive integer")
+		}
+	}
+	if perPageParam := r.URL.Query().Get("per_page"); perPageParam != "" {
+		list.PerPage, err = strconv.Atoi(perPageParam)
+		if err != nil || list.PerPage < 1 || list.PerPage > apiMaxPerPage {
+			return list, 0, 0, fmt.Errorf("per_page must be an integer from 1 to %d", apiMaxPerPage)
+		}
+	}
+
+	list.Total = total
+	list.TotalPages = (total + list.PerPage - 1) / list.PerPage
+
+	start = (list.Page - 1) * list.PerPage
+	if start > total {
+		start = total
+	}
+	end = start + list.PerPage
+	if end > total {
+		end = total
+	}
+
+	return list, start, end, nil
+}
+
+// apiTime gives a time for a JSON response, or nil if it is not set.
+func apiTime(t model.NullTime) *time.Time {
+	if t.IsNull() || t.Time.IsZero() {
+		return nil
+	}
+
+	return &t.Time
+}
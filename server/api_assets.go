@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	model "github.com/adamcrossland/grog/models"
+	"github.com/gorilla/mux"
+)
+
+// apiAsset is how the API gives an Asset. Its content is left out; it can be fetched
+// by asking for the Asset with raw=true.
+type apiAsset struct {
+	Name     string     `json:"name"`
+	MimeType string     `json:"mimetype"`
+	Size     int        `json:"size"`
+	External bool       `json:"external"`
+	Rendered bool       `json:"rendered"`
+	Added    *time.Time `json:"added"`
+	Modified *time.Time `json:"modified"`
+	URL      string     `json:"url,omitempty"` // Only set if the Asset is served externally
+}
+
+// apiAssetInput describes the changes that a request makes to an Asset. It can be
+// given as JSON, with the content encoded in base64; as a multipart form, with the
+// content as a file named "content" and the other fields as form fields; or as the
+// raw content, with the other fields as URL parameters and the Content-Type header as
+// the mimetype. Fields that are left out are not changed.
+type apiAssetInput struct {
+	Name     *string `json:"name"`
+	MimeType *string `json:"mimetype"`
+	External *bool   `json:"external"`
+	Rendered *bool   `json:"rendered"`
+	Content  []byte  `json:"content"`
+}
+
+func newAPIAsset(r *http.Request, asset *model.Asset) apiAsset {
+	apiAsset := apiAsset{
+		Name:     asset.Name,
+		MimeType: asset.MimeType,
+		Size:     asset.Size(),
+		External: asset.ServeExternal,
+		Rendered: asset.Rendered,
+		Added:    apiTime(asset.Added),
+		Modified: apiTime(asset.Modified),
+	}
+	if asset.ServeExternal {
+		apiAsset.URL = site.absoluteURL(r, "/asset/"+asset.Name)
+	}
+
+	return apiAsset
+}
+
+// apiCanSeeAsset reports whether the request may see the Asset. Assets that are not
+// served externally, such as templates, can only be seen by those who may edit them.
+func apiCanSeeAsset(r *http.Request, asset *model.Asset) bool {
+	user := requestUser(r)
+
+	return asset.ServeExternal || (user != nil && user.CanEditAssets())
+}
+
+// apiAssetsController lists Assets, and creates them.
+func apiAssetsController(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		allAssets, assetsErr := grog.AllAssets()
+		if assetsErr != nil {
+			log.Printf("error loading assets for API: %v", assetsErr)
+			apiError(w, http.StatusInternalServerError, "error loading assets")
+			return
+		}
+
+		var visible []*model.Asset
+		for _, asset := range allAssets {
+			if apiCanSeeAsset(r, asset) {
+				visible = append(visible, asset)
+			}
+		}
+
+		list, start, end, pageErr := apiPage(r, len(visible))
+		if pageErr != nil {
+			apiError(w, http.StatusBadRequest, "%v", pageErr)
+			return
+		}
+
+		items := make([]apiAsset, 0, end-start)
+		for _, asset := range visible[start:end] {
+			items = append(items, newAPIAsset(r, asset))
+		}
+		list.Items = items
+
+		writeAPIJSON(w, http.StatusOK, list)
+	case "POST":
+		if !apiRequireAssetEditor(w, r) {
+			return
+		}
+
+		input, inputOK := readAPIAssetInput(w, r)
+		if !inputOK {
+			return
+		}
+		if input.Name == nil || len(*input.Name) == 0 {
+			apiError(w, http.StatusBadRequest, "name must be given")
+			return
+		}
+		if grog.AssetExists(*input.Name) {
+			apiError(w, http.StatusConflict, "asset %s exists; change it with PUT", *input.Name)
+			return
+		}
+		if input.MimeType == nil || len(*input.MimeType) == 0 {
+			detected := http.DetectContentType(input.Content)
+			input.MimeType = &detected
+		}
+
+		asset := grog.NewAsset(*input.Name, *input.MimeType)
+		applyAPIAssetInput(asset, input)
+
+		if saveErr := asset.Save(); saveErr != nil {
+			log.Printf("error saving new asset from API: %v", saveErr)
+			apiError(w, http.StatusInternalServerError, "error saving new asset: %v", saveErr)
+			return
+		}
+
+		w.Header().Set("Location", "/api/v1/assets/"+asset.Name)
+		writeAPIJSON(w, http.StatusCreated, newAPIAsset(r, asset))
+	default:
+		apiMethodNotAllowed(w, r, "GET, POST")
+	}
+}
+
+// apiAssetController gets, changes and deletes an Asset. With raw=true, GET gives the
+// Asset's content rather than a description of it.
+func apiAssetController(w http.ResponseWriter, r *http.Request) {
+	assetName := mux.Vars(r)["name"]
+
+	asset, assetErr := grog.GetAsset(assetName)
+	if assetErr != nil || !apiCanSeeAsset(r, asset) {
+		apiError(w, http.StatusNotFound, "no asset named %s", assetName)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if raw, _ := strconv.ParseBool(r.URL.Query().Get("raw")); raw {
+			w.Header().Set("Content-type", asset.MimeType)
+			w.Header().Set("Content-length", strconv.Itoa(asset.Size()))
+			w.Write(asset.Content)
+			return
+		}
+
+		writeAPIJSON(w, http.StatusOK, newAPIAsset(r, asset))
+	case "PUT", "PATCH":
+		if !apiRequireAssetEditor(w, r) {
+			return
+		}
+
+		input, inputOK := readAPIAssetInput(w, r)
+		if !inputOK {
+			return
+		}
+
+		renaming := input.Name != nil && *input.Name != asset.Name
+		if renaming {
+			if len(*input.Name) == 0 {
+				apiError(w, http.StatusBadRequest, "name must not be empty")
+				return
+			}
+			if grog.AssetExists(*input.Name) {
+				apiError(w, http.StatusConflict, "asset %s exists", *input.Name)
+				return
+			}
+		}
+		applyAPIAssetInput(asset, input)
+
+		// Save finds the Asset by its name, so the rename comes first, and is undone if
+		// the save fails so that a failed request changes nothing.
+		if renaming {
+			if renameErr := asset.Rename(*input.Name); renameErr != nil {
+				log.Printf("error renaming asset %s from API: %v", assetName, renameErr)
+				apiError(w, http.StatusInternalServerError, "error updating asset: %v", renameErr)
+				return
+			}
+		}
+		if saveErr := asset.Save(); saveErr != nil {
+			log.Printf("error updating asset %s from API: %v", assetName, saveErr)
+			if renaming {
+				if undoErr := asset.Rename(assetName); undoErr != nil {
+					log.Printf("error renaming asset %s back to %s: %v", asset.Name, assetName, undoErr)
+				}
+			}
+			apiError(w, http.StatusInternalServerError, "error updating asset: %v", saveErr)
+			return
+		}
+
+		writeAPIJSON(w, http.StatusOK, newAPIAsset(r, asset))
+	case "DELETE":
+		if !apiRequireAssetEditor(w, r) {
+			return
+		}
+
+		if delErr := asset.Delete(); delErr != nil {
+			log.Printf("error deleting asset %s from API: %v", assetName, delErr)
+			apiError(w, http.StatusInternalServerError, "error deleting asset: %v", delErr)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiMethodNotAllowed(w, r, "GET, PUT, PATCH, DELETE")
+	}
+}
+
+func apiRequireAssetEditor(w http.ResponseWriter, r *http.Request) bool {
+	user := apiRequireUser(w, r)
+	if user == nil {
+		return false
+	}
+	if !user.CanEditAssets() {
+		apiError(w, http.StatusForbidden, "only administrators may change assets")
+		return false
+	}
+
+	return true
+}
+
+// readAPIAssetInput reads an apiAssetInput in whichever of its forms the request
+// gives it. If it cannot, the request is answered with an error and false is returned.
+func readAPIAssetInput(w http.ResponseWriter, r *http.Request) (apiAssetInput, bool) {
+	var input apiAssetInput
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-type"))
+	switch mediaType {
+	case "application/json":
+		inputOK := readAPIJSON(w, r, &input)
+		return input, inputOK
+	case "multipart/form-data":
+		if parseErr := r.ParseMultipartForm(apiMaxBodySize); parseErr != nil {
+			apiError(w, http.StatusBadRequest, "request body is not valid: %v", parseErr)
+			return input, false
+		}
+
+		file, header, fileErr := r.FormFile("content")
+		if fileErr == nil {
+			defer file.Close()
+
+			var readErr error
+			input.Content, readErr = ioutil.ReadAll(file)
+			if readErr != nil {
+				apiError(w, http.StatusBadRequest, "error reading content: %v", readErr)
+				return input, false
+			}
+			if partType := header.Header.Get("Content-type"); len(partType) > 0 && partType != "application/octet-stream" {
+				input.MimeType = &partType
+			}
+		} else if fileErr != http.ErrMissingFile {
+			apiError(w, http.StatusBadRequest, "error reading content: %v", fileErr)
+			return input, false
+		}
+
+		fieldsOK := readAPIAssetFields(w, r.MultipartForm.Value, &input)
+		return input, fieldsOK
+	default:
+		body, readErr := ioutil.ReadAll(r.Body)
+		if readErr != nil {
+			apiError(w, http.StatusBadRequest, "error reading content: %v", readErr)
+			return input, false
+		}
+		// An empty body leaves the content alone, so that an Asset can be renamed or
+		// have its flags changed with URL parameters alone.
+		if len(body) > 0 {
+			input.Content = body
+			if contentType := r.Header.Get("Content-type"); len(contentType) > 0 {
+				input.MimeType = &contentType
+			}
+		}
+
+		fieldsOK := readAPIAssetFields(w, r.URL.Query(), &input)
+		return input, fieldsOK
+	}
+}
+
+// readAPIAssetFields reads the fields of an apiAssetInput, other than its content,
+// from form fields or URL parameters.
+func readAPIAssetFields(w http.ResponseWriter, values map[string][]string, input *apiAssetInput) bool {
+	for field, fieldValues := range values {
+		if len(fieldValues) == 0 {
+			continue
+		}
+		value := fieldValues[0]
+
+		switch field {
+		case "name":
+			input.Name = &value
+		case "mimetype":
+			input.MimeType = &value
+		case "external", "rendered":
+			var flag bool
+			if decodeErr := json.Unmarshal([]byte(value), &flag); decodeErr != nil {
+				apiError(w, http.StatusBadRequest, "%s must be true or false", field)
+				return false
+			}
+			if field == "external" {
+				input.External = &flag
+			} else {
+				input.Rendered = &flag
+			}
+		default:
+			apiError(w, http.StatusBadRequest, "unknown field %s", field)
+			return false
+		}
+	}
+
+	return true
+}
+
+func applyAPIAssetInput(asset *model.Asset, input apiAssetInput) {
+	if input.MimeType != nil && len(*input.MimeType) > 0 {
+		asset.MimeType = *input.MimeType
+	}
+	if input.External != nil {
+		asset.ServeExternal = *input.External
+	}
+	if input.Rendered != nil {
+		asset.Rendered = *input.Rendered
+	}
+	if input.Content != nil {
+		asset.Write(input.Content)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	model "github.com/adamcrossland/grog/models"
+	"github.com/gorilla/mux"
+)
+
+// apiContent is how the API gives a Content.
+type apiContent struct {
+	ID         int64      `json:"id"`
+	Title      string     `json:"title"`
+	Summary    string     `json:"summary"`
+	Body       string     `json:"body"`
+	BodyFormat string     `json:"body_format"`
+	Slug       string     `json:"slug"`
+	Template   string     `json:"template"`
+	Parent     int64      `json:"parent"`
+	Author     int64      `json:"author"`
+	Status     string     `json:"status"`
+	PublishAt  *time.Time `json:"publish_at"`
+	Added      *time.Time `json:"added"`
+	Modified   *time.Time `json:"modified"`
+	Tags       []string   `json:"tags"`
+	URL        string     `json:"url"`
+}
+
+// apiContentInput is the body of a request that creates or changes a Content. Fields
+// that are left out are not changed.
+type apiContentInput struct {
+	Title      *string    `json:"title"`
+	Summary    *string    `json:"summary"`
+	Body       *string    `json:"body"`
+	BodyFormat *string    `json:"body_format"`
+	Slug       *string    `json:"slug"`
+	Template   *string    `json:"template"`
+	Parent     *int64     `json:"parent"`
+	Status     *string    `json:"status"`
+	PublishAt  *time.Time `json:"publish_at"`
+	Tags       *[]string  `json:"tags"`
+}
+
+func newAPIContent(r *http.Request, content *model.Content) apiContent {
+	tags := []string{}
+	for _, tag := range content.Tags() {
+		tags = append(tags, tag.Name)
+	}
+
+	return apiContent{
+		ID:         content.ID,
+		Title:      content.Title,
+		Summary:    content.Summary,
+		Body:       content.Body,
+		BodyFormat: content.BodyFormat,
+		Slug:       content.Slug,
+		Template:   content.Template,
+		Parent:     content.Parent,
+		Author:     content.Author,
+		Status:     content.Status,
+		PublishAt:  apiTime(content.PublishAt),
+		Added:      apiTime(content.Added),
+		Modified:   apiTime(content.Modified),
+		Tags:       tags,
+		URL:        site.absoluteURL(r, urlForContent(*content)),
+	}
+}
+
+// apiContentsController lists Content, and creates it. Anonymous requests only see
+// Content that has been published; others can ask for Content in a given state with
+// the status parameter.
+func apiContentsController(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		user := requestUser(r)
+		status := r.URL.Query().Get("status")
+		if len(status) > 0 && !model.ValidContentStatus(status) {
+			apiError(w, http.StatusBadRequest, "unknown status %s", status)
+			return
+		}
+
+		allContent, contentErr := grog.AllContents()
+		if contentErr != nil {
+			log.Printf("error loading content for API: %v", contentErr)
+			apiError(w, http.StatusInternalServerError, "error loading content")
+			return
+		}
+
+		var visible []*model.Content
+		for _, content := range allContent {
+			if (user != nil || content.IsPublished()) && (len(status) == 0 || content.Status == status) {
+				visible = append(visible, content)
+			}
+		}
+		sort.Slice(visible, func(i, j int) bool { return visible[i].ID < visible[j].ID })
+
+		list, start, end, pageErr := apiPage(r, len(visible))
+		if pageErr != nil {
+			apiError(w, http.StatusBadRequest, "%v", pageErr)
+			return
+		}
+
+		items := make([]apiContent, 0, end-start)
+		for _, content := range visible[start:end] {
+			items = append(items, newAPIContent(r, content))
+		}
+		list.Items = items
+
+		writeAPIJSON(w, http.StatusOK, list)
+	case "POST":
+		user := apiRequireUser(w, r)
+		if user == nil {
+			return
+		}
+		if !user.CanAddContent() {
+			apiError(w, http.StatusForbidden, "you may not add content")
+			return
+		}
+
+		var input apiContentInput
+		if !readAPIJSON(w, r, &input) {
+			return
+		}
+
+		content := grog.NewContent("", "", "", "", "")
+		content.Author = user.ID
+		if !applyAPIContentInput(w, content, input) {
+			return
+		}
+
+		saveErr := content.Save()
+		if saveErr == nil && input.Tags != nil {
+			saveErr = content.Tag(*input.Tags...)
+		}
+		if saveErr != nil {
+			log.Printf("error saving new content from API: %v", saveErr)
+			apiError(w, http.StatusInternalServerError, "error saving new content: %v", saveErr)
+			return
+		}
+
+		w.Header().Set("Location", "/api/v1/content/"+strconv.FormatInt(content.ID, 10))
+		writeAPIJSON(w, http.StatusCreated, newAPIContent(r, content))
+	default:
+		apiMethodNotAllowed(w, r, "GET, POST")
+	}
+}
+
+// apiContentController gets, changes and deletes a Content.
+func apiContentController(w http.ResponseWriter, r *http.Request) {
+	contentID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	content, contentErr := grog.GetContent(contentID)
+	if contentErr != nil || (!content.IsPublished() && requestUser(r) == nil) {
+		apiError(w, http.StatusNotFound, "no content with id %d", contentID)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		writeAPIJSON(w, http.StatusOK, newAPIContent(r, content))
+	case "PUT", "PATCH":
+		user := apiRequireUser(w, r)
+		if user == nil {
+			return
+		}
+		if !user.CanEditContent(content) {
+			apiError(w, http.StatusForbidden, "you may not change content %d", contentID)
+			return
+		}
+
+		var input apiContentInput
+		if !readAPIJSON(w, r, &input) {
+			return
+		}
+		if !applyAPIContentInput(w, content, input) {
+			return
+		}
+		content.Editor = user.ID
+
+		saveErr := content.Save()
+		if saveErr == nil && input.Tags != nil {
+			saveErr = content.SetTags(*input.Tags)
+		}
+		if saveErr != nil {
+			log.Printf("error updating content %d from API: %v", contentID, saveErr)
+			apiError(w, http.StatusInternalServerError, "error updating content: %v", saveErr)
+			return
+		}
+
+		writeAPIJSON(w, http.StatusOK, newAPIContent(r, content))
+	case "DELETE":
+		user := apiRequireUser(w, r)
+		if user == nil {
+			return
+		}
+		if !user.CanEditContent(content) {
+			apiError(w, http.StatusForbidden, "you may not delete content %d", contentID)
+			return
+		}
+
+		if delErr := content.Delete(); delErr != nil {
+			log.Printf("error deleting content %d from API: %v", contentID, delErr)
+			apiError(w, http.StatusInternalServerError, "error deleting content: %v", delErr)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiMethodNotAllowed(w, r, "GET, PUT, PATCH, DELETE")
+	}
+}
+
+// applyAPIContentInput makes the changes that a request asks for to a Content. If they
+// are not valid, the request is answered with an error and false is returned.
+func applyAPIContentInput(w http.ResponseWriter, content *model.Content, input apiContentInput) bool {
+	if input.Status != nil && !model.ValidContentStatus(*input.Status) {
+		apiError(w, http.StatusBadRequest, "unknown status %s", *input.Status)
+		return false
+	}
+	if input.BodyFormat != nil && !model.ValidBodyFormat(*input.BodyFormat) {
+		apiError(w, http.StatusBadRequest, "unknown body_format %s", *input.BodyFormat)
+		return false
+	}
+	if input.Tags != nil {
+		for _, tag := range *input.Tags {
+			if !model.ValidTagName(tag) {
+				apiError(w, http.StatusBadRequest, "tag names cannot be empty or contain slashes or commas: %q", tag)
+				return false
+			}
+		}
+	}
+
+	if input.Title != nil {
+		content.UpdateTitle(*input.Title)
+	}
+	if input.Slug != nil {
+		content.Slug = *input.Slug
+	}
+	if input.Summary != nil {
+		content.Summary = *input.Summary
+	}
+	if input.Body != nil {
+		content.Body = *input.Body
+	}
+	if input.BodyFormat != nil {
+		content.BodyFormat = *input.BodyFormat
+	}
+	if input.Template != nil {
+		content.Template = *input.Template
+	}
+	if input.Parent != nil {
+		content.Parent = *input.Parent
+	}
+	if input.Status != nil {
+		content.Status = *input.Status
+	}
+	if input.PublishAt != nil {
+		content.PublishAt.Set(*input.PublishAt)
+	}
+
+	if content.Status == model.ContentScheduled && content.PublishAt.IsNull() {
+		apiError(w, http.StatusBadRequest, "scheduled content must have a publish_at time")
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	model "github.com/adamcrossland/grog/models"
+	"github.com/adamcrossland/grog/mtemplate"
+	"github.com/gorilla/mux"
+)
+
+// apiQuery is how the API gives a NamedQuery. A timeout or max_rows of 0 means that
+// the server's default is used. Public queries can be run by anyone through /q/{name},
+// with the params that they declare.
+type apiQuery struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Query     string     `json:"query"`
+	TimeoutMS int64      `json:"timeout_ms"`
+	MaxRows   int        `json:"max_rows"`
+	Public    bool       `json:"public"`
+	Params    string     `json:"params"`
+	Added     *time.Time `json:"added"`
+	Modified  *time.Time `json:"modified"`
+}
+
+// apiQueryInput is the body of a request that creates or changes a NamedQuery. Fields
+// that are left out are not changed.
+type apiQueryInput struct {
+	Name      *string `json:"name"`
+	Query     *string `json:"query"`
+	TimeoutMS *int64  `json:"timeout_ms"`
+	MaxRows   *int    `json:"max_rows"`
+	Public    *bool   `json:"public"`
+	Params    *string `json:"params"`
+}
+
+func newAPIQuery(query *model.NamedQuery) apiQuery {
+	return apiQuery{
+		ID:        query.ID,
+		Name:      query.Name,
+		Query:     query.Query,
+		TimeoutMS: query.Timeout.Milliseconds(),
+		MaxRows:   query.MaxRows,
+		Public:    query.Public,
+		Params:    query.Params,
+		Added:     apiTime(query.Added),
+		Modified:  apiTime(query.Modified),
+	}
+}
+
+// apiRequireQueryEditor returns true if the request was made by a User who may edit
+// named queries, and otherwise answers it with an error. Queries can read anything in
+// the database, so only those who may change them may see them.
+func apiRequireQueryEditor(w http.ResponseWriter, r *http.Request) bool {
+	user := apiRequireUser(w, r)
+	if user == nil {
+		return false
+	}
+	if !user.CanEditQueries() {
+		apiError(w, http.StatusForbidden, "only administrators may see or change named queries")
+		return false
+	}
+
+	return true
+}
+
+// apiQueriesController lists named queries, and creates them.
+func apiQueriesController(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireQueryEditor(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		allQueries, queriesErr := grog.AllNamedQueries()
+		if queriesErr != nil {
+			log.Printf("error loading named queries for API: %v", queriesErr)
+			apiError(w, http.StatusInternalServerError, "error loading named queries")
+			return
+		}
+
+		list, start, end, pageErr := apiPage(r, len(allQueries))
+		if pageErr != nil {
+			apiError(w, http.StatusBadRequest, "%v", pageErr)
+			return
+		}
+
+		items := make([]apiQuery, 0, end-start)
+		for _, query := range allQueries[start:end] {
+			items = append(items, newAPIQuery(query))
+		}
+		list.Items = items
+
+		writeAPIJSON(w, http.StatusOK, list)
+	case "POST":
+		var input apiQueryInput
+		if !readAPIJSON(w, r, &input) {
+			return
+		}
+		if input.Name == nil || input.Query == nil {
+			apiError(w, http.StatusBadRequest, "name and query must be given")
+			return
+		}
+		if _, existsErr := grog.GetNamedQuery(*input.Name); existsErr == nil {
+			apiError(w, http.StatusConflict, "a named query called %s exists", *input.Name)
+			return
+		}
+
+		query := grog.NewNamedQuery(*input.Name, *input.Query)
+		if !saveAPIQuery(w, query, input) {
+			return
+		}
+
+		w.Header().Set("Location", "/api/v1/queries/"+url.PathEscape(query.Name))
+		writeAPIJSON(w, http.StatusCreated, newAPIQuery(query))
+	default:
+		apiMethodNotAllowed(w, r, "GET, POST")
+	}
+}
+
+// apiQueryController gets, changes and deletes a named query.
+func apiQueryController(w http.ResponseWriter, r *http.Request) {
+	if !apiRequireQueryEditor(w, r) {
+		return
+	}
+
+	queryName := mux.Vars(r)["name"]
+	query, queryErr := grog.GetNamedQuery(queryName)
+	if queryErr != nil {
+		apiError(w, http.StatusNotFound, "no named query called %s", queryName)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		writeAPIJSON(w, http.StatusOK, newAPIQuery(query))
+	case "PUT", "PATCH":
+		var input apiQueryInput
+		if !readAPIJSON(w, r, &input) {
+			return
+		}
+		if input.Name != nil && *input.Name != query.Name {
+			if _, existsErr := grog.GetNamedQuery(*input.Name); existsErr == nil {
+				apiError(w, http.StatusConflict, "a named query called %s exists", *input.Name)
+				return
+			}
+		}
+
+		if !saveAPIQuery(w, query, input) {
+			return
+		}
+
+		writeAPIJSON(w, http.StatusOK, newAPIQuery(query))
+	case "DELETE":
+		if delErr := query.Delete(); delErr != nil {
+			log.Printf("error deleting named query %s from API: %v", queryName, delErr)
+			apiError(w, http.StatusInternalServerError, "error deleting named query: %v", delErr)
+			return
+		}
+		reloadNamedQueries("API change")
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiMethodNotAllowed(w, r, "GET, PUT, PATCH, DELETE")
+	}
+}
+
+// saveAPIQuery makes the changes that a request asks for to a NamedQuery, saves it and
+// reloads the named queries so that templates see the change at once. If the query is
+// not valid or cannot be saved, the request is answered with an error and false is
+// returned.
+func saveAPIQuery(w http.ResponseWriter, query *model.NamedQuery, input apiQueryInput) bool {
+	if input.Name != nil {
+		query.Name = *input.Name
+	}
+	if input.Query != nil {
+		query.Query = *input.Query
+	}
+	if input.TimeoutMS != nil {
+		query.Timeout = time.Duration(*input.TimeoutMS) * time.Millisecond
+	}
+	if input.MaxRows != nil {
+		query.MaxRows = *input.MaxRows
+	}
+	if input.Public != nil {
+		query.Public = *input.Public
+	}
+	if input.Params != nil {
+		if _, paramsErr := mtemplate.ParseModelParameters(*input.Params); paramsErr != nil {
+			apiError(w, http.StatusBadRequest, "params are not valid: %v", paramsErr)
+			return false
+		}
+		query.Params = strings.Join(strings.Fields(*input.Params), " ")
+	}
+
+	if validErr := query.Validate(); validErr != nil {
+		apiError(w, http.StatusBadRequest, "%v", validErr)
+		return false
+	}
+	if saveErr := query.Save(); saveErr != nil {
+		log.Printf("error saving named query %s from API: %v", query.Name, saveErr)
+		apiError(w, http.StatusInternalServerError, "error saving named query: %v", saveErr)
+		return false
+	}
+	reloadNamedQueries("API change")
+
+	return true
+}
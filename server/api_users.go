@@ -0,0 +1,238 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	model "github.com/adamcrossland/grog/models"
+	"github.com/gorilla/mux"
+)
+
+// apiUser is how the API gives a User. Passwords and API tokens are never given.
+type apiUser struct {
+	ID    int64      `json:"id"`
+	Email string     `json:"email"`
+	Name  string     `json:"name"`
+	Role  string     `json:"role"`
+	Added *time.Time `json:"added"`
+}
+
+// apiUserInput is the body of a request that creates or changes a User. Fields that
+// are left out are not changed. Users who are not administrators must give their
+// current password to change their own password or email address.
+type apiUserInput struct {
+	Email           *string `json:"email"`
+	Name            *string `json:"name"`
+	Role            *string `json:"role"`
+	Password        *string `json:"password"`
+	CurrentPassword *string `json:"current_password"`
+}
+
+func newAPIUser(user *model.User) apiUser {
+	return apiUser{
+		ID:    user.ID,
+		Email: user.Email,
+		Name:  user.Name,
+		Role:  user.Role,
+		Added: apiTime(user.Added),
+	}
+}
+
+// apiUsersController lists Users, and creates them. Only administrators may do either.
+func apiUsersController(w http.ResponseWriter, r *http.Request) {
+	user := apiRequireUser(w, r)
+	if user == nil {
+		return
+	}
+	if !user.CanManageUsers() {
+		apiError(w, http.StatusForbidden, "only administrators may list or add users")
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		allUsers, usersErr := grog.AllUsers()
+		if usersErr != nil {
+			log.Printf("error loading users for API: %v", usersErr)
+			apiError(w, http.StatusInternalServerError, "error loading users")
+			return
+		}
+		sort.Slice(allUsers, func(i, j int) bool { return allUsers[i].ID < allUsers[j].ID })
+
+		list, start, end, pageErr := apiPage(r, len(allUsers))
+		if pageErr != nil {
+			apiError(w, http.StatusBadRequest, "%v", pageErr)
+			return
+		}
+
+		items := make([]apiUser, 0, end-start)
+		for _, listed := range allUsers[start:end] {
+			items = append(items, newAPIUser(listed))
+		}
+		list.Items = items
+
+		writeAPIJSON(w, http.StatusOK, list)
+	case "POST":
+		var input apiUserInput
+		if !readAPIJSON(w, r, &input) {
+			return
+		}
+		if input.Email == nil || len(*input.Email) == 0 {
+			apiError(w, http.StatusBadRequest, "email must be given")
+			return
+		}
+		if _, existsErr := grog.GetUserByEmail(*input.Email); existsErr == nil {
+			apiError(w, http.StatusConflict, "a user with email %s exists", *input.Email)
+			return
+		}
+		if input.Password != nil && len(*input.Password) < model.MinPasswordLength {
+			apiError(w, http.StatusBadRequest, "password must be at least %d characters long", model.MinPasswordLength)
+			return
+		}
+
+		newUser := grog.NewUser(*input.Email, "")
+		if !applyAPIUserInput(w, newUser, input) {
+			return
+		}
+
+		if saveErr := newUser.Save(); saveErr != nil {
+			log.Printf("error saving new user from API: %v", saveErr)
+			apiError(w, http.StatusInternalServerError, "error saving new user: %v", saveErr)
+			return
+		}
+		if input.Password != nil {
+			if passwordErr := grog.SetUserPassword(newUser.ID, *input.Password); passwordErr != nil {
+				log.Printf("error setting password for new user %d from API: %v", newUser.ID, passwordErr)
+				apiError(w, http.StatusInternalServerError, "user %d was added, but its password could not be set: %v",
+					newUser.ID, passwordErr)
+				return
+			}
+		}
+
+		w.Header().Set("Location", "/api/v1/users/"+strconv.FormatInt(newUser.ID, 10))
+		writeAPIJSON(w, http.StatusCreated, newAPIUser(newUser))
+	default:
+		apiMethodNotAllowed(w, r, "GET, POST")
+	}
+}
+
+// apiUserController gets, changes and deletes a User. Users may get and change
+// themselves, but not their own role; only administrators may do anything else.
+func apiUserController(w http.ResponseWriter, r *http.Request) {
+	user := apiRequireUser(w, r)
+	if user == nil {
+		return
+	}
+
+	userID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if userID != user.ID && !user.CanManageUsers() {
+		// Other Users are not revealed to those who may not manage them.
+		apiError(w, http.StatusNotFound, "no user with id %d", userID)
+		return
+	}
+
+	found, userErr := grog.GetUser(userID)
+	if userErr != nil {
+		apiError(w, http.StatusNotFound, "no user with id %d", userID)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		writeAPIJSON(w, http.StatusOK, newAPIUser(found))
+	case "PUT", "PATCH":
+		var input apiUserInput
+		if !readAPIJSON(w, r, &input) {
+			return
+		}
+		if input.Role != nil && *input.Role != found.Role && !user.CanManageUsers() {
+			apiError(w, http.StatusForbidden, "you may not change your own role")
+			return
+		}
+		// Someone who has only taken a session or token cannot lock the User out.
+		changingLogin := input.Password != nil || (input.Email != nil && *input.Email != found.Email)
+		if changingLogin && !user.CanManageUsers() {
+			if input.CurrentPassword == nil {
+				apiError(w, http.StatusForbidden, "current_password must be given to change your password or email")
+				return
+			}
+			if _, verifyErr := grog.VerifyUserPassword(found.Email, *input.CurrentPassword); verifyErr != nil {
+				apiError(w, http.StatusForbidden, "current_password is not correct")
+				return
+			}
+		}
+		if input.Email != nil && *input.Email != found.Email {
+			if _, existsErr := grog.GetUserByEmail(*input.Email); existsErr == nil {
+				apiError(w, http.StatusConflict, "a user with email %s exists", *input.Email)
+				return
+			}
+		}
+		if input.Password != nil && len(*input.Password) < model.MinPasswordLength {
+			apiError(w, http.StatusBadRequest, "password must be at least %d characters long", model.MinPasswordLength)
+			return
+		}
+		if !applyAPIUserInput(w, found, input) {
+			return
+		}
+
+		saveErr := found.Save()
+		if saveErr == nil && input.Password != nil {
+			saveErr = grog.SetUserPassword(found.ID, *input.Password)
+		}
+		if saveErr != nil {
+			log.Printf("error updating user %d from API: %v", userID, saveErr)
+			apiError(w, http.StatusInternalServerError, "error updating user: %v", saveErr)
+			return
+		}
+
+		writeAPIJSON(w, http.StatusOK, newAPIUser(found))
+	case "DELETE":
+		if !user.CanManageUsers() {
+			apiError(w, http.StatusForbidden, "only administrators may remove users")
+			return
+		}
+		if found.ID == user.ID {
+			apiError(w, http.StatusConflict, "you may not remove yourself")
+			return
+		}
+
+		if delErr := grog.DeleteUser(found.ID); delErr != nil {
+			log.Printf("error deleting user %d from API: %v", userID, delErr)
+			apiError(w, http.StatusInternalServerError, "error deleting user: %v", delErr)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiMethodNotAllowed(w, r, "GET, PUT, PATCH, DELETE")
+	}
+}
+
+// applyAPIUserInput makes the changes that a request asks for to a User, other than to
+// its password. If they are not valid, the request is answered with an error and false
+// is returned.
+func applyAPIUserInput(w http.ResponseWriter, user *model.User, input apiUserInput) bool {
+	if input.Role != nil && !model.ValidRole(*input.Role) {
+		apiError(w, http.StatusBadRequest, "unknown role %s", *input.Role)
+		return false
+	}
+	if input.Email != nil && len(*input.Email) == 0 {
+		apiError(w, http.StatusBadRequest, "email cannot be empty")
+		return false
+	}
+
+	if input.Email != nil {
+		user.Email = *input.Email
+	}
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Role != nil {
+		user.Role = *input.Role
+	}
+
+	return true
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/adamcrossland/grog/mtemplate"
@@ -34,6 +35,24 @@ func assetController(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// A prior version of the asset can be requested with ?v=
+		if versionParam := r.FormValue("v"); versionParam != "" {
+			version, versionErr := strconv.ParseInt(versionParam, 10, 64)
+			if versionErr != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "v must be a version number")
+				return
+			}
+
+			// A version is only served if it was itself external, so that old content that
+			// was internal does not become public along with the current version.
+			asset, assetErr = grog.GetAssetVersion(assetID, version)
+			if assetErr != nil || !asset.ServeExternal {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		}
+
 		w.Header().Set("Content-type", asset.MimeType)
 
 		mimeTypeParts := strings.Split(asset.MimeType, ";")
@@ -43,7 +62,7 @@ func assetController(w http.ResponseWriter, r *http.Request) {
 		case "text/css", "text/html", "text/plain", "text/javascript":
 			if asset.Rendered {
 				parsedTemplate := mtemplate.MustParse(string(asset.Content), nil)
-				tdata := mtemplate.NewTemplateData(w, r, loadedNamedQueries, nil)
+				tdata := mtemplate.NewTemplateData(w, r, namedQueries.Queries(), nil)
 				parsedTemplate.Execute(w, tdata)
 			} else {
 				fmt.Fprintf(w, "%s", string(asset.Content))
@@ -52,6 +71,12 @@ func assetController(w http.ResponseWriter, r *http.Request) {
 			w.Write(asset.Content)
 		}
 	case "PUT", "POST":
+		if user := requestUser(r); user == nil || !user.CanEditAssets() {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "only administrators may change assets")
+			return
+		}
+
 		r.ParseForm()
 
 		assetName, assetNameOK := r.Form["name"]
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	model "github.com/adamcrossland/grog/models"
+)
+
+const sessionCookieName = "grog_session"
+
+// sessionLifetime is how long a login lasts before the user must log in again.
+var sessionLifetime = 14 * 24 * time.Hour
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// requestUser returns the authenticated User that made the request, or nil if the
+// request was anonymous.
+func requestUser(r *http.Request) *model.User {
+	user, _ := r.Context().Value(userContextKey).(*model.User)
+
+	return user
+}
+
+// authenticate finds the User that made the request, either from an API token in the
+// Authorization header or from a session cookie.
+func authenticate(r *http.Request) *model.User {
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		user, userErr := grog.GetUserByAPIToken(strings.TrimPrefix(authHeader, "Bearer "))
+		if userErr != nil {
+			log.Printf("rejected api token from %s: %v", r.RemoteAddr, userErr)
+			return nil
+		}
+
+		return user
+	}
+
+	cookie, cookieErr := r.Cookie(sessionCookieName)
+	if cookieErr != nil {
+		return nil
+	}
+
+	session, sessionErr := grog.GetSession(cookie.Value)
+	if sessionErr != nil {
+		return nil
+	}
+
+	user, userErr := grog.GetUser(session.User)
+	if userErr != nil {
+		log.Printf("session refers to missing user %d: %v", session.User, userErr)
+		return nil
+	}
+
+	return user
+}
+
+// authorizeWrites wraps a handler so that any request which could change data must come
+// from an authenticated User. Reads are allowed through anonymously, but the User is
+// still made available through requestUser if one can be found.
+func authorizeWrites(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := authenticate(r)
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+		}
+
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			if user == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="grog"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, "authentication required")
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// loginController exchanges an email address and password for a session cookie.
+// One of the user's API tokens is also accepted in place of the password.
+func loginController(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+
+	email := formStringValueOrDef(r, "email")
+	password := formStringValueOrDef(r, "password")
+
+	user, authErr := grog.AuthenticateUser(email, password)
+	if authErr != nil {
+		log.Printf("failed login for %s from %s", email, r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "invalid email address or password")
+		return
+	}
+
+	_, key, sessionErr := grog.NewSession(user.ID, sessionLifetime)
+	if sessionErr != nil {
+		log.Printf("error creating session for user %d: %v", user.ID, sessionErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "error logging in")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    key,
+		Path:     "/",
+		Expires:  time.Now().Add(sessionLifetime),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	redirectTo := formStringValueOrDef(r, "next")
+	if strings.HasPrefix(redirectTo, "/") && !strings.HasPrefix(redirectTo, "//") {
+		http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "logged in")
+}
+
+// logoutController ends the session that made the request.
+func logoutController(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if cookie, cookieErr := r.Cookie(sessionCookieName); cookieErr == nil {
+		if session, sessionErr := grog.GetSession(cookie.Value); sessionErr == nil {
+			if delErr := session.Delete(); delErr != nil {
+				log.Printf("error deleting session: %v", delErr)
+			}
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "logged out")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	model "github.com/adamcrossland/grog/models"
+	"github.com/gorilla/mux"
+)
+
+// maxCommentLength is the longest comment body, in bytes, that will be accepted.
+const maxCommentLength = 10000
+
+// commentController accepts new comments on a published Content. Anyone may comment;
+// comments from Users who may add content are approved straight away, and all others
+// wait for moderation.
+func commentController(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := authenticate(r)
+
+	contentID := mux.Vars(r)["id"]
+
+	var content *model.Content
+	var contentErr error
+
+	if parsedID, parseErr := strconv.ParseInt(contentID, 10, 64); parseErr == nil {
+		content, contentErr = grog.GetContent(parsedID)
+	} else {
+		content, contentErr = grog.GetContentBySlug(contentID)
+	}
+	if contentErr != nil || !content.IsPublished() {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Could not find post %s", contentID)
+		return
+	}
+
+	r.ParseForm()
+
+	body := formStringValRequired(w, r, "comment_body")
+	if len(body) == 0 {
+		return
+	}
+	if len(body) > maxCommentLength {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "comment_body cannot be longer than %d characters", maxCommentLength)
+		return
+	}
+
+	authorName := formStringValueOrDef(r, "comment_name")
+	authorEmail := formStringValueOrDef(r, "comment_email")
+	if user != nil {
+		authorName = user.Name
+		authorEmail = user.Email
+	} else if len(authorName) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "comment_name must be provided and cannot be empty")
+		return
+	}
+
+	// Replies can only be made to comments that are shown on the same Content.
+	parentID := formIntValueOrDef(r, "comment_parent")
+	if parentID != 0 {
+		parent, parentErr := grog.GetComment(parentID)
+		if parentErr != nil || parent.Content != content.ID || parent.Status != model.CommentApproved {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "cannot reply to comment %d", parentID)
+			return
+		}
+	}
+
+	comment := grog.NewComment(content.ID, parentID, authorName, authorEmail, body)
+	if user != nil {
+		comment.User = user.ID
+		if user.CanAddContent() {
+			comment.Status = model.CommentApproved
+		}
+	}
+
+	saveErr := comment.Save()
+	if saveErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "error saving comment")
+		log.Printf("error saving comment on Content %d: %v", content.ID, saveErr)
+		return
+	}
+
+	http.Redirect(w, r, urlForContent(*content), http.StatusSeeOther)
+}
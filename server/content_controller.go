@@ -6,8 +6,8 @@ import (
 	"net/http"
 	"strconv"
 
-	"github.com/adamcrossland/grog/mtemplate"
 	model "github.com/adamcrossland/grog/models"
+	"github.com/adamcrossland/grog/mtemplate"
 	"github.com/gorilla/mux"
 )
 
@@ -25,7 +25,6 @@ func contentController(w http.ResponseWriter, r *http.Request) {
 		getContent(w, r, contentID)
 	case "PUT", "POST":
 		putContent(w, r)
-		// TODO: This must be authenticated and authorized
 
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -56,14 +55,20 @@ func getContent(w http.ResponseWriter, r *http.Request, contentID string) {
 		return
 	}
 
-	if content == nil {
+	if content == nil || (!content.IsPublished() && requestUser(r) == nil) {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "Could not find post %s", contentID)
 		return
 	}
 
-	data := mtemplate.NewTemplateData(w, r, loadedNamedQueries, content)
-	renderErr := mtemplate.RenderFile(content.Template, w, data)
+	// Logged-in users preview unpublished content, and can ask to see it among
+	// the children of published content too.
+	if requestUser(r) != nil && (!content.IsPublished() || len(r.FormValue("preview")) > 0) {
+		content.SetPreview(true)
+	}
+
+	data := mtemplate.NewTemplateData(w, r, namedQueries.Queries(), content)
+	renderErr := renderTemplate(w, content.Template, data)
 	if renderErr != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Error rendering post template: %v", renderErr)
@@ -72,6 +77,13 @@ func getContent(w http.ResponseWriter, r *http.Request, contentID string) {
 }
 
 func putContent(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "authentication required")
+		return
+	}
+
 	r.ParseForm()
 
 	title := formStringValueOrDef(r, "content_title")
@@ -80,6 +92,36 @@ func putContent(w http.ResponseWriter, r *http.Request) {
 	template := formStringValueOrDef(r, "content_template")
 	parentID := formIntValueOrDef(r, "content_parent")
 	contentID := formIntValueOrDef(r, "content_id")
+	status := formStringValueOrDef(r, "content_status")
+	if len(status) > 0 && !model.ValidContentStatus(status) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unknown content_status %s", status)
+		return
+	}
+
+	bodyFormat := formStringValueOrDef(r, "content_body_format")
+	if len(bodyFormat) > 0 && !model.ValidBodyFormat(bodyFormat) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unknown content_body_format %s", bodyFormat)
+		return
+	}
+
+	_, tagsGiven := r.Form["content_tags"]
+	tags := formListValueOrDef(r, "content_tags")
+	for _, tag := range tags {
+		if !model.ValidTagName(tag) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "tag names in content_tags cannot contain slashes: %s", tag)
+			return
+		}
+	}
+
+	publishAt, publishAtOK := formTimeValueOrDef(r, "content_publish_at")
+	if !publishAtOK {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "content_publish_at must be a date and time such as 2006-01-02T15:04")
+		return
+	}
 
 	if contentID > 0 {
 		var getErr error
@@ -92,11 +134,30 @@ func putContent(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if !user.CanEditContent(oldContent) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "you may not change content %d", contentID)
+			return
+		}
+
 		oldContent.UpdateTitle(title)
 		oldContent.Summary = summary
 		oldContent.Body = body
+		oldContent.Editor = user.ID
+		if len(status) > 0 {
+			oldContent.Status = status
+		}
+		if len(bodyFormat) > 0 {
+			oldContent.BodyFormat = bodyFormat
+		}
+		if !publishAt.IsZero() {
+			oldContent.PublishAt.Set(publishAt)
+		}
 
 		saveErr := oldContent.Save()
+		if saveErr == nil && tagsGiven {
+			saveErr = oldContent.SetTags(tags)
+		}
 		if saveErr != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "error updating content: %v", saveErr)
@@ -105,10 +166,29 @@ func putContent(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, urlForContent(*oldContent), http.StatusSeeOther)
 		}
 	} else {
+		if !user.CanAddContent() {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "you may not add content")
+			return
+		}
+
 		newlyAdded := grog.NewContent(title, summary, body, "", template)
 		newlyAdded.Parent = parentID
+		newlyAdded.Author = user.ID
+		if len(status) > 0 {
+			newlyAdded.Status = status
+		}
+		if len(bodyFormat) > 0 {
+			newlyAdded.BodyFormat = bodyFormat
+		}
+		if !publishAt.IsZero() {
+			newlyAdded.PublishAt.Set(publishAt)
+		}
 
 		saveErr := newlyAdded.Save()
+		if saveErr == nil {
+			saveErr = newlyAdded.Tag(tags...)
+		}
 		if saveErr != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "error saving new content: %v", saveErr)
@@ -126,7 +206,7 @@ func urlForContent(content model.Content) string {
 	if len(content.Slug) > 0 {
 		url = "/content/" + content.Slug
 	} else {
-		url = "/content/" + string(content.ID)
+		url = "/content/" + strconv.FormatInt(content.ID, 10)
 	}
 
 	return url
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamcrossland/grog/mtemplate"
 )
 
+// formTimeLayouts are the layouts that formTimeValueOrDef understands. The first is
+// what browsers send from a datetime-local input.
+var formTimeLayouts = []string{"2006-01-02T15:04", time.RFC3339}
+
 func formIntValueOrDef(r *http.Request, formKey string) int64 {
 	var foundValue int64
 
@@ -33,6 +42,39 @@ func formStringValueOrDef(r *http.Request, formKey string) string {
 	return foundValue
 }
 
+// formListValueOrDef splits a comma-separated form value into its non-empty items.
+func formListValueOrDef(r *http.Request, formKey string) []string {
+	var foundValues []string
+
+	for _, item := range strings.Split(formStringValueOrDef(r, formKey), ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			foundValues = append(foundValues, item)
+		}
+	}
+
+	return foundValues
+}
+
+// formTimeValueOrDef returns the time given in the form, or the zero time if none was
+// given. The bool result is false only if a value was given that could not be parsed.
+func formTimeValueOrDef(r *http.Request, formKey string) (time.Time, bool) {
+	var foundValue time.Time
+
+	valStr := formStringValueOrDef(r, formKey)
+	if len(valStr) == 0 {
+		return foundValue, true
+	}
+
+	for _, layout := range formTimeLayouts {
+		parsed, parseErr := time.ParseInLocation(layout, valStr, time.Local)
+		if parseErr == nil {
+			return parsed, true
+		}
+	}
+
+	return foundValue, false
+}
+
 func formIntValRequired(w http.ResponseWriter, r *http.Request, formKey string) int64 {
 	result := formIntValueOrDef(r, formKey)
 
@@ -56,3 +98,17 @@ func formStringValRequired(w http.ResponseWriter, r *http.Request, formKey strin
 
 	return result
 }
+
+// renderTemplate renders a template into a buffer, and writes it to the response only
+// if rendering succeeds, so that a template that fails part of the way through can
+// still be answered with an error.
+func renderTemplate(w http.ResponseWriter, templateName string, data *mtemplate.TemplateData) error {
+	var rendered bytes.Buffer
+
+	renderErr := mtemplate.RenderFile(templateName, &rendered, data)
+	if renderErr == nil {
+		rendered.WriteTo(w)
+	}
+
+	return renderErr
+}
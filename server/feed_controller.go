@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	model "github.com/adamcrossland/grog/models"
+	"github.com/gorilla/mux"
+)
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	DC      string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description,omitempty"`
+	Creator     string  `xml:"dc:creator,omitempty"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Author   *atomPerson `xml:"author,omitempty"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title     string      `xml:"title"`
+	ID        string      `xml:"id"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Links     []atomLink  `xml:"link"`
+	Summary   string      `xml:"summary,omitempty"`
+	Author    *atomPerson `xml:"author,omitempty"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+// feedController produces an RSS 2.0 or Atom feed of the site's published Content or,
+// if a parent is given, of that Content's published children.
+func feedController(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	entries, title, description, feedErr := feedEntries(vars["parent"])
+	if feedErr != nil {
+		log.Printf("error building feed: %v", feedErr)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no feed for %s", vars["parent"])
+		return
+	}
+
+	authors := feedAuthorNames(entries)
+
+	var feed interface{}
+	switch vars["format"] {
+	case "atom":
+		w.Header().Set("Content-type", "application/atom+xml; charset=utf-8")
+		feed = makeAtomFeed(r, entries, authors, title, description)
+	default:
+		w.Header().Set("Content-type", "application/rss+xml; charset=utf-8")
+		feed = makeRSSFeed(r, entries, authors, title, description)
+	}
+
+	fmt.Fprint(w, xml.Header)
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if encodeErr := encoder.Encode(feed); encodeErr != nil {
+		log.Printf("error writing feed: %v", encodeErr)
+	}
+}
+
+// feedEntries finds the newest published Content for a feed, along with the feed's
+// title and description.
+func feedEntries(parentID string) ([]*model.Content, string, string, error) {
+	var entries []*model.Content
+	title := site.Title
+	description := site.Description
+
+	if parentID == "" {
+		allContents, allErr := grog.AllContents()
+		if allErr != nil {
+			return nil, "", "", allErr
+		}
+
+		for _, content := range allContents {
+			if content.IsPublished() {
+				entries = append(entries, content)
+			}
+		}
+	} else {
+		var parent *model.Content
+		var parentErr error
+
+		if parsedID, parseErr := strconv.ParseInt(parentID, 10, 64); parseErr == nil {
+			parent, parentErr = grog.GetContent(parsedID)
+		} else {
+			parent, parentErr = grog.GetContentBySlug(parentID)
+		}
+		if parentErr != nil {
+			return nil, "", "", parentErr
+		}
+		if !parent.IsPublished() {
+			return nil, "", "", fmt.Errorf("content %s is not published", parentID)
+		}
+
+		entries = parent.IncludeChildren().Children
+		title = parent.Title
+		description = parent.Summary
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return publishedTime(entries[i]).After(publishedTime(entries[j]))
+	})
+
+	if len(entries) > site.FeedLimit {
+		entries = entries[:site.FeedLimit]
+	}
+
+	return entries, title, description, nil
+}
+
+// publishedTime is when the Content went live: its PublishAt time if it was scheduled,
+// otherwise when it was added.
+func publishedTime(content *model.Content) time.Time {
+	if content.Status == model.ContentScheduled && !content.PublishAt.IsNull() {
+		return content.PublishAt.Val()
+	}
+
+	return content.Added.Val()
+}
+
+// feedAuthorNames looks up the names of the Users who wrote the entries.
+func feedAuthorNames(entries []*model.Content) map[int64]string {
+	authors := make(map[int64]string)
+
+	for _, entry := range entries {
+		if _, found := authors[entry.Author]; found {
+			continue
+		}
+
+		authors[entry.Author] = ""
+		if author, authorErr := grog.GetUser(entry.Author); authorErr == nil {
+			authors[entry.Author] = author.Name
+		}
+	}
+
+	return authors
+}
+
+func makeRSSFeed(r *http.Request, entries []*model.Content, authors map[int64]string,
+	title string, description string) *rssFeed {
+
+	feed := &rssFeed{Version: "2.0", DC: "http://purl.org/dc/elements/1.1/"}
+	feed.Channel.Title = title
+	feed.Channel.Link = site.absoluteURL(r, "/")
+	feed.Channel.Description = description
+
+	if len(entries) > 0 {
+		feed.Channel.LastBuildDate = publishedTime(entries[0]).Format(time.RFC1123Z)
+	}
+
+	for _, entry := range entries {
+		link := site.absoluteURL(r, urlForContent(*entry))
+
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       entry.Title,
+			Link:        link,
+			Description: entry.Summary,
+			Creator:     authors[entry.Author],
+			GUID:        rssGUID{IsPermaLink: true, Value: link},
+			PubDate:     publishedTime(entry).Format(time.RFC1123Z),
+		})
+	}
+
+	return feed
+}
+
+func makeAtomFeed(r *http.Request, entries []*model.Content, authors map[int64]string,
+	title string, description string) *atomFeed {
+
+	feed := &atomFeed{
+		Title:    title,
+		Subtitle: description,
+		ID:       site.absoluteURL(r, r.URL.Path),
+		Links: []atomLink{
+			{Href: site.absoluteURL(r, r.URL.Path), Rel: "self"},
+			{Href: site.absoluteURL(r, "/"), Rel: "alternate"},
+		},
+		// Atom requires an author for every entry; this one stands in for entries
+		// whose author is not known.
+		Author: &atomPerson{Name: site.Title},
+	}
+
+	var updated time.Time
+	for _, entry := range entries {
+		link := site.absoluteURL(r, urlForContent(*entry))
+
+		newEntry := atomEntry{
+			Title:     entry.Title,
+			ID:        link,
+			Updated:   entry.Modified.Val().Format(time.RFC3339),
+			Published: publishedTime(entry).Format(time.RFC3339),
+			Links:     []atomLink{{Href: link, Rel: "alternate"}},
+			Summary:   entry.Summary,
+		}
+		if name := authors[entry.Author]; name != "" {
+			newEntry.Author = &atomPerson{Name: name}
+		}
+
+		if entry.Modified.Val().After(updated) {
+			updated = entry.Modified.Val()
+		}
+
+		feed.Entries = append(feed.Entries, newEntry)
+	}
+
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+
+	return feed
+}
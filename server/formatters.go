@@ -22,6 +22,10 @@ func ShortDateFormatter(w io.Writer, format string, data *mtemplate.TemplateData
 		if timeValOK {
 			timeToRender = timeVal.Val()
 			foundTime = true
+		} else if plainTime, plainTimeOK := value[0].(time.Time); plainTimeOK {
+			// Named query results give date columns as time.Time
+			timeToRender = plainTime
+			foundTime = true
 		} else {
 			// Try to convert from an int64 representation of time
 			intVal, intValOK := value[0].(int64)
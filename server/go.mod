@@ -6,3 +6,7 @@ require (
 	github.com/adamcrossland/grog v0.0.0-20190918185639-89838bfbce50
 	github.com/gorilla/mux v1.8.0
 )
+
+require golang.org/x/crypto v0.9.0 // indirect
+
+replace github.com/adamcrossland/grog => ../
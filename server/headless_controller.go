@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamcrossland/grog/mtemplate"
+	"github.com/gorilla/mux"
+)
+
+// headlessQueryResults is the JSON form of the results of a named query. The columns
+// are given separately so that their order is kept.
+type headlessQueryResults struct {
+	Query   string                   `json:"query"`
+	Columns []string                 `json:"columns"`
+	Rows    []map[string]interface{} `json:"rows"`
+}
+
+// headlessQueryController runs a named query and gives its results as JSON or, if the
+// Accept header prefers it, as CSV, so that scripts in the browser can get the same
+// data that templates get with .model. Only queries that have been made public can be
+// run this way, and only with the parameters that they declare, which are taken from
+// the URL as they are for .model.
+func headlessQueryController(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		apiMethodNotAllowed(w, r, "GET")
+		return
+	}
+
+	queryName := mux.Vars(r)["name"]
+	query, querier := namedQueries.Lookup(queryName)
+	if query == nil || !query.Public {
+		apiError(w, http.StatusNotFound, "no query named %s", queryName)
+		return
+	}
+
+	params, paramsErr := mtemplate.ParseModelParameters(query.Params)
+	if paramsErr != nil {
+		log.Printf("namedquery[%s] has parameters that are not valid: %v", queryName, paramsErr)
+		apiError(w, http.StatusInternalServerError, "query %s is not set up correctly", queryName)
+		return
+	}
+
+	paramValues := make([]interface{}, 0, len(params))
+	for _, param := range params {
+		value, valueErr := param.Value(r)
+		if valueErr != nil {
+			apiError(w, http.StatusBadRequest, "%v", valueErr)
+			return
+		}
+		paramValues = append(paramValues, value)
+	}
+
+	results, queryErr := querier(paramValues)
+	if queryErr != nil {
+		log.Printf("error running namedquery[%s] for %s: %v", queryName, r.URL, queryErr)
+		apiError(w, http.StatusInternalServerError, "error running query %s", queryName)
+		return
+	}
+
+	// The rows are read in full before anything is written, so that an error part of
+	// the way through, such as going over the row limit, can still be reported.
+	rows, rowsErr := results.All()
+	if rowsErr != nil {
+		log.Printf("error reading results of namedquery[%s] for %s: %v", queryName, r.URL, rowsErr)
+		apiError(w, http.StatusInternalServerError, "error running query %s", queryName)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+
+	if prefersCSV(r) {
+		w.Header().Set("Content-type", "text/csv; charset=utf-8")
+		writer := csv.NewWriter(w)
+		writer.Write(results.Columns())
+		for _, row := range rows {
+			record := make([]string, 0, len(row))
+			for _, column := range results.Columns() {
+				record = append(record, csvValue(row[column]))
+			}
+			writer.Write(record)
+		}
+		writer.Flush()
+		if writeErr := writer.Error(); writeErr != nil {
+			log.Printf("error writing results of namedquery[%s]: %v", queryName, writeErr)
+		}
+		return
+	}
+
+	for _, row := range rows {
+		for column, value := range row {
+			// Text that the database gives as bytes would otherwise be sent as base64.
+			if bytes, isBytes := value.([]byte); isBytes {
+				row[column] = string(bytes)
+			}
+		}
+	}
+	writeAPIJSON(w, http.StatusOK, headlessQueryResults{queryName, results.Columns(), rows})
+}
+
+// prefersCSV reports whether the Accept header of the request ranks text/csv above
+// application/json. JSON is given when neither is asked for.
+func prefersCSV(r *http.Request) bool {
+	var csvQuality, jsonQuality float64
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, parseErr := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if parseErr != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, found := params["q"]; found {
+			if parsed, qErr := strconv.ParseFloat(q, 64); qErr == nil {
+				quality = parsed
+			}
+		}
+
+		switch mediaType {
+		case "text/csv":
+			if quality > csvQuality {
+				csvQuality = quality
+			}
+		case "application/json":
+			if quality > jsonQuality {
+				jsonQuality = quality
+			}
+		}
+	}
+
+	return csvQuality > jsonQuality
+}
+
+// csvValue gives the text of a value from the results of a named query. NULL is given
+// as an empty field.
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+
+	return fmt.Sprint(value)
+}
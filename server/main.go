@@ -16,7 +16,6 @@ import (
 )
 
 var grog *model.GrogModel
-var loadedNamedQueries map[string]model.NamedQueryFunc
 
 func main() {
 	argsWithoutProg := os.Args[1:]
@@ -24,6 +23,8 @@ func main() {
 		switch strings.ToLower(argsWithoutProg[i]) {
 		case "--no-cache":
 			mtemplate.Cache = false
+		case "--autoescape":
+			mtemplate.AutoEscape = true
 		}
 	}
 
@@ -36,8 +37,18 @@ func main() {
 	db := manageddb.NewManagedDB(dbFilename, "sqlite3", migrations.DatabaseMigrations, false)
 	grog = model.NewModel(db)
 
+	// Sessions that expired while the server was down are of no further use
+	if sessionErr := grog.DeleteExpiredSessions(); sessionErr != nil {
+		log.Printf("error removing expired sessions: %v", sessionErr)
+	}
+
+	loadSiteSettings()
+
 	// Load namedqueries
-	loadedNamedQueries = grog.LoadNamedQueries()
+	loadNamedQueries()
+	if policy := os.Getenv("GROG_MODEL_ERROR_POLICY"); policy != "" {
+		mtemplate.DefaultModelErrorPolicy = policy
+	}
 
 	// Set up templating engine to read files from the database
 	mtemplate.TemplateSourceReader = dbFileReader
@@ -49,13 +60,26 @@ func main() {
 
 	// Set up request routing
 	r := mux.NewRouter()
-
-	r.HandleFunc("/content/{id:[a-zA-z0-9/\\-_\\.]+}", contentController)
-	r.HandleFunc("/content", contentController)
-	r.HandleFunc("/asset/{id:[a-zA-Z0-9/\\-_\\.]+}", assetController)
-	r.HandleFunc("/asset", assetController)
-	r.HandleFunc("/{id:[a-zA-Z0-9/\\-_\\.]+}", assetController)
-	r.HandleFunc("/", assetController)
+	registerAPIRoutes(r)
+
+	r.HandleFunc("/login", loginController)
+	r.HandleFunc("/logout", logoutController)
+	r.HandleFunc("/feed/{format:rss|atom}", feedController)
+	r.HandleFunc("/feed/{format:rss|atom}/{parent:[a-zA-Z0-9\\-_\\.]+}", feedController)
+	r.HandleFunc("/admin/queries/reload", authorizeWrites(queryReloadController))
+	r.HandleFunc("/q/{name}", headlessQueryController)
+	r.HandleFunc("/sitemap.xml", sitemapController)
+	r.HandleFunc("/sitemap-{page:[0-9]+}.xml", sitemapController)
+	r.HandleFunc("/search", authorizeWrites(searchController))
+	r.HandleFunc("/tag/{name:[^/,]+}", authorizeWrites(tagController))
+	r.HandleFunc("/robots.txt", authorizeWrites(robotsController))
+	r.HandleFunc("/content/{id:[a-zA-Z0-9\\-_\\.]+}/comments", commentController)
+	r.HandleFunc("/content/{id:[a-zA-z0-9/\\-_\\.]+}", authorizeWrites(contentController))
+	r.HandleFunc("/content", authorizeWrites(contentController))
+	r.HandleFunc("/asset/{id:[a-zA-Z0-9/\\-_\\.]+}", authorizeWrites(assetController))
+	r.HandleFunc("/asset", authorizeWrites(assetController))
+	r.HandleFunc("/{id:[a-zA-Z0-9/\\-_\\.]+}", authorizeWrites(assetController))
+	r.HandleFunc("/", authorizeWrites(assetController))
 	http.Handle("/", r)
 
 	servingAddress := os.Getenv("GROG_SERVER_ADDRESS")
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	model "github.com/adamcrossland/grog/models"
+	"github.com/adamcrossland/grog/mtemplate"
+)
+
+var namedQueries *model.NamedQueryRegistry
+
+// loadNamedQueries loads the named queries and arranges for them to be reloaded when
+// they change: whenever the server gets a SIGHUP, and, if GROG_QUERY_POLL is set to a
+// duration such as "30s", whenever a check that often finds that the queries table has
+// changed. GROG_QUERY_TIMEOUT and GROG_QUERY_MAX_ROWS set the limits for queries that
+// do not have their own.
+func loadNamedQueries() {
+	if timeoutSetting := os.Getenv("GROG_QUERY_TIMEOUT"); timeoutSetting != "" {
+		timeout, timeoutErr := time.ParseDuration(timeoutSetting)
+		if timeoutErr != nil || timeout <= 0 {
+			log.Printf("GROG_QUERY_TIMEOUT must be a positive duration; using %v", model.DefaultQueryTimeout)
+		} else {
+			model.DefaultQueryTimeout = timeout
+		}
+	}
+	if maxRowsSetting := os.Getenv("GROG_QUERY_MAX_ROWS"); maxRowsSetting != "" {
+		maxRows, maxRowsErr := strconv.Atoi(maxRowsSetting)
+		if maxRowsErr != nil || maxRows < 1 {
+			log.Printf("GROG_QUERY_MAX_ROWS must be a positive integer; using %d", model.DefaultQueryRowLimit)
+		} else {
+			model.DefaultQueryRowLimit = maxRows
+		}
+	}
+
+	var loadErr error
+	namedQueries, loadErr = grog.NewNamedQueryRegistry()
+	if loadErr != nil {
+		log.Printf("error loading named queries: %v", loadErr)
+	}
+
+	mtemplate.NamedQueryExists = namedQueries.Exists
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			reloadNamedQueries("SIGHUP")
+		}
+	}()
+
+	if pollSetting := os.Getenv("GROG_QUERY_POLL"); pollSetting != "" {
+		interval, intervalErr := time.ParseDuration(pollSetting)
+		if intervalErr != nil || interval <= 0 {
+			log.Printf("GROG_QUERY_POLL must be a positive duration; not checking for changed queries")
+			return
+		}
+
+		go func() {
+			for range time.Tick(interval) {
+				reloaded, reloadErr := namedQueries.ReloadIfChanged()
+				if reloadErr != nil {
+					log.Printf("error reloading named queries: %v", reloadErr)
+				} else if reloaded {
+					log.Printf("named queries reloaded after a change")
+				}
+			}
+		}()
+	}
+}
+
+func reloadNamedQueries(reason string) error {
+	reloadErr := namedQueries.Reload()
+	if reloadErr != nil {
+		log.Printf("error reloading named queries on %s: %v", reason, reloadErr)
+	} else {
+		log.Printf("named queries reloaded on %s", reason)
+	}
+
+	return reloadErr
+}
+
+// queryReloadController reloads the named queries on request from a User who may edit
+// them.
+func queryReloadController(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if user := requestUser(r); user == nil || !user.CanEditQueries() {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "not allowed to reload queries")
+		return
+	}
+
+	if reloadErr := reloadNamedQueries("request"); reloadErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error reloading queries: %v", reloadErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "queries reloaded")
+}
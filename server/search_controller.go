@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	model "github.com/adamcrossland/grog/models"
+	"github.com/adamcrossland/grog/mtemplate"
+)
+
+// searchResultLimit is the most results that one search will show.
+const searchResultLimit = 50
+
+// searchPage is the model that the search template is rendered with.
+type searchPage struct {
+	Query   string
+	Results []*model.ContentSearchResult
+}
+
+// searchController searches the site's Content for the words given in the q parameter
+// and renders the results with the template named by GROG_SEARCH_TEMPLATE, or
+// search.html if it is not set. Logged-in users also find unpublished Content.
+func searchController(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	page := searchPage{Query: r.FormValue("q")}
+
+	var searchErr error
+	page.Results, searchErr = grog.SearchContent(page.Query, searchResultLimit, requestUser(r) != nil)
+	if searchErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Error while searching")
+		log.Printf("error searching for %q: %v", page.Query, searchErr)
+		return
+	}
+
+	templateName := os.Getenv("GROG_SEARCH_TEMPLATE")
+	if templateName == "" {
+		templateName = "search.html"
+	}
+
+	data := mtemplate.NewTemplateData(w, r, namedQueries.Queries(), page)
+	renderErr := renderTemplate(w, templateName, data)
+	if renderErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error rendering search template: %v", renderErr)
+		log.Printf("Error rendering search template: %v", renderErr)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// siteSettings describes the site as a whole. It is used when producing documents,
+// such as feeds, that tell other programs about the site.
+type siteSettings struct {
+	Title       string
+	URL         string // Absolute URL of the site, without a trailing slash
+	Description string
+	FeedLimit   int // Most entries that a feed will contain
+	// Paths that robots.txt asks crawlers to stay out of, if there is no robots.txt asset
+	RobotsDisallow []string
+}
+
+var site siteSettings
+
+// loadSiteSettings reads the site settings from the environment. None of them are
+// required; when GROG_SITE_URL is not set, URLs are built from the request instead.
+func loadSiteSettings() {
+	site.Title = os.Getenv("GROG_SITE_TITLE")
+	site.URL = strings.TrimSuffix(os.Getenv("GROG_SITE_URL"), "/")
+	site.Description = os.Getenv("GROG_SITE_DESCRIPTION")
+
+	site.FeedLimit = 20
+	if feedLimit := os.Getenv("GROG_FEED_LIMIT"); feedLimit != "" {
+		limit, limitErr := strconv.Atoi(feedLimit)
+		if limitErr != nil || limit < 1 {
+			log.Printf("GROG_FEED_LIMIT must be a positive integer; using %d", site.FeedLimit)
+		} else {
+			site.FeedLimit = limit
+		}
+	}
+
+	site.RobotsDisallow = []string{"/login", "/logout"}
+	if disallow, disallowOK := os.LookupEnv("GROG_ROBOTS_DISALLOW"); disallowOK {
+		site.RobotsDisallow = nil
+		for _, path := range strings.Split(disallow, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				site.RobotsDisallow = append(site.RobotsDisallow, path)
+			}
+		}
+	}
+}
+
+// absoluteURL turns a path on this site into a full URL.
+func (settings siteSettings) absoluteURL(r *http.Request, path string) string {
+	base := settings.URL
+	if base == "" {
+		base = "https://" + r.Host
+	}
+
+	return base + path
+}
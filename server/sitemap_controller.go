@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	model "github.com/adamcrossland/grog/models"
+	"github.com/gorilla/mux"
+)
+
+// sitemapMaxEntries is the most URLs that the sitemap protocol allows in one file.
+// Larger sitemaps are split up and listed in a sitemap index.
+var sitemapMaxEntries = 50000
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+// sitemapController lists every published Content and every externally-served Asset.
+// If there are too many to fit in one sitemap, /sitemap.xml is an index of numbered
+// sitemaps instead.
+func sitemapController(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries, entriesErr := sitemapEntries(r)
+	if entriesErr != nil {
+		log.Printf("error building sitemap: %v", entriesErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	pageCount := (len(entries) + sitemapMaxEntries - 1) / sitemapMaxEntries
+
+	var document interface{}
+	if pageParam, isPage := mux.Vars(r)["page"]; isPage {
+		page, _ := strconv.Atoi(pageParam)
+		if page < 1 || page > pageCount {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		end := page * sitemapMaxEntries
+		if end > len(entries) {
+			end = len(entries)
+		}
+		document = &sitemapURLSet{URLs: entries[(page-1)*sitemapMaxEntries : end]}
+	} else if pageCount > 1 {
+		index := new(sitemapIndex)
+		for page := 1; page <= pageCount; page++ {
+			index.Sitemaps = append(index.Sitemaps,
+				sitemapURL{Loc: site.absoluteURL(r, fmt.Sprintf("/sitemap-%d.xml", page))})
+		}
+		document = index
+	} else {
+		document = &sitemapURLSet{URLs: entries}
+	}
+
+	w.Header().Set("Content-type", "application/xml; charset=utf-8")
+	fmt.Fprint(w, xml.Header)
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if encodeErr := encoder.Encode(document); encodeErr != nil {
+		log.Printf("error writing sitemap: %v", encodeErr)
+	}
+}
+
+func sitemapEntries(r *http.Request) ([]sitemapURL, error) {
+	var entries []sitemapURL
+
+	allContents, contentsErr := grog.AllContents()
+	if contentsErr != nil {
+		return nil, contentsErr
+	}
+
+	for _, content := range allContents {
+		if content.IsPublished() {
+			entries = append(entries, sitemapURL{
+				Loc:     site.absoluteURL(r, urlForContent(*content)),
+				LastMod: content.Modified.Val().Format(time.RFC3339),
+			})
+		}
+	}
+
+	allAssets, assetsErr := grog.AllAssets()
+	if assetsErr != nil {
+		return nil, assetsErr
+	}
+
+	for _, asset := range allAssets {
+		if asset.ServeExternal {
+			entries = append(entries, sitemapURL{
+				Loc:     site.absoluteURL(r, urlForAsset(asset)),
+				LastMod: asset.Modified.Val().Format(time.RFC3339),
+			})
+		}
+	}
+
+	return entries, nil
+}
+
+// urlForAsset gives the path at which assetController serves the Asset.
+func urlForAsset(asset *model.Asset) string {
+	if asset.Name == "index" {
+		return "/"
+	}
+
+	return "/" + asset.Name
+}
+
+// robotsController serves the robots.txt asset if there is one. Otherwise, it makes
+// one up from the site settings that points crawlers at the sitemap.
+func robotsController(w http.ResponseWriter, r *http.Request) {
+	if grog.AssetExists("robots.txt") {
+		assetController(w, mux.SetURLVars(r, map[string]string{"id": "robots.txt"}))
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var robots strings.Builder
+	robots.WriteString("User-agent: *\n")
+	if len(site.RobotsDisallow) == 0 {
+		robots.WriteString("Disallow:\n")
+	}
+	for _, path := range site.RobotsDisallow {
+		fmt.Fprintf(&robots, "Disallow: %s\n", path)
+	}
+	fmt.Fprintf(&robots, "\nSitemap: %s\n", site.absoluteURL(r, "/sitemap.xml"))
+
+	w.Header().Set("Content-type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, robots.String())
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/adamcrossland/grog/mtemplate"
+	"github.com/gorilla/mux"
+)
+
+// tagController renders a Tag with the template named by GROG_TAG_TEMPLATE, or
+// tag.html if it is not set. The template can list the tagged Content through the
+// Tag's Contents; logged-in users also see unpublished Content there.
+func tagController(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	tagName := mux.Vars(r)["name"]
+
+	tag, tagErr := grog.GetTag(tagName)
+	if tagErr != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Could not find tag %s", tagName)
+		return
+	}
+
+	if requestUser(r) != nil {
+		tag.SetPreview(true)
+	}
+
+	templateName := os.Getenv("GROG_TAG_TEMPLATE")
+	if templateName == "" {
+		templateName = "tag.html"
+	}
+
+	data := mtemplate.NewTemplateData(w, r, namedQueries.Queries(), tag)
+	renderErr := renderTemplate(w, templateName, data)
+	if renderErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error rendering tag template: %v", renderErr)
+		log.Printf("Error rendering tag template: %v", renderErr)
+	}
+}